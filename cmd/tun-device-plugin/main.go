@@ -16,43 +16,352 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/health"
-	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/anza-labs/tun-manager/pkg/config"
+	"github.com/anza-labs/tun-manager/pkg/logging"
 	"github.com/anza-labs/tun-manager/pkg/metrics"
+	"github.com/anza-labs/tun-manager/pkg/node"
 	"github.com/anza-labs/tun-manager/pkg/plugin"
+	"github.com/anza-labs/tun-manager/pkg/servers/admin"
 	"github.com/anza-labs/tun-manager/pkg/servers/tundeviceplugin"
 )
 
 const (
-	pluginNamespace = "devices.anza-labs.dev"
-	gracePeriod     = 5 * time.Second
+	defaultPluginNamespace = "devices.anza-labs.dev"
+	defaultGracePeriod     = 5 * time.Second
+	socketDirPerm          = 0o750
+	adminSocketPerm        = 0o600
+
+	bindBaseDelay  = 100 * time.Millisecond
+	bindMaxDelay   = 5 * time.Second
+	bindMaxRetries = 5
+
+	// socketDialTimeout bounds the check for a live instance on an existing socket.
+	socketDialTimeout = time.Second
+
+	numDevicesEnv = "TUN_NUM_DEVICES"
+)
+
+// Populated at build time with -ldflags "-X main.version=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
 var (
+	printVersion bool
+	configPath   string
+
+	pluginNamespace  string
+	devicePluginPath string
+	grpcReflection   bool
+	socketModeFlag   string
+	socketMode       os.FileMode
+
 	logLevel   string
-	maxDevices uint
+	logFormat  string
+	logRedact  string
+	logFile    string
+	numDevices uint
+	numTAP     uint
+	maxAllocs  int
+	stackDump  bool
+
+	// numDevicesSet is true when the device count was given on the command line.
+	numDevicesSet bool
+
+	admissionAllow string
+	admissionDeny  string
+
+	nodeNameFlag string
+	maxWatchers  int
+
+	discoveryPolicy string
+
+	quitEndpoint  bool
+	quitAllowlist string
+
+	allocationCacheSize int
+	fdSampleInterval    time.Duration
+
+	panicThreshold int
+	panicWindow    time.Duration
+
+	allocateLatencyMetric     string
+	allocateLatencyObjectives string
+
+	discoveryMode     string
+	discoveryInterval time.Duration
+
+	minUptime time.Duration
+
+	adminSocket string
+
+	allocationStrategy string
+
+	fastInterrupt bool
+
+	envPrefix string
+
+	discoveryDebounce time.Duration
+	healthDebounce    time.Duration
+
+	cdiEnabled  bool
+	cdiSpecPath string
+
+	metricsAddr string
+	metricsPath string
+
+	cgroupHints bool
+
+	metricsEnabled  bool
+	pprofAddr       string
+	metricsTLSCert  string
+	metricsTLSKey   string
+	metricsClientCA string
+
+	gracePeriod       time.Duration
+	drainPeriod       time.Duration
+	registerRetry     plugin.RetryConfig
+	healthInterval    time.Duration
+	selfProbeInterval time.Duration
+	numaNodes         string
+	strictNumbers     bool
+	prestartMknod     bool
+
+	deviceHostPath      string
+	deviceContainerPath string
+
+	nodeDrain           bool
+	nodeDrainConditions string
+	nodeDrainInterval   time.Duration
+
+	nodeHealthAnnotation bool
+
+	deviceIDFormat    string
+	devicePermissions string
+
+	healthServiceName string
+
+	runPreflight bool
+
+	allocationAnnotations string
+
+	kubeletSocket   string
+	registerTimeout time.Duration
+
+	registrationMode   string
+	pluginsRegistryDir string
+
+	grpcListen       string
+	skipRegistration bool
 )
 
+// parseFlags registers the command line flags on fs, with their defaults,
+// and parses args.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	registerRetry = plugin.DefaultRetryConfig()
+	numDevicesSet = false
+
+	fs.BoolVar(&printVersion, "version", false, "Print the version and exit")
+	fs.StringVar(&pluginNamespace, "plugin-namespace", defaultPluginNamespace,
+		"Namespace of the advertised resources, must be a DNS-1123 subdomain")
+	fs.StringVar(&devicePluginPath, "device-plugin-path", v1beta1.DevicePluginPath,
+		"Directory of the kubelet device plugin sockets")
+	fs.BoolVar(&grpcReflection, "grpc-reflection", false,
+		"Register gRPC reflection on the device plugin server, for debugging only")
+	fs.StringVar(&socketModeFlag, "socket-mode", "0600", "Octal file mode of the unix sockets created by the plugin")
+	fs.StringVar(&configPath, "config", "",
+		"Path of a YAML file declaring the served resources, overrides the device count and path flags; "+
+			"it is re-read on SIGHUP")
+	fs.StringVar(&logLevel, "log-level", "info", "Set log level (debug, info, warn, error)")
+	fs.StringVar(&logFormat, "log-format", "text", "Set log format (text, json)")
+	fs.StringVar(&logRedact, "log-redact", logging.RedactNone,
+		"Redaction of pod and container identifiers in logs (none, hash)")
+	fs.StringVar(&logFile, "log-file", "", "Append logs to this file instead of stdout")
+	fs.UintVar(&numDevices, "num-devices", tundeviceplugin.DefaultDeviceCount,
+		"Set number of devices presented to kubelet, the TUN_NUM_DEVICES env is used when unset")
+	fs.UintVar(&numDevices, "devices", tundeviceplugin.DefaultDeviceCount, "Deprecated: use -num-devices")
+	fs.UintVar(&numTAP, "num-tap-devices", 0,
+		"Set number of tap devices presented to kubelet, 0 disables the tap resource")
+	fs.IntVar(&maxAllocs, "max-allocations", 0,
+		"Maximum number of concurrently allocated devices per resource, 0 disables the cap")
+	fs.BoolVar(&stackDump, "panic-stack-dump", false, "Log a full goroutine dump when a panic is recovered")
+	fs.StringVar(&admissionAllow, "admission-allow", "",
+		"Regex of container names allowed to allocate devices (best-effort, not a security boundary)")
+	fs.StringVar(&admissionDeny, "admission-deny", "",
+		"Regex of container names denied from allocating devices (best-effort, not a security boundary)")
+	fs.IntVar(&maxWatchers, "max-watchers", tundeviceplugin.DefaultMaxWatchers,
+		"Maximum number of concurrent ListAndWatch streams, 0 disables the limit")
+	fs.StringVar(&discoveryPolicy, "discovery-policy", string(tundeviceplugin.DiscoveryPolicyCap),
+		"Policy when discovery finds more devices than configured (cap, expand)")
+	fs.BoolVar(&quitEndpoint, "quit-endpoint", false, "Expose POST /quitquitquit to trigger a graceful shutdown")
+	fs.StringVar(&quitAllowlist, "quit-allowlist", "127.0.0.1/32,::1/128",
+		"Comma-separated CIDRs allowed to call /quitquitquit")
+	fs.IntVar(&allocationCacheSize, "allocation-cache-size", 0,
+		"Number of allocation responses cached for repeated requests, 0 disables the cache")
+	fs.DurationVar(&fdSampleInterval, "fd-sample-interval", 30*time.Second,
+		"Interval for sampling the number of open file descriptors")
+	fs.IntVar(&panicThreshold, "panic-threshold", 0,
+		"Exit once more than this many panics are recovered within -panic-window, 0 disables it")
+	fs.DurationVar(&panicWindow, "panic-window", time.Minute, "Window used by -panic-threshold")
+	fs.StringVar(&allocateLatencyMetric, "allocate-latency-metric", metrics.LatencyHistogram,
+		"Metric type for Allocate latency (histogram, summary, both)")
+	fs.StringVar(&allocateLatencyObjectives, "allocate-latency-objectives", "0.5:0.05,0.9:0.01,0.99:0.001",
+		"Comma-separated quantile:error objectives for the Allocate latency summary")
+	fs.StringVar(&discoveryMode, "discovery-mode", string(tundeviceplugin.DiscoveryModePoll),
+		"How device changes are detected (poll, watch)")
+	fs.DurationVar(&discoveryInterval, "discovery-interval", 10*time.Second, "Interval for re-discovering the device")
+	fs.DurationVar(&minUptime, "min-uptime", 0,
+		"Minimum uptime before acting on a shutdown signal, a second signal shuts down immediately")
+	fs.StringVar(&adminSocket, "admin-socket", "",
+		"Endpoint of the admin gRPC service (e.g. unix:///run/tun-manager/admin.sock), disabled when empty")
+	fs.StringVar(&allocationStrategy, "allocation-strategy", "",
+		"Preferred allocation strategy (packed, spread), disabled when empty")
+	fs.BoolVar(&fastInterrupt, "fast-sigint", false,
+		"Stop immediately on SIGINT instead of shutting down gracefully, SIGTERM stays graceful")
+	fs.StringVar(&envPrefix, "env-prefix", tundeviceplugin.DefaultEnvPrefix,
+		"Prefix of the environment variables injected into containers")
+	fs.DurationVar(&healthDebounce, "health-debounce", time.Second,
+		"Time device events must settle before health changes are propagated, 0 disables it")
+	fs.DurationVar(&discoveryDebounce, "discovery-debounce", 0,
+		"Time the device must be stably present at startup before it is advertised")
+	fs.BoolVar(&cdiEnabled, "cdi", false, "Generate a CDI spec and return CDI devices on allocation")
+	fs.StringVar(&cdiSpecPath, "cdi-spec-path", tundeviceplugin.DefaultCDISpecPath,
+		"Path of the generated CDI spec, the directory must be mounted from the host")
+	fs.BoolVar(&metricsEnabled, "metrics-enabled", true,
+		"Serve the HTTP server with metrics, /readyz and /quitquitquit")
+	fs.StringVar(&pprofAddr, "pprof-addr", "", "Endpoint of the pprof HTTP server, disabled when empty")
+	fs.StringVar(&metricsAddr, "metrics-addr", "tcp://0.0.0.0:8080", "Endpoint of the metrics HTTP server")
+	fs.StringVar(&metricsPath, "metrics-path", "/metrics", "Path the metrics are served on")
+	fs.BoolVar(&cgroupHints, "cgroup-device-hints", false,
+		"Annotate allocations with the cgroup v2 device rule on cgroup v2 nodes")
+	fs.StringVar(&metricsTLSCert, "metrics-tls-cert", "", "TLS certificate for the metrics server, enables HTTPS")
+	fs.StringVar(&metricsTLSKey, "metrics-tls-key", "", "TLS key for the metrics server, enables HTTPS")
+	fs.StringVar(&metricsClientCA, "metrics-client-ca", "",
+		"CA used to verify client certificates for the metrics server, enables mTLS")
+	fs.IntVar(&registerRetry.MaxRetries, "register-max-retries", registerRetry.MaxRetries,
+		"Maximum attempts to connect to the plugin socket and register with the kubelet")
+	fs.DurationVar(&registerRetry.BaseDelay, "register-base-delay", registerRetry.BaseDelay,
+		"Initial delay between registration attempts")
+	fs.DurationVar(&registerRetry.MaxDelay, "register-max-delay", registerRetry.MaxDelay,
+		"Maximum delay between registration attempts")
+	fs.DurationVar(&drainPeriod, "drain-period", 2*time.Second,
+		"Time the kubelet is given to observe the devices as unhealthy before the servers are stopped")
+	fs.DurationVar(&gracePeriod, "grace-period", defaultGracePeriod,
+		"Time in-flight requests are given to complete on shutdown before servers are stopped")
+	fs.DurationVar(&healthInterval, "health-interval", 30*time.Second,
+		"Interval of the active device health probe, 0 disables it")
+	fs.StringVar(&numaNodes, "numa-node", "",
+		"Comma separated NUMA nodes stamped on advertised devices, or auto to detect them")
+	fs.BoolVar(&strictNumbers, "strict-device-numbers", false,
+		"Mark devices unhealthy when /dev/net/tun is not 10:200, instead of only warning")
+	fs.StringVar(&deviceHostPath, "device-host-path", tundeviceplugin.DefaultDevicePath,
+		"Path of the tun device on the host")
+	fs.StringVar(&deviceContainerPath, "device-container-path", tundeviceplugin.DefaultDevicePath,
+		"Path the tun device is exposed at in containers")
+	fs.BoolVar(&prestartMknod, "prestart-mknod", false,
+		"Create the device node before containers start if it is missing, requires CAP_MKNOD")
+	fs.DurationVar(&selfProbeInterval, "self-probe-interval", 0,
+		"Interval of the self allocation probe reported by /readyz, 0 disables it")
+	fs.StringVar(&nodeNameFlag, "node-name", "",
+		"Name of the node the plugin runs on (defaults to NODE_NAME env or hostname)")
+	fs.BoolVar(&nodeDrain, "node-drain", false,
+		"Drain devices while the node is cordoned or has one of the node-drain-conditions")
+	fs.StringVar(&nodeDrainConditions, "node-drain-conditions", "NetworkUnavailable",
+		"Comma separated node conditions that drain the devices while True")
+	fs.DurationVar(&nodeDrainInterval, "node-drain-interval", 30*time.Second, "Resync period of the node state watch")
+	fs.StringVar(&deviceIDFormat, "device-id-format", "",
+		"Format of the device IDs, a template with one integer verb (e.g. tun-%04d) or uuid, "+
+			"defaults to the resource name followed by the index")
+	fs.StringVar(&devicePermissions, "device-permissions", string(tundeviceplugin.DevicePermissionsReadWrite),
+		"Cgroup permissions granted on the device (r, rw, rwm)")
+	fs.StringVar(&healthServiceName, "health-service-name", "",
+		"gRPC health service name of the resource, suffixed with -<resource> when serving several resources "+
+			"(defaults to the full resource name)")
+	fs.StringVar(&kubeletSocket, "kubelet-socket", v1beta1.KubeletSocket,
+		"Path of the kubelet registration socket, plugin sockets should be in the same directory")
+	fs.DurationVar(&registerTimeout, "register-timeout", plugin.DefaultRegisterTimeout,
+		"Timeout of a single kubelet registration call, timed out calls are retried")
+	fs.StringVar(&registrationMode, "registration-mode", string(plugin.RegistrationModeLegacy),
+		"How resources register with the kubelet: legacy calls the kubelet registration service, "+
+			"watcher serves a socket in -plugins-registry-dir for the kubelet plugin watcher")
+	fs.StringVar(&pluginsRegistryDir, "plugins-registry-dir", plugin.DefaultPluginsRegistryDir,
+		"Directory watched by the kubelet plugin watcher, used by -registration-mode=watcher")
+	fs.StringVar(&grpcListen, "grpc-listen", "",
+		"Serve the device plugin on this endpoint (e.g. tcp://127.0.0.1:9000) instead of the device plugin dir, "+
+			"for testing with a single resource")
+	fs.BoolVar(&skipRegistration, "skip-registration", false,
+		"Do not register with the kubelet, for testing the device plugin server out of cluster")
+	fs.StringVar(&allocationAnnotations, "allocation-annotations", "",
+		"Comma separated key=value annotations added to every allocation, along with "+
+			"<plugin-namespace>/<resource>-device-ids; annotations are disabled when empty")
+	fs.BoolVar(&runPreflight, "preflight", false,
+		"Check the devices and the device plugin directory, print a report in -log-format and exit")
+	fs.BoolVar(&nodeHealthAnnotation, "node-health-annotation", false,
+		"Annotate the node with <plugin-namespace>/<resource>-health when the device health changes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "num-devices" || f.Name == "devices" {
+			numDevicesSet = true
+		}
+	})
+	return nil
+}
+
 func main() {
-	flag.StringVar(&logLevel, "log-level", "info", "Set log level (debug, info, warn, error)")
-	flag.UintVar(&maxDevices, "devices", 10, "Set number of devices presented to kubelet")
-	flag.Parse()
+	if err := parseFlags(flag.CommandLine, os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	if printVersion {
+		fmt.Printf("tun-device-plugin %s (commit %s, built %s)\n", version, commit, buildDate)
+		return
+	}
+
+	if runPreflight {
+		report := preflight()
+		if err := writePreflight(os.Stdout, logFormat, report); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write preflight report: %v\n", err)
+			os.Exit(1)
+		}
+		if !report.OK {
+			os.Exit(1)
+		}
+		return
+	}
 
 	var level slog.Level
 	switch logLevel {
@@ -67,70 +376,738 @@ func main() {
 	default:
 		level = slog.LevelInfo // Default to info if unknown
 	}
-	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
 
-	if err := run(context.Background(), log); err != nil {
+	out, closeLog, err := logOutput(logFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	handler, err := logging.Redact(logHandler(logFormat, out, level), logRedact)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	log := slog.New(handler)
+
+	err = run(context.Background(), log)
+	if err != nil {
 		log.Error("Critical failure", "error", err)
+	}
+	// os.Exit skips deferred calls, so the log file is closed explicitly.
+	_ = closeLog()
+	if err != nil {
 		os.Exit(1)
 	}
 }
 
+// reportFeatureGates logs and exposes the state of the experimental features.
+// The set of gates is fixed, which keeps the metric cardinality bounded.
+func reportFeatureGates(log *slog.Logger, gates map[string]bool) {
+	args := make([]any, 0, 2*len(gates))
+	for _, gate := range slices.Sorted(maps.Keys(gates)) {
+		enabled := gates[gate]
+		args = append(args, gate, enabled)
+
+		value := 0.0
+		if enabled {
+			value = 1
+		}
+		metrics.FeatureGateEnabled.WithLabelValues(gate).Set(value)
+	}
+	log.Info("Feature gates", args...)
+}
+
+// logOutput returns the log destination: the file at path, opened for
+// appending, or stdout when path is empty. The returned function closes it.
+func logOutput(path string) (io.Writer, func() error, error) {
+	if path == "" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return file, file.Close, nil
+}
+
+func logHandler(format string, w io.Writer, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts) // Default to text if unknown
+}
+
 func run(ctx context.Context, log *slog.Logger) error {
-	ctx, stop := signal.NotifyContext(ctx,
-		os.Interrupt,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-	)
+	ctx, stop := notifyContext(ctx, log, minUptime, fastInterrupt)
 	defer stop()
 
-	log.Info("Starting plugin")
+	log.Info("Starting plugin", "version", version, "commit", commit, "buildDate", buildDate)
+	metrics.BuildInfo.WithLabelValues(version, commit, buildDate).Set(1)
+
+	// nodeName is shared by all node-aware features; those must fail if it is empty.
+	nodeName, err := node.ResolveName(nodeNameFlag, log)
+	if err != nil {
+		log.Warn("Unable to resolve node name", "error", err)
+	}
+	log.Info("Running on node", "node", nodeName)
+
+	ctx, quit := context.WithCancel(ctx)
+	defer quit()
+
 	eg, ctx := errgroup.WithContext(ctx)
 
-	tun := tundeviceplugin.New(pluginNamespace, maxDevices, log)
-	dps := plugin.New(log)
+	admission, err := admissionPolicy(admissionAllow, admissionDeny)
+	if err != nil {
+		return err
+	}
+
+	if err := validateEndpoint(metricsAddr); err != nil {
+		return fmt.Errorf("invalid metrics address: %w", err)
+	}
+	if !strings.HasPrefix(metricsPath, "/") {
+		return fmt.Errorf("metrics path must start with /, got %q", metricsPath)
+	}
+
+	if drainPeriod < 0 {
+		return fmt.Errorf("drain period must not be negative, got %s", drainPeriod)
+	}
+	if gracePeriod < 0 {
+		return fmt.Errorf("grace period must not be negative, got %s", gracePeriod)
+	}
+
+	if fdSampleInterval <= 0 {
+		return fmt.Errorf("fd sample interval must be positive, got %s", fdSampleInterval)
+	}
+
+	objectives, err := parseObjectives(allocateLatencyObjectives)
+	if err != nil {
+		return err
+	}
+	if err := metrics.RegisterAllocateLatency(allocateLatencyMetric, objectives); err != nil {
+		return fmt.Errorf("failed to register allocate latency metric: %w", err)
+	}
+
+	policy, err := tundeviceplugin.ParseDiscoveryPolicy(discoveryPolicy)
+	if err != nil {
+		return err
+	}
+
+	strategy, err := tundeviceplugin.ParseAllocationStrategy(allocationStrategy)
+	if err != nil {
+		return err
+	}
+
+	perms, err := tundeviceplugin.ParseDevicePermissions(devicePermissions)
+	if err != nil {
+		return err
+	}
+
+	var annotations map[string]string
+	if allocationAnnotations != "" {
+		annotations, err = tundeviceplugin.ParseAnnotations(allocationAnnotations)
+		if err != nil {
+			return err
+		}
+	}
+
+	mode, err := tundeviceplugin.ParseDiscoveryMode(discoveryMode)
+	if err != nil {
+		return err
+	}
+	if discoveryInterval <= 0 {
+		return fmt.Errorf("discovery interval must be positive, got %s", discoveryInterval)
+	}
+
+	numa, err := tundeviceplugin.ParseNUMANodes(numaNodes)
+	if err != nil {
+		return err
+	}
 
-	grpcServer := dps.DevicePluginServer(tun)
-	httpServer := metricsServer()
+	perm, err := strconv.ParseUint(socketModeFlag, 8, 32)
+	if err != nil || perm > 0o777 {
+		return fmt.Errorf("invalid socket mode %q, expected an octal permission like 0600", socketModeFlag)
+	}
+	socketMode = os.FileMode(perm)
 
-	healthServer := health.NewServer()
-	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	if err := tundeviceplugin.ValidateNamespace(pluginNamespace); err != nil {
+		return err
+	}
+	if err := tundeviceplugin.ValidateDeviceIDFormat(deviceIDFormat); err != nil {
+		return err
+	}
+
+	if grpcListen != "" {
+		endpointURL, err := url.Parse(grpcListen)
+		if err != nil || (endpointURL.Scheme != "tcp" && endpointURL.Scheme != "unix") {
+			return fmt.Errorf("invalid gRPC endpoint %q, expected tcp://host:port or unix:///path", grpcListen)
+		}
+		// The kubelet only dials unix sockets in its device plugin directory.
+		if endpointURL.Scheme == "tcp" && !skipRegistration {
+			return fmt.Errorf("-grpc-listen %q requires -skip-registration, the kubelet only dials unix sockets",
+				grpcListen)
+		}
+	}
+
+	resources, err := resourceConfigs()
+	if err != nil {
+		return err
+	}
+	for _, res := range resources {
+		log.Info("Advertising devices", "resource", res.Name, "kind", res.Kind, "count", res.Count)
+	}
+	if grpcListen != "" && len(resources) > 1 {
+		return fmt.Errorf("-grpc-listen supports a single resource, %d are configured", len(resources))
+	}
+
+	if maxAllocs < 0 {
+		return fmt.Errorf("max allocations must not be negative, got %d", maxAllocs)
+	}
+
+	regMode, err := plugin.ParseRegistrationMode(registrationMode)
+	if err != nil {
+		return err
+	}
+
+	if registerTimeout <= 0 {
+		return fmt.Errorf("register timeout must be positive, got %s", registerTimeout)
+	}
+	if registerRetry.MaxRetries <= 0 || registerRetry.BaseDelay <= 0 || registerRetry.MaxDelay < registerRetry.BaseDelay {
+		return fmt.Errorf("invalid registration retry configuration: %+v", registerRetry)
+	}
+
+	// A custom kubelet socket is most likely a typo when its directory is
+	// missing, the default one is created by the socket dir setup.
+	if !skipRegistration && kubeletSocket != v1beta1.KubeletSocket {
+		if _, err := os.Stat(filepath.Dir(kubeletSocket)); err != nil {
+			return fmt.Errorf("invalid kubelet socket %q: %w", kubeletSocket, err)
+		}
+		if filepath.Dir(kubeletSocket) != filepath.Clean(devicePluginPath) {
+			log.Warn("The kubelet socket and the plugin sockets are in different directories, "+
+				"the kubelet resolves plugin sockets relative to its own",
+				"kubeletSocket", kubeletSocket, "devicePluginPath", devicePluginPath)
+		}
+	}
+
+	dps := plugin.New(log,
+		plugin.WithKubeletSocket(kubeletSocket),
+		plugin.WithRegistrationMode(regMode),
+		plugin.WithRegisterTimeout(registerTimeout),
+		plugin.WithRetryConfig(registerRetry),
+		plugin.WithReflection(grpcReflection),
+		plugin.WithPanicStackDump(stackDump),
+		plugin.WithPanicEscalation(panicThreshold, panicWindow),
+		plugin.WithHealthServiceNames(healthServiceNames(resources)),
+	)
+
+	log.Info("Using registration mode", "mode", dps.RegistrationMode())
+	metrics.RegistrationMode.Reset()
+	metrics.RegistrationMode.WithLabelValues(string(dps.RegistrationMode())).Set(1)
+
+	if !cdiEnabled {
+		cdiSpecPath = ""
+	}
+
+	reportFeatureGates(log, map[string]bool{
+		"AdminService":         adminSocket != "",
+		"AllocationCache":      allocationCacheSize > 0,
+		"CDI":                  cdiEnabled,
+		"GRPCReflection":       grpcReflection,
+		"DiscoveryWatch":       mode == tundeviceplugin.DiscoveryModeWatch,
+		"NodeDrain":            nodeDrain,
+		"NodeHealthAnnotation": nodeHealthAnnotation,
+		"PanicEscalation":      panicThreshold > 0,
+		"PrestartMknod":        prestartMknod,
+		"PreferredAllocation":  strategy != tundeviceplugin.AllocationStrategyNone,
+		"QuitEndpoint":         quitEndpoint,
+		"SelfProbe":            selfProbeInterval > 0,
+		"SkipRegistration":     skipRegistration,
+		"Topology":             len(numa) > 0,
+	})
+
+	var nodeClient *node.Client
+	if nodeDrain || nodeHealthAnnotation {
+		if nodeName == "" {
+			return fmt.Errorf("node drain and health annotation require the node name: %w", node.ErrNameUnavailable)
+		}
+		nodeClient, err = node.InClusterClient()
+		if err != nil {
+			return fmt.Errorf("failed to create node client: %w", err)
+		}
+	}
+	if nodeDrain && nodeDrainInterval <= 0 {
+		return fmt.Errorf("node drain resync period must be positive, got %s", nodeDrainInterval)
+	}
+
+	opts := []tundeviceplugin.Option{
+		tundeviceplugin.WithAdmissionPolicy(admission),
+		tundeviceplugin.WithMaxWatchers(maxWatchers),
+		tundeviceplugin.WithDiscoveryPolicy(policy),
+		tundeviceplugin.WithAllocationCache(allocationCacheSize),
+		tundeviceplugin.WithRegistrationMode(string(dps.RegistrationMode())),
+		tundeviceplugin.WithAllocationStrategy(strategy),
+		tundeviceplugin.WithEnvPrefix(envPrefix),
+		tundeviceplugin.WithDiscoveryDebounce(discoveryDebounce),
+		tundeviceplugin.WithHealthDebounce(healthDebounce),
+		tundeviceplugin.WithCgroupHints(cgroupHints),
+		tundeviceplugin.WithNUMANodes(numa),
+		tundeviceplugin.WithSocketDir(devicePluginPath),
+		tundeviceplugin.WithStrictDeviceNumbers(strictNumbers),
+		tundeviceplugin.WithPrestartMknod(prestartMknod, nil),
+		tundeviceplugin.WithMaxAllocations(maxAllocs),
+		tundeviceplugin.WithDeviceIDFormat(deviceIDFormat),
+		tundeviceplugin.WithDevicePermissions(perms),
+	}
+	if nodeHealthAnnotation {
+		opts = append(opts, tundeviceplugin.WithHealthHook(
+			node.HealthAnnotator(ctx, log, nodeClient, nodeName, pluginNamespace)))
+	}
+
+	servers := make([]*tundeviceplugin.Server, 0, len(resources))
+	byName := make(map[string]*tundeviceplugin.Server, len(resources))
+	for _, res := range resources {
+		// Each resource needs its own CDI spec, as the spec kind is the resource name.
+		specPath := cdiSpecPath
+		if specPath != "" && res.Name != string(tundeviceplugin.KindTUN) {
+			specPath = strings.TrimSuffix(specPath, ".json") + "-" + res.Name + ".json"
+		}
+		srv, err := tundeviceplugin.New(pluginNamespace, slices.Concat(opts, []tundeviceplugin.Option{
+			tundeviceplugin.WithLogger(log),
+			tundeviceplugin.WithDeviceCount(res.Count),
+			tundeviceplugin.WithKind(tundeviceplugin.Kind(res.Kind)),
+			tundeviceplugin.WithResourceName(res.Name),
+			tundeviceplugin.WithDevicePaths(res.HostPath, res.ContainerPath),
+			tundeviceplugin.WithCDI(specPath),
+			tundeviceplugin.WithEndpoint(grpcListen),
+			tundeviceplugin.WithAllocationAnnotations(mergeAnnotations(annotations, res.Annotations)),
+		})...)
+		if err != nil {
+			return fmt.Errorf("failed to create server for resource %q: %w", res.Name, err)
+		}
+		servers = append(servers, srv)
+		byName[res.Name] = srv
+	}
+
+	grpcServers := make([]*grpc.Server, 0, len(servers)+1)
+	for _, srv := range servers {
+		grpcServers = append(grpcServers, dps.DevicePluginServer(srv))
+	}
+	// In watcher mode, the kubelet plugin watcher registers each resource
+	// through its own registration server.
+	var registrationServers []*grpc.Server
+	if !skipRegistration && dps.RegistrationMode() == plugin.RegistrationModeWatcher {
+		for _, srv := range servers {
+			registrationServers = append(registrationServers, dps.RegistrationServer(srv.Name(), srv.Socket()))
+		}
+	}
+
+	var adminServer *grpc.Server
+	if adminSocket != "" {
+		backends := make([]admin.Backend, 0, len(servers))
+		for _, srv := range servers {
+			backends = append(backends, srv)
+		}
+		adminServer = dps.GRPCServer()
+		admin.Register(adminServer, admin.New(log, backends...))
+		reflection.Register(adminServer)
+	}
+	var quitHandler http.Handler
+	if quitEndpoint {
+		allowlist, err := parseAllowlist(quitAllowlist)
+		if err != nil {
+			return err
+		}
+		quitHandler = quitquitquit(log, allowlist, quit)
+	}
+	readyChecks := []func() error{dps.Ready}
+	if skipRegistration {
+		readyChecks = nil
+	}
+	for _, srv := range servers {
+		readyChecks = append(readyChecks, srv.Ready)
+	}
+	var httpServer *http.Server
+	if metricsEnabled {
+		httpServer = metricsServer(metricsPath, quitHandler, readyz(readyChecks...))
+	} else {
+		log.Info("HTTP server disabled, metrics, /readyz and /quitquitquit are not served")
+	}
+	if httpServer != nil && (metricsTLSCert != "" || metricsTLSKey != "") {
+		tlsConfig, err := metricsTLSConfig(metricsTLSCert, metricsTLSKey, metricsClientCA)
+		if err != nil {
+			return err
+		}
+		httpServer.TLSConfig = tlsConfig
+	}
+
+	var pprofServer *http.Server
+	if pprofAddr != "" {
+		if err := validateEndpoint(pprofAddr); err != nil {
+			return fmt.Errorf("invalid pprof address: %w", err)
+		}
+		pprofServer = profilingServer()
+	}
+
+	hooks := shutdownHooks{
+		unregistered: dps.Unregistered,
+		drain: func() {
+			for _, srv := range servers {
+				srv.SetDrained(true)
+			}
+		},
+		stop: func() {
+			for _, srv := range servers {
+				srv.Stop()
+			}
+		},
+	}
 
 	eg.Go(func() error {
 		log.Info("Starting shutdown controller")
-		return shutdown(ctx, log, grpcServer, httpServer)
+		return shutdown(ctx, log, slices.Concat(grpcServers, registrationServers, []*grpc.Server{adminServer}),
+			[]*http.Server{httpServer, pprofServer},
+			hooks, drainPeriod, gracePeriod)
 	})
 	eg.Go(func() error {
-		log.Info("Registering device plugin")
-		return dps.RegisterDevicePlugin(ctx, tun.Name(), tun.Socket())
+		return metrics.SampleOpenFDs(ctx, fdSampleInterval)
 	})
 	eg.Go(func() error {
-		lis, cleanup, err := listener(ctx, log, "tcp://0.0.0.0:8080")
-		if err != nil {
-			return fmt.Errorf("failed to create http listener: %w", err)
-		}
-		defer cleanup()
-
-		log.Info("Starting HTTP server")
-		return httpServer.Serve(lis)
+		return dps.WatchPanics(ctx)
 	})
 	eg.Go(func() error {
-		lis, cleanup, err := listener(ctx, log, tun.Socket())
-		if err != nil {
-			return fmt.Errorf("failed to create grpc listener: %w", err)
+		return reloadOnSignal(ctx, log, byName)
+	})
+	eg.Go(func() error {
+		return reRegisterOnSignal(ctx, log, dps)
+	})
+	if httpServer != nil {
+		eg.Go(func() error {
+			lis, cleanup, err := listener(ctx, log, metricsAddr)
+			if err != nil {
+				return fmt.Errorf("failed to create http listener: %w", err)
+			}
+			defer cleanup()
+
+			log.Info("Starting HTTP server")
+			if httpServer.TLSConfig != nil {
+				// Certificates are already loaded into the TLS config.
+				return ignoreServerClosed(httpServer.ServeTLS(lis, "", ""))
+			}
+			return ignoreServerClosed(httpServer.Serve(lis))
+		})
+	}
+	if pprofServer != nil {
+		eg.Go(func() error {
+			lis, cleanup, err := listener(ctx, log, pprofAddr)
+			if err != nil {
+				return fmt.Errorf("failed to create pprof listener: %w", err)
+			}
+			defer cleanup()
+
+			log.Info("Starting pprof server", "addr", pprofAddr)
+			return ignoreServerClosed(pprofServer.Serve(lis))
+		})
+	}
+	if nodeDrain {
+		eg.Go(func() error {
+			log.Info("Watching node state", "node", nodeName, "resync", nodeDrainInterval)
+			conditions := strings.Split(nodeDrainConditions, ",")
+			clientset := nodeClient.Clientset()
+			return node.WatchDrain(ctx, log, clientset, nodeName, conditions, nodeDrainInterval, func(drained bool) {
+				for _, srv := range servers {
+					srv.SetNodeDrained(drained)
+				}
+			})
+		})
+	}
+	for i, srv := range servers {
+		grpcServer := grpcServers[i]
+
+		eg.Go(func() error {
+			log.Info("Starting device discovery", "resource", srv.Name(), "mode", mode)
+			return srv.Discover(ctx, mode, discoveryInterval)
+		})
+		if healthInterval > 0 {
+			eg.Go(func() error {
+				log.Info("Starting device health probe", "resource", srv.Name(), "interval", healthInterval)
+				return srv.Probe(ctx, healthInterval)
+			})
 		}
-		defer cleanup()
+		if selfProbeInterval > 0 {
+			eg.Go(func() error {
+				log.Info("Starting self allocation probe", "resource", srv.Name(), "interval", selfProbeInterval)
+				return srv.SelfProbe(ctx, selfProbeInterval)
+			})
+		}
+		listen := func(ctx context.Context, socket string) (net.Listener, func(), error) {
+			return listener(ctx, log, socket)
+		}
+		// The resource is only reported as serving once its socket exists.
+		endpoint := plugin.NewEndpoint(grpcServer, srv.Socket(), listen, func() {
+			dps.SetServing(srv.Name())
+		})
+		switch {
+		case skipRegistration:
+			log.Warn("Skipping kubelet registration", "resource", srv.Name(), "endpoint", srv.Socket())
+		case dps.RegistrationMode() == plugin.RegistrationModeWatcher:
+			socket := plugin.RegistrationSocket(pluginsRegistryDir, srv.Name())
+			registration := plugin.NewEndpoint(registrationServers[i], socket, listen, nil)
+			eg.Go(func() error {
+				log.Info("Serving plugin watcher registration", "resource", srv.Name(), "socket", socket)
+				if err := registration.Serve(ctx); err != nil {
+					return fmt.Errorf("failed to serve registration: %w", err)
+				}
+				return nil
+			})
+		default:
+			eg.Go(func() error {
+				log.Info("Registering device plugin", "resource", srv.Name())
+				return dps.RegisterDevicePlugin(ctx, srv.Name(), srv.Socket())
+			})
+		}
+		if !skipRegistration {
+			eg.Go(func() error {
+				log.Info("Watching kubelet socket", "resource", srv.Name())
+				return dps.WatchKubelet(ctx, srv.Name(), srv.Socket(), endpoint.Recreate)
+			})
+		}
+		eg.Go(func() error {
+			log.Info("Starting gRPC server", "resource", srv.Name())
+			if err := endpoint.Serve(ctx); err != nil {
+				return fmt.Errorf("failed to serve grpc: %w", err)
+			}
+			return nil
+		})
+	}
 
-		// Mark server as healthy
-		healthServer.SetServingStatus(tun.Name(), grpc_health_v1.HealthCheckResponse_SERVING)
+	if adminServer != nil {
+		eg.Go(func() error {
+			lis, cleanup, err := listener(ctx, log, adminSocket)
+			if err != nil {
+				return fmt.Errorf("failed to create admin listener: %w", err)
+			}
+			defer cleanup()
 
-		log.Info("Starting gRPC server")
-		return grpcServer.Serve(lis)
-	})
+			if err := restrictSocket(adminSocket); err != nil {
+				return err
+			}
+
+			log.Info("Starting admin gRPC server", "socket", adminSocket)
+			return adminServer.Serve(lis)
+		})
+	}
 
 	log.Info("Plugin is running")
 	return eg.Wait()
 }
 
+// errFastShutdown is the cancellation cause for signals mapped to an immediate stop.
+var errFastShutdown = errors.New("fast shutdown requested")
+
+// mergeAnnotations returns the resource annotations merged over the flag
+// ones, or nil when neither are set.
+func mergeAnnotations(annotations, overrides map[string]string) map[string]string {
+	if annotations == nil && len(overrides) == 0 {
+		return nil
+	}
+	merged := maps.Clone(annotations)
+	if merged == nil {
+		merged = map[string]string{}
+	}
+	maps.Copy(merged, overrides)
+	return merged
+}
+
+// healthServiceNames maps the full resource names to the health service
+// names set with -health-service-name.
+func healthServiceNames(resources []config.ResourceConfig) map[string]string {
+	if healthServiceName == "" {
+		return nil
+	}
+
+	names := make(map[string]string, len(resources))
+	for _, res := range resources {
+		service := healthServiceName
+		if len(resources) > 1 {
+			service += "-" + res.Name
+		}
+		names[path.Join(pluginNamespace, res.Name)] = service
+	}
+	return names
+}
+
+// reloadOnSignal re-reads the config file on SIGHUP and updates the advertised
+// device count of each running server. Adding or removing resources requires
+// a restart. Flags and environment cannot change at runtime, so SIGHUP is
+// ignored without a config file.
+func reloadOnSignal(ctx context.Context, log *slog.Logger, servers map[string]*tundeviceplugin.Server) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sigs:
+		}
+
+		if configPath == "" {
+			log.Warn("Received SIGHUP, ignoring it as reloading requires -config")
+			continue
+		}
+
+		log.Info("Received SIGHUP, reloading resources", "config", configPath)
+		resources, err := resourceConfigs()
+		if err != nil {
+			log.Error("Failed to reload resources, keeping the current configuration", "error", err)
+			continue
+		}
+
+		for _, res := range resources {
+			srv, ok := servers[res.Name]
+			if !ok {
+				log.Warn("Ignoring new resource, a restart is required to serve it", "resource", res.Name)
+				continue
+			}
+			srv.Reload(res.Count)
+		}
+	}
+}
+
+// reRegisterOnSignal forces every resource to re-register with the kubelet
+// on SIGUSR1.
+func reRegisterOnSignal(ctx context.Context, log *slog.Logger, dps *plugin.Plugin) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sigs:
+			log.Info("Received SIGUSR1, forcing re-registration with the kubelet")
+			dps.TriggerReRegister()
+		}
+	}
+}
+
+// notifyContext is like signal.NotifyContext, but defers acting on the first
+// signal until the plugin has been up for at least minUptime. A second signal
+// cancels the context immediately. When fastInterrupt is set, SIGINT cancels
+// the context with errFastShutdown, skipping the graceful shutdown.
+func notifyContext(
+	ctx context.Context,
+	log *slog.Logger,
+	minUptime time.Duration,
+	fastInterrupt bool,
+) (context.Context, func()) {
+	started := time.Now()
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+
+	cause := func(sig os.Signal) error {
+		if fastInterrupt && sig == syscall.SIGINT {
+			return errFastShutdown
+		}
+		return fmt.Errorf("received signal %s", sig)
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigs:
+			if remaining := minUptime - time.Since(started); remaining > 0 {
+				log.Info("Deferring shutdown until minimum uptime is reached",
+					"signal", sig.String(), "remaining", remaining)
+
+				timer := time.NewTimer(remaining)
+				defer timer.Stop()
+
+				select {
+				case <-ctx.Done():
+				case <-timer.C:
+				case sig = <-sigs:
+					log.Info("Received second signal, shutting down immediately", "signal", sig.String())
+				}
+			}
+			cancel(cause(sig))
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel(nil)
+	}
+}
+
+func admissionPolicy(allow, deny string) (*tundeviceplugin.AdmissionPolicy, error) {
+	policy := &tundeviceplugin.AdmissionPolicy{}
+
+	if allow != "" {
+		re, err := regexp.Compile(allow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admission allow regex: %w", err)
+		}
+		policy.Allow = re
+	}
+
+	if deny != "" {
+		re, err := regexp.Compile(deny)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admission deny regex: %w", err)
+		}
+		policy.Deny = re
+	}
+
+	return policy, nil
+}
+
+func parseObjectives(list string) (map[float64]float64, error) {
+	objectives := map[float64]float64{}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		q, e, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid objective %q, expected quantile:error", pair)
+		}
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid objective quantile %q: %w", q, err)
+		}
+		epsilon, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid objective error %q: %w", e, err)
+		}
+		objectives[quantile] = epsilon
+	}
+	return objectives, nil
+}
+
+// errSocketInUse is returned when another instance is serving on the socket.
+var errSocketInUse = errors.New("socket is served by another instance")
+
+// socketInUse reports whether something accepts connections on the unix
+// socket at path. Stale sockets, left by an instance that did not exit
+// gracefully, refuse connections and are safe to remove.
+func socketInUse(path string) bool {
+	conn, err := net.DialTimeout("unix", path, socketDialTimeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
 func listener(
 	ctx context.Context,
 	log *slog.Logger,
@@ -144,15 +1121,37 @@ func listener(
 	listenConfig := net.ListenConfig{}
 
 	if endpointURL.Scheme == "unix" {
+		if err := ensureSocketDir(filepath.Dir(endpointURL.Path)); err != nil {
+			return nil, nil, err
+		}
+
+		if socketInUse(endpointURL.Path) {
+			return nil, nil, fmt.Errorf("%w: %s", errSocketInUse, endpointURL.Path)
+		}
 		// best effort call to remove the socket if it exists, fixes issue with restarted pod that did not exit gracefully
 		_ = os.Remove(endpointURL.Path)
 	}
 
-	listener, err := listenConfig.Listen(ctx, endpointURL.Scheme, endpointURL.Path)
+	address := endpointURL.Path
+	if endpointURL.Scheme != "unix" {
+		address = endpointURL.Host
+	}
+
+	listener, err := listenWithRetry(ctx, log, func() (net.Listener, error) {
+		return listenConfig.Listen(ctx, endpointURL.Scheme, address)
+	})
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to create listener: %w", err)
 	}
 
+	// Sockets are created according to the umask, which differs between nodes.
+	if endpointURL.Scheme == "unix" {
+		if err := os.Chmod(endpointURL.Path, socketMode); err != nil {
+			_ = listener.Close()
+			return nil, nil, fmt.Errorf("unable to set socket permissions: %w", err)
+		}
+	}
+
 	cleanup := func() {
 		if err := listener.Close(); err != nil {
 			if !errors.Is(err, net.ErrClosed) {
@@ -170,26 +1169,339 @@ func listener(
 	return listener, cleanup, nil
 }
 
-func metricsServer() *http.Server {
+// validateEndpoint checks that endpoint is a URL with a scheme supported by listener.
+func validateEndpoint(endpoint string) error {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("unable to parse endpoint: %w", err)
+	}
+
+	switch endpointURL.Scheme {
+	case "unix":
+		if endpointURL.Path == "" {
+			return fmt.Errorf("missing socket path in %q", endpoint)
+		}
+	case "tcp", "tcp4", "tcp6":
+		if endpointURL.Host == "" {
+			return fmt.Errorf("missing address in %q", endpoint)
+		}
+	default:
+		return fmt.Errorf("unsupported scheme %q in %q", endpointURL.Scheme, endpoint)
+	}
+	return nil
+}
+
+// listenWithRetry retries transient bind failures with backoff, e.g. while the
+// kubelet is restarting, and fails fast on permanent errors.
+func listenWithRetry(
+	ctx context.Context,
+	log *slog.Logger,
+	listen func() (net.Listener, error),
+) (net.Listener, error) {
+	delay := bindBaseDelay
+
+	for attempt := 1; ; attempt++ {
+		lis, err := listen()
+		if err == nil {
+			return lis, nil
+		}
+		if !transientBindError(err) || attempt >= bindMaxRetries {
+			return nil, err
+		}
+
+		log.Debug("Transient bind failure, retrying", "error", err, "backoff", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, bindMaxDelay)
+	}
+}
+
+func transientBindError(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR)
+}
+
+// restrictSocket limits access to a unix socket to its owner.
+func restrictSocket(endpoint string) error {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("unable to parse endpoint: %w", err)
+	}
+	if endpointURL.Scheme != "unix" {
+		return nil
+	}
+
+	if err := os.Chmod(endpointURL.Path, adminSocketPerm); err != nil {
+		return fmt.Errorf("unable to restrict socket permissions: %w", err)
+	}
+	return nil
+}
+
+// mkdirAll creates the socket directories, replaced in tests to fake a
+// read-only file system.
+var mkdirAll = os.MkdirAll
+
+// ensureSocketDir creates the full directory path for the socket, if any part of it is missing.
+func ensureSocketDir(dir string) error {
+	if err := mkdirAll(dir, socketDirPerm); err != nil {
+		if errors.Is(err, syscall.EROFS) || errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("the device-plugins dir must be writable: %w", err)
+		}
+		return fmt.Errorf("unable to create socket directory: %w", err)
+	}
+
+	return nil
+}
+
+func metricsServer(path string, quit, ready http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	mux.Handle("/readyz", ready)
+	if quit != nil {
+		mux.Handle("/quitquitquit", quit)
+	}
+	return &http.Server{Handler: mux}
+}
+
+// ignoreServerClosed drops the error returned by an HTTP server stopped by
+// the shutdown controller.
+func ignoreServerClosed(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// metricsTLSConfig loads the serving certificate and, when clientCA is set,
+// requires and verifies client certificates signed by it.
+func metricsTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	if cert == "" || key == "" {
+		return nil, errors.New("both metrics TLS certificate and key must be set")
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metrics TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metrics client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in metrics client CA %s", clientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// resourceConfigs returns the resources declared in the config file, or the
+// ones configured with flags when no config file is given.
+func resourceConfigs() ([]config.ResourceConfig, error) {
+	if configPath != "" {
+		return config.Load(configPath)
+	}
+
+	count := numDevices
+	if env, ok := os.LookupEnv(numDevicesEnv); ok && !numDevicesSet {
+		n, err := strconv.ParseUint(env, 10, 0)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid %s %q, expected a positive integer", numDevicesEnv, env)
+		}
+		count = uint(n)
+	}
+
+	if count == 0 {
+		return nil, errors.New("number of devices must be greater than zero")
+	}
+	resources := []config.ResourceConfig{{
+		Name:          string(tundeviceplugin.KindTUN),
+		Kind:          string(tundeviceplugin.KindTUN),
+		Count:         count,
+		HostPath:      deviceHostPath,
+		ContainerPath: deviceContainerPath,
+	}}
+	if numTAP > 0 {
+		resources = append(resources, config.ResourceConfig{
+			Name:          string(tundeviceplugin.KindTAP),
+			Kind:          string(tundeviceplugin.KindTAP),
+			Count:         numTAP,
+			HostPath:      deviceHostPath,
+			ContainerPath: deviceContainerPath,
+		})
+	}
+	return resources, nil
+}
+
+func profilingServer() *http.Server {
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	return &http.Server{Handler: mux}
 }
 
+// readyz returns 200 when every check passes and 503 otherwise.
+func readyz(checks ...func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+}
+
+// quitquitquit returns a handler triggering the same graceful shutdown as SIGTERM.
+// Only POST requests from the allowlisted networks are accepted.
+func quitquitquit(log *slog.Logger, allowlist []*net.IPNet, quit context.CancelFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ip := net.ParseIP(host)
+		if !allowed(allowlist, ip) {
+			log.Warn("Rejected shutdown request", "remote", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		log.Info("Shutdown requested", "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusOK)
+		quit()
+	})
+}
+
+func allowed(allowlist []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range allowlist {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAllowlist(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist entry %q: %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// shutdownHooks are called by shutdown, in order: drain, stop, and then the
+// servers are stopped. Sockets are removed once their server stopped.
+type shutdownHooks struct {
+	// unregistered returns the resources not registered with the kubelet.
+	unregistered func() []string
+	// drain reports every device as unhealthy.
+	drain func()
+	// stop ends the ListAndWatch streams, after the final update was sent.
+	stop func()
+}
+
 func shutdown(
 	ctx context.Context,
 	log *slog.Logger,
-	grpcServer *grpc.Server,
-	httpServer *http.Server,
+	grpcServers []*grpc.Server,
+	httpServers []*http.Server,
+	hooks shutdownHooks,
+	drainPeriod time.Duration,
+	gracePeriod time.Duration,
 ) error {
 	<-ctx.Done()
-	log.Info("Shutting down")
-	dctx, stop := context.WithTimeout(context.Background(), gracePeriod)
+
+	fast := errors.Is(context.Cause(ctx), errFastShutdown)
+
+	// Devices are reported unhealthy first, so the scheduler stops placing pods
+	// on the node before the plugin disconnects.
+	if hooks.drain != nil {
+		hooks.drain()
+		if !fast && drainPeriod > 0 {
+			log.Info("Draining devices before shutdown", "drainPeriod", drainPeriod)
+			// The first signal was consumed by notifyContext, another one
+			// cuts the drain and the grace period short, so the kubelet does
+			// not have to SIGKILL the plugin.
+			sctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			select {
+			case <-sctx.Done():
+				log.Info("Received another signal, skipping the drain period")
+				fast = true
+			case <-time.After(drainPeriod):
+			}
+			stopSignals()
+		}
+	}
+	// Ending the streams lets GracefulStop complete without waiting for the
+	// kubelet to close them.
+	if hooks.stop != nil {
+		hooks.stop()
+	}
+
+	// A pod which never became ready is easier to understand with this reported.
+	if hooks.unregistered == nil {
+		hooks.unregistered = func() []string { return nil }
+	}
+	if pending := hooks.unregistered(); len(pending) > 0 {
+		log.Warn("Shutting down before kubelet registration completed", "resources", pending)
+		for _, name := range pending {
+			metrics.ShutdownRegistrationIncomplete.WithLabelValues(name).Inc()
+		}
+	}
+
+	grace := gracePeriod
+	if fast {
+		grace = 0
+	}
+	log.Info("Shutting down", "gracePeriod", grace)
+	dctx, stop := context.WithTimeout(context.Background(), grace)
 	defer stop()
 
 	eg, dctx := errgroup.WithContext(dctx)
 
-	if grpcServer != nil {
+	for _, grpcServer := range grpcServers {
+		if grpcServer == nil {
+			continue
+		}
+
 		eg.Go(func() error {
 			log.Debug("Shutting down gRPC server")
 
@@ -204,15 +1516,22 @@ func shutdown(
 				case <-dctx.Done():
 					log.Info("Forcing gRPC shutdown")
 					grpcServer.Stop()
+					metrics.ShutdownTotal.WithLabelValues("grpc", metrics.ShutdownForced).Inc()
 					return nil
 				case <-c:
+					log.Info("gRPC server shut down gracefully")
+					metrics.ShutdownTotal.WithLabelValues("grpc", metrics.ShutdownGraceful).Inc()
 					return nil
 				}
 			}
 		})
 	}
 
-	if httpServer != nil {
+	for _, httpServer := range httpServers {
+		if httpServer == nil {
+			continue
+		}
+
 		eg.Go(func() error {
 			log.Debug("Shutting down HTTP server")
 
@@ -225,8 +1544,11 @@ func shutdown(
 				select {
 				case <-dctx.Done():
 					log.Info("Forcing HTTP shutdown")
+					metrics.ShutdownTotal.WithLabelValues("http", metrics.ShutdownForced).Inc()
 					return httpServer.Close()
 				case err := <-c:
+					log.Info("HTTP server shut down gracefully")
+					metrics.ShutdownTotal.WithLabelValues("http", metrics.ShutdownGraceful).Inc()
 					return err
 				}
 			}
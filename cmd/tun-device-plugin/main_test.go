@@ -0,0 +1,1571 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"maps"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	adminv1 "github.com/anza-labs/tun-manager/api/admin/v1"
+	"github.com/anza-labs/tun-manager/pkg/config"
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+	"github.com/anza-labs/tun-manager/pkg/plugin"
+	"github.com/anza-labs/tun-manager/pkg/servers/tundeviceplugin"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// syncBuffer is a log sink safe for use by the goroutines of run.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// setFlags resets every flag to its default and parses args.
+func setFlags(t *testing.T, args ...string) {
+	t.Helper()
+
+	fs := flag.NewFlagSet("tun-device-plugin", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := parseFlags(fs, args); err != nil {
+		t.Fatalf("parseFlags() failed: %v", err)
+	}
+}
+
+// fakeDevice returns the path of a regular file standing in for the tun device.
+func fakeDevice(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "tun")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatalf("failed to create the device: %v", err)
+	}
+	return path
+}
+
+// freeTCPEndpoint returns a tcp:// endpoint on a free local port.
+func freeTCPEndpoint(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close() //nolint:errcheck // best effort call
+
+	return "tcp://" + lis.Addr().String()
+}
+
+// baseFlags returns the flags running the plugin against a fake device
+// without the kubelet, completed by args.
+func baseFlags(t *testing.T, args ...string) []string {
+	t.Helper()
+
+	return append([]string{
+		"-skip-registration",
+		"-device-host-path", fakeDevice(t),
+		"-device-plugin-path", t.TempDir(),
+		"-health-interval", "0",
+		"-drain-period", "0",
+	}, args...)
+}
+
+// freeAddr returns a free local tcp address.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	return strings.TrimPrefix(freeTCPEndpoint(t), "tcp://")
+}
+
+// get requests url with client, retrying until the server accepts connections.
+func get(t *testing.T, client *http.Client, url string) (*http.Response, error) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Get(url)
+		if err == nil || !errors.Is(err, syscall.ECONNREFUSED) || time.Now().After(deadline) {
+			return resp, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startRun runs the plugin logging to log and returns a function stopping it
+// and returning the result of run, it is called at the latest when the test ends.
+func startRun(t *testing.T, log *slog.Logger) func() error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, log)
+	}()
+
+	stop := sync.OnceValue(func() error {
+		cancel()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(10 * time.Second):
+			return errors.New("run() did not return")
+		}
+	})
+	t.Cleanup(func() {
+		if err := stop(); err != nil {
+			t.Errorf("stopping the plugin: %v", err)
+		}
+	})
+	return stop
+}
+
+func TestListenerLiveSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tun.sock")
+
+	live, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer live.Close() //nolint:errcheck // best effort call
+
+	_, _, err = listener(t.Context(), slog.New(slog.DiscardHandler), "unix://"+socket)
+	if !errors.Is(err, errSocketInUse) {
+		t.Fatalf("listener() = %v, want %v", err, errSocketInUse)
+	}
+
+	// The live instance keeps its socket.
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("the live socket was removed: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestListenerStaleSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tun.sock")
+
+	// An instance which did not exit gracefully leaves its socket behind.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	if _, err := os.Stat(socket); err != nil {
+		t.Fatalf("the stale socket is missing: %v", err)
+	}
+
+	lis, cleanup, err := listener(t.Context(), slog.New(slog.DiscardHandler), "unix://"+socket)
+	if err != nil {
+		t.Fatalf("listener() failed: %v", err)
+	}
+	defer cleanup()
+
+	go func() {
+		if conn, err := lis.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to dial the new socket: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestListenerSocketMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0o600, 0o660, 0o666} {
+		t.Run(mode.String(), func(t *testing.T) {
+			old := socketMode
+			socketMode = mode
+			t.Cleanup(func() { socketMode = old })
+
+			socket := filepath.Join(t.TempDir(), "tun.sock")
+			_, cleanup, err := listener(t.Context(), slog.New(slog.DiscardHandler), "unix://"+socket)
+			if err != nil {
+				t.Fatalf("listener() failed: %v", err)
+			}
+			defer cleanup()
+
+			info, err := os.Stat(socket)
+			if err != nil {
+				t.Fatalf("failed to stat the socket: %v", err)
+			}
+			if got := info.Mode().Perm(); got != mode {
+				t.Errorf("got socket mode %v, want %v", got, mode)
+			}
+		})
+	}
+}
+
+func TestRunInvalidSocketMode(t *testing.T) {
+	for _, mode := range []string{"rw", "0999", "01777"} {
+		t.Run(mode, func(t *testing.T) {
+			setFlags(t, baseFlags(t, "-socket-mode", mode, "-metrics-enabled=false")...)
+
+			err := run(t.Context(), slog.New(slog.DiscardHandler))
+			if err == nil || !strings.Contains(err.Error(), "invalid socket mode") {
+				t.Errorf("run() = %v, want an invalid socket mode error", err)
+			}
+		})
+	}
+}
+
+func TestRunTCPEndpoint(t *testing.T) {
+	endpoint := freeTCPEndpoint(t)
+	setFlags(t,
+		"-grpc-listen", endpoint,
+		"-skip-registration",
+		"-metrics-enabled=false",
+		"-num-devices", "2",
+		"-device-host-path", fakeDevice(t),
+		"-device-plugin-path", t.TempDir(),
+		"-health-interval", "0",
+		"-drain-period", "0",
+	)
+	stop := startRun(t, slog.New(slog.DiscardHandler))
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(endpoint, "tcp://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+	client := v1beta1.NewDevicePluginClient(conn)
+
+	ctx, cancelCall := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancelCall()
+
+	stream, err := client.ListAndWatch(ctx, &v1beta1.Empty{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("ListAndWatch() failed: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive devices: %v", err)
+	}
+	if len(resp.GetDevices()) != 2 {
+		t.Fatalf("got %d devices, want 2", len(resp.GetDevices()))
+	}
+
+	_, err = client.Allocate(ctx, &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{resp.GetDevices()[0].GetID()}}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("run() = %v, want nil", err)
+	}
+}
+
+func TestRunDrainOnShutdown(t *testing.T) {
+	endpoint := freeTCPEndpoint(t)
+	setFlags(t, baseFlags(t,
+		"-grpc-listen", endpoint,
+		"-metrics-enabled=false",
+		"-num-devices", "2",
+		"-drain-period", "100ms",
+	)...)
+	stop := startRun(t, slog.New(slog.DiscardHandler))
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(endpoint, "tcp://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+
+	ctx, cancelCall := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancelCall()
+
+	stream, err := v1beta1.NewDevicePluginClient(conn).ListAndWatch(ctx, &v1beta1.Empty{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("ListAndWatch() failed: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("failed to receive devices: %v", err)
+	}
+
+	if err := stop(); err != nil {
+		t.Errorf("run() = %v, want nil", err)
+	}
+
+	// The stream ends with the drained device list.
+	var last []*v1beta1.Device
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			break
+		}
+		last = resp.GetDevices()
+	}
+	if len(last) != 2 {
+		t.Fatalf("got %d devices in the final update, want 2", len(last))
+	}
+	for _, dev := range last {
+		if dev.GetHealth() != v1beta1.Unhealthy {
+			t.Errorf("got device %s %s, want %s", dev.GetID(), dev.GetHealth(), v1beta1.Unhealthy)
+		}
+	}
+}
+
+func TestRunTCPEndpointRequiresSkipRegistration(t *testing.T) {
+	setFlags(t, "-grpc-listen", freeTCPEndpoint(t), "-metrics-enabled=false")
+
+	err := run(t.Context(), slog.New(slog.DiscardHandler))
+	if err == nil || !strings.Contains(err.Error(), "-skip-registration") {
+		t.Errorf("run() = %v, want an error requiring -skip-registration", err)
+	}
+}
+
+func TestRunInvalidPluginNamespace(t *testing.T) {
+	setFlags(t, baseFlags(t, "-plugin-namespace", "Devices.example.com", "-metrics-enabled=false")...)
+
+	err := run(t.Context(), slog.New(slog.DiscardHandler))
+	if err == nil || !strings.Contains(err.Error(), "invalid namespace") {
+		t.Errorf("run() = %v, want an invalid namespace error", err)
+	}
+}
+
+func TestResourceConfigsDeviceCount(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		env     string
+		want    uint
+		wantErr bool
+	}{
+		{name: "default", want: tundeviceplugin.DefaultDeviceCount},
+		{name: "flag", args: []string{"-num-devices", "3"}, want: 3},
+		{name: "flag wins", args: []string{"-num-devices", "3"}, env: "8", want: 3},
+		{name: "deprecated flag wins", args: []string{"-devices", "3"}, env: "8", want: 3},
+		{name: "env fallback", env: "8", want: 8},
+		{name: "invalid env", env: "eight", wantErr: true},
+		{name: "zero env", env: "0", wantErr: true},
+		{name: "negative env", env: "-1", wantErr: true},
+		// The flag takes precedence, so an invalid env is not even parsed.
+		{name: "invalid env with flag", args: []string{"-num-devices", "3"}, env: "eight", want: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.env != "" {
+				t.Setenv(numDevicesEnv, tc.env)
+			}
+			setFlags(t, tc.args...)
+
+			resources, err := resourceConfigs()
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), numDevicesEnv) {
+					t.Fatalf("resourceConfigs() = %v, want an invalid %s error", err, numDevicesEnv)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resourceConfigs() failed: %v", err)
+			}
+			if got := resources[0].Count; got != tc.want {
+				t.Errorf("got %d devices, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunCancelDuringRegistration(t *testing.T) {
+	// Nothing listens on the kubelet socket, so the registration is retried
+	// for hours.
+	dir := t.TempDir()
+	setFlags(t,
+		"-kubelet-socket", filepath.Join(dir, "kubelet.sock"),
+		"-device-plugin-path", dir,
+		"-device-host-path", fakeDevice(t),
+		"-register-base-delay", "1h",
+		"-register-max-delay", "1h",
+		"-metrics-enabled=false",
+		"-health-interval", "0",
+		"-drain-period", "0",
+	)
+
+	var logs syncBuffer
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), `msg="Failure, retrying"`) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the registration was not retried: %s", logs.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	start := time.Now()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run() = %v, want nil", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("run() took %s to return", elapsed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run() did not return while retrying the registration")
+	}
+}
+
+func TestRunKubeletSocket(t *testing.T) {
+	// A kubelet with a custom root dir, as on k3s.
+	dir := filepath.Join(t.TempDir(), "k3s")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("failed to create the kubelet dir: %v", err)
+	}
+	kubeletSocket := filepath.Join(dir, "kubelet.sock")
+	kubelet := &recordingKubelet{registered: make(chan *v1beta1.RegisterRequest, 16)}
+	startKubelet(t, kubelet, kubeletSocket)
+
+	setFlags(t,
+		"-kubelet-socket", kubeletSocket,
+		"-device-plugin-path", dir,
+		"-device-host-path", fakeDevice(t),
+		"-metrics-enabled=false",
+		"-health-interval", "0",
+		"-drain-period", "0",
+	)
+	startRun(t, slog.New(slog.DiscardHandler))
+
+	select {
+	case req := <-kubelet.registered:
+		if req.GetResourceName() != defaultPluginNamespace+"/tun" || req.GetEndpoint() != "tun.sock" {
+			t.Errorf("got registration of %s on %s, want %s/tun on tun.sock",
+				req.GetResourceName(), req.GetEndpoint(), defaultPluginNamespace)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the plugin did not register with the kubelet")
+	}
+}
+
+func TestRunKubeletSocketMissingDir(t *testing.T) {
+	dir := t.TempDir()
+	setFlags(t,
+		"-kubelet-socket", filepath.Join(dir, "missing", "kubelet.sock"),
+		"-device-plugin-path", dir,
+		"-metrics-enabled=false",
+	)
+
+	err := run(t.Context(), slog.New(slog.DiscardHandler))
+	if err == nil || !strings.Contains(err.Error(), "invalid kubelet socket") {
+		t.Errorf("run() = %v, want an invalid kubelet socket error", err)
+	}
+}
+
+type acceptingKubelet struct {
+	v1beta1.UnimplementedRegistrationServer
+}
+
+func (acceptingKubelet) Register(context.Context, *v1beta1.RegisterRequest) (*v1beta1.Empty, error) {
+	return &v1beta1.Empty{}, nil
+}
+
+// registerWithWatcher acts as the kubelet plugin watcher on the registration
+// socket of the tun resource.
+func registerWithWatcher(ctx context.Context, t *testing.T, dir string) {
+	t.Helper()
+
+	conn, err := grpc.NewClient(plugin.RegistrationSocket(dir, defaultPluginNamespace+"/tun"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+	client := registerapi.NewRegistrationClient(conn)
+
+	info, err := client.GetInfo(ctx, &registerapi.InfoRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("GetInfo() failed: %v", err)
+	}
+	if info.GetType() != registerapi.DevicePlugin {
+		t.Fatalf("got plugin type %q, want %q", info.GetType(), registerapi.DevicePlugin)
+	}
+	_, err = client.NotifyRegistrationStatus(ctx, &registerapi.RegistrationStatus{PluginRegistered: true})
+	if err != nil {
+		t.Fatalf("NotifyRegistrationStatus() failed: %v", err)
+	}
+}
+
+func TestRunRegistrationMode(t *testing.T) {
+	for _, mode := range []plugin.RegistrationMode{plugin.RegistrationModeLegacy, plugin.RegistrationModeWatcher} {
+		t.Run(string(mode), func(t *testing.T) {
+			pluginDir := t.TempDir()
+			registryDir := t.TempDir()
+			kubeletSocket := filepath.Join(pluginDir, "kubelet.sock")
+			adminSocket := filepath.Join(t.TempDir(), "admin.sock")
+
+			if mode == plugin.RegistrationModeLegacy {
+				lis, err := net.Listen("unix", kubeletSocket)
+				if err != nil {
+					t.Fatalf("failed to listen: %v", err)
+				}
+				kubelet := grpc.NewServer()
+				v1beta1.RegisterRegistrationServer(kubelet, acceptingKubelet{})
+				go kubelet.Serve(lis) //nolint:errcheck // stopped by the test
+				t.Cleanup(kubelet.Stop)
+			}
+
+			setFlags(t,
+				"-registration-mode", string(mode),
+				"-kubelet-socket", kubeletSocket,
+				"-plugins-registry-dir", registryDir,
+				"-device-plugin-path", pluginDir,
+				"-admin-socket", "unix://"+adminSocket,
+				"-metrics-enabled=false",
+				"-device-host-path", fakeDevice(t),
+				"-health-interval", "0",
+				"-drain-period", "0",
+			)
+			var logs syncBuffer
+			stop := startRun(t, slog.New(slog.NewTextHandler(&logs, nil)))
+
+			ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+			defer cancel()
+			if mode == plugin.RegistrationModeWatcher {
+				registerWithWatcher(ctx, t, registryDir)
+			}
+
+			conn, err := grpc.NewClient("unix://"+adminSocket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+			defer conn.Close() //nolint:errcheck // best effort call
+			resp, err := adminv1.NewAdminClient(conn).GetStatus(ctx,
+				&adminv1.GetStatusRequest{Resource: defaultPluginNamespace + "/tun"}, grpc.WaitForReady(true))
+			if err != nil {
+				t.Fatalf("GetStatus() failed: %v", err)
+			}
+			if got := resp.GetStatus().GetRegistrationMode(); got != string(mode) {
+				t.Errorf("status registration mode = %q, want %q", got, mode)
+			}
+
+			if want := `msg="Using registration mode" mode=` + string(mode); !strings.Contains(logs.String(), want) {
+				t.Errorf("logs do not contain %q:\n%s", want, logs.String())
+			}
+
+			if got := testutil.ToFloat64(metrics.RegistrationMode.WithLabelValues(string(mode))); got != 1 {
+				t.Errorf("tun_registration_mode{mode=%q} = %v, want 1", mode, got)
+			}
+			if got := testutil.CollectAndCount(metrics.RegistrationMode); got != 1 {
+				t.Errorf("tun_registration_mode has %d series, want 1", got)
+			}
+
+			if err := stop(); err != nil {
+				t.Errorf("run() = %v, want nil", err)
+			}
+		})
+	}
+}
+
+// selfSignedCert writes a self-signed certificate for 127.0.0.1, usable by
+// both the server and the client, and returns its paths.
+func selfSignedCert(t *testing.T) (certPath, keyPath string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tun-device-plugin"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certPath = filepath.Join(dir, "tls.crt")
+	keyPath = filepath.Join(dir, "tls.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestRunMetricsTLS(t *testing.T) {
+	certPath, keyPath := selfSignedCert(t)
+	addr := freeAddr(t)
+	setFlags(t, baseFlags(t,
+		"-metrics-addr", "tcp://"+addr,
+		"-metrics-tls-cert", certPath,
+		"-metrics-tls-key", keyPath,
+		"-metrics-client-ca", certPath,
+	)...)
+	startRun(t, slog.New(slog.DiscardHandler))
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load the certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(pair.Leaf)
+
+	for _, tc := range []struct {
+		name    string
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{name: "client certificate", certs: []tls.Certificate{pair}},
+		{name: "no client certificate", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: tc.certs, MinVersion: tls.VersionTLS12},
+			}}
+			defer client.CloseIdleConnections()
+
+			resp, err := get(t, client, "https://"+addr+"/metrics")
+			if tc.wantErr {
+				if err == nil {
+					_ = resp.Body.Close()
+					t.Fatal("scraping without a client certificate succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to scrape: %v", err)
+			}
+			defer resp.Body.Close() //nolint:errcheck // best effort call
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read the metrics: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if !strings.Contains(string(body), "tun_registration_mode") {
+				t.Errorf("the metrics do not contain tun_registration_mode:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestEnsureSocketDir(t *testing.T) {
+	root := t.TempDir()
+	// Only the first level of the tree exists.
+	if err := os.Mkdir(filepath.Join(root, "var"), 0o700); err != nil {
+		t.Fatalf("failed to create the partial tree: %v", err)
+	}
+	dir := filepath.Join(root, "var", "lib", "kubelet", "device-plugins")
+
+	for range 2 {
+		if err := ensureSocketDir(dir); err != nil {
+			t.Fatalf("ensureSocketDir() failed: %v", err)
+		}
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("the socket dir is missing: %v", err)
+	}
+	if got := info.Mode().Perm(); got != socketDirPerm {
+		t.Errorf("got mode %v, want %v", got, os.FileMode(socketDirPerm))
+	}
+	// The existing part of the tree is left untouched.
+	if info, err := os.Stat(filepath.Join(root, "var")); err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("the existing dir changed: %v, %v", info, err)
+	}
+}
+
+func TestEnsureSocketDirReadOnly(t *testing.T) {
+	mkdirAll = func(path string, _ os.FileMode) error {
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EROFS}
+	}
+	t.Cleanup(func() { mkdirAll = os.MkdirAll })
+
+	err := ensureSocketDir("/var/lib/kubelet/device-plugins")
+	if !errors.Is(err, syscall.EROFS) {
+		t.Fatalf("ensureSocketDir() = %v, want %v", err, syscall.EROFS)
+	}
+	if !strings.Contains(err.Error(), "must be writable") {
+		t.Errorf("got error %q, want a writable dir hint", err)
+	}
+}
+
+func TestQuitQuitQuit(t *testing.T) {
+	allowlist, err := parseAllowlist("127.0.0.1/32")
+	if err != nil {
+		t.Fatalf("parseAllowlist() failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		remote   string
+		want     int
+		wantQuit bool
+	}{
+		{name: "post", method: http.MethodPost, remote: "127.0.0.1:1234", want: http.StatusOK, wantQuit: true},
+		{name: "get", method: http.MethodGet, remote: "127.0.0.1:1234", want: http.StatusMethodNotAllowed},
+		{name: "put", method: http.MethodPut, remote: "127.0.0.1:1234", want: http.StatusMethodNotAllowed},
+		{name: "not allowlisted", method: http.MethodPost, remote: "10.0.0.1:1234", want: http.StatusForbidden},
+		{name: "invalid remote", method: http.MethodPost, remote: "unknown", want: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var quit bool
+			handler := quitquitquit(slog.New(slog.DiscardHandler), allowlist, func() { quit = true })
+
+			req := httptest.NewRequest(tc.method, "/quitquitquit", nil)
+			req.RemoteAddr = tc.remote
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				t.Errorf("got status %d, want %d", rec.Code, tc.want)
+			}
+			if quit != tc.wantQuit {
+				t.Errorf("got quit %t, want %t", quit, tc.wantQuit)
+			}
+		})
+	}
+}
+
+func TestRunQuitQuitQuit(t *testing.T) {
+	addr := freeAddr(t)
+	setFlags(t, baseFlags(t, "-metrics-addr", "tcp://"+addr, "-quit-endpoint")...)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(t.Context(), slog.New(slog.DiscardHandler))
+	}()
+
+	resp, err := get(t, http.DefaultClient, "http://"+addr+"/quitquitquit")
+	if err != nil {
+		t.Fatalf("GET /quitquitquit failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /quitquitquit: got status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Post("http://"+addr+"/quitquitquit", "", nil)
+	if err != nil {
+		t.Fatalf("POST /quitquitquit failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /quitquitquit: got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The plugin shuts down without its context being cancelled.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run() = %v, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run() did not return after /quitquitquit")
+	}
+}
+
+// signalSelf sends sig to the test process, caught by notifyContext.
+func signalSelf(t *testing.T, sig syscall.Signal) {
+	t.Helper()
+
+	if err := syscall.Kill(os.Getpid(), sig); err != nil {
+		t.Fatalf("failed to send %s: %v", sig, err)
+	}
+}
+
+// waitDone waits for ctx to be done and returns its cause.
+func waitDone(t *testing.T, ctx context.Context, timeout time.Duration) error {
+	t.Helper()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-time.After(timeout):
+		t.Fatalf("the context was not cancelled within %s", timeout)
+		return nil
+	}
+}
+
+// recordingKubelet accepts every registration and reports it on registered.
+type recordingKubelet struct {
+	v1beta1.UnimplementedRegistrationServer
+
+	registered chan *v1beta1.RegisterRequest
+}
+
+func (k *recordingKubelet) Register(_ context.Context, req *v1beta1.RegisterRequest) (*v1beta1.Empty, error) {
+	k.registered <- req
+	return &v1beta1.Empty{}, nil
+}
+
+// startKubelet serves kubelet on a unix socket until the test ends.
+func startKubelet(t *testing.T, kubelet v1beta1.RegistrationServer, socket string) {
+	t.Helper()
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on the kubelet socket: %v", err)
+	}
+	srv := grpc.NewServer()
+	v1beta1.RegisterRegistrationServer(srv, kubelet)
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+	t.Cleanup(srv.Stop)
+}
+
+func TestReRegisterOnSignal(t *testing.T) {
+	// The default action of SIGUSR1 kills the test, until the handler runs.
+	guard := make(chan os.Signal, 16)
+	signal.Notify(guard, syscall.SIGUSR1)
+	defer signal.Stop(guard)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	dir := t.TempDir()
+	kubeletSocket := filepath.Join(dir, "kubelet.sock")
+	socket := filepath.Join(dir, "tun.sock")
+	name := defaultPluginNamespace + "/tun"
+
+	kubelet := &recordingKubelet{registered: make(chan *v1beta1.RegisterRequest, 16)}
+	startKubelet(t, kubelet, kubeletSocket)
+
+	dps := plugin.New(nil,
+		plugin.WithKubeletSocket(kubeletSocket),
+		plugin.WithRetryConfig(plugin.RetryConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxRetries: 5}),
+	)
+	srv := dps.DevicePluginServer(&v1beta1.UnimplementedDevicePluginServer{})
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on the plugin socket: %v", err)
+	}
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+	defer srv.Stop()
+	dps.SetServing(name)
+
+	if err := dps.RegisterDevicePlugin(ctx, name, "unix://"+socket); err != nil {
+		t.Fatalf("RegisterDevicePlugin() failed: %v", err)
+	}
+	<-kubelet.registered
+
+	go dps.WatchKubelet(ctx, name, "unix://"+socket, nil) //nolint:errcheck // stopped by the test
+
+	var logs syncBuffer
+	log := slog.New(slog.NewTextHandler(&logs, nil))
+	go reRegisterOnSignal(ctx, log, dps) //nolint:errcheck // stopped by the test
+
+	// The signal is only handled once both loops run, so it is sent until the
+	// plugin registers again.
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	timeout := time.After(10 * time.Second)
+	for registered := false; !registered; {
+		select {
+		case <-kubelet.registered:
+			registered = true
+		case <-tick.C:
+			signalSelf(t, syscall.SIGUSR1)
+		case <-timeout:
+			t.Fatal("the plugin did not register again on SIGUSR1")
+		}
+	}
+
+	if !strings.Contains(logs.String(), `msg="Received SIGUSR1, forcing re-registration with the kubelet"`) {
+		t.Errorf("the manual re-registration is not logged: %s", logs.String())
+	}
+}
+
+func TestHealthServiceNames(t *testing.T) {
+	tun := config.ResourceConfig{Name: "tun"}
+	tap := config.ResourceConfig{Name: "tap"}
+
+	for _, tc := range []struct {
+		name      string
+		service   string
+		resources []config.ResourceConfig
+		want      map[string]string
+	}{
+		{name: "default", resources: []config.ResourceConfig{tun}},
+		{
+			name:      "single resource",
+			service:   "tun-plugin",
+			resources: []config.ResourceConfig{tun},
+			want:      map[string]string{defaultPluginNamespace + "/tun": "tun-plugin"},
+		},
+		{
+			name:      "several resources",
+			service:   "tun-plugin",
+			resources: []config.ResourceConfig{tun, tap},
+			want: map[string]string{
+				defaultPluginNamespace + "/tun": "tun-plugin-tun",
+				defaultPluginNamespace + "/tap": "tun-plugin-tap",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, "-health-service-name", tc.service)
+
+			names := healthServiceNames(tc.resources)
+			if !maps.Equal(names, tc.want) {
+				t.Fatalf("got health service names %v, want %v", names, tc.want)
+			}
+
+			// Every resource is ready on its own service name.
+			dir := t.TempDir()
+			kubeletSocket := filepath.Join(dir, "kubelet.sock")
+			socket := filepath.Join(dir, "tun.sock")
+
+			startKubelet(t, acceptingKubelet{}, kubeletSocket)
+
+			dps := plugin.New(nil, plugin.WithKubeletSocket(kubeletSocket), plugin.WithHealthServiceNames(names))
+			srv := dps.DevicePluginServer(&v1beta1.UnimplementedDevicePluginServer{})
+			lis, err := net.Listen("unix", socket)
+			if err != nil {
+				t.Fatalf("failed to listen on the plugin socket: %v", err)
+			}
+			go srv.Serve(lis) //nolint:errcheck // stopped by the test
+			defer srv.Stop()
+
+			for _, res := range tc.resources {
+				name := defaultPluginNamespace + "/" + res.Name
+				dps.SetServing(name)
+				if err := dps.RegisterDevicePlugin(t.Context(), name, "unix://"+socket); err != nil {
+					t.Errorf("RegisterDevicePlugin(%s) = %v, want nil", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifyContextMinUptime(t *testing.T) {
+	const minUptime = 300 * time.Millisecond
+
+	started := time.Now()
+	ctx, stop := notifyContext(t.Context(), slog.New(slog.DiscardHandler), minUptime, false)
+	defer stop()
+
+	signalSelf(t, syscall.SIGTERM)
+	select {
+	case <-ctx.Done():
+		t.Fatal("the signal was honored before the minimum uptime")
+	case <-time.After(minUptime / 3):
+	}
+
+	err := waitDone(t, ctx, 5*time.Second)
+	if elapsed := time.Since(started); elapsed < minUptime {
+		t.Errorf("shut down after %s, want at least %s", elapsed, minUptime)
+	}
+	if err == nil || !strings.Contains(err.Error(), "terminated") {
+		t.Errorf("got cause %v, want the signal", err)
+	}
+}
+
+func TestNotifyContextSecondSignal(t *testing.T) {
+	ctx, stop := notifyContext(t.Context(), slog.New(slog.DiscardHandler), time.Hour, false)
+	defer stop()
+
+	signalSelf(t, syscall.SIGTERM)
+	// Pending signals of the same kind are merged by the kernel.
+	time.Sleep(50 * time.Millisecond)
+	signalSelf(t, syscall.SIGTERM)
+	waitDone(t, ctx, 5*time.Second)
+}
+
+func TestShutdownSignals(t *testing.T) {
+	const drainPeriod = 300 * time.Millisecond
+
+	for _, tc := range []struct {
+		name          string
+		signal        syscall.Signal
+		fastInterrupt bool
+		wantFast      bool
+	}{
+		{name: "SIGTERM", signal: syscall.SIGTERM},
+		{name: "SIGINT", signal: syscall.SIGINT},
+		{name: "SIGTERM with fast interrupt", signal: syscall.SIGTERM, fastInterrupt: true},
+		{name: "SIGINT with fast interrupt", signal: syscall.SIGINT, fastInterrupt: true, wantFast: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, stop := notifyContext(t.Context(), slog.New(slog.DiscardHandler), 0, tc.fastInterrupt)
+			defer stop()
+
+			signalSelf(t, tc.signal)
+			cause := waitDone(t, ctx, 5*time.Second)
+			if got := errors.Is(cause, errFastShutdown); got != tc.wantFast {
+				t.Errorf("got cause %v, want fast %t", cause, tc.wantFast)
+			}
+
+			var drained bool
+			hooks := shutdownHooks{drain: func() { drained = true }}
+			started := time.Now()
+			if err := shutdown(ctx, slog.New(slog.DiscardHandler), nil, nil, hooks, drainPeriod, time.Second); err != nil {
+				t.Fatalf("shutdown() failed: %v", err)
+			}
+			elapsed := time.Since(started)
+
+			// Devices are always reported unhealthy, only the drain period is skipped.
+			if !drained {
+				t.Error("the devices were not drained")
+			}
+			if tc.wantFast && elapsed >= drainPeriod {
+				t.Errorf("fast shutdown took %s, want less than the drain period", elapsed)
+			}
+			if !tc.wantFast && elapsed < drainPeriod {
+				t.Errorf("shutdown took %s, want at least the drain period %s", elapsed, drainPeriod)
+			}
+		})
+	}
+}
+
+func TestLogHandler(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{format: "json", check: func(t *testing.T, line string) {
+			rec := map[string]any{}
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("got %q, want a JSON object: %v", line, err)
+			}
+			if rec["level"] != "INFO" || rec["msg"] != "Started" || rec["resource"] != "tun" {
+				t.Errorf("got record %v", rec)
+			}
+			if _, ok := rec["time"]; !ok {
+				t.Error("the record has no time")
+			}
+		}},
+		{format: "text", check: func(t *testing.T, line string) {
+			if !strings.HasPrefix(line, "time=") || !strings.HasSuffix(line, "level=INFO msg=Started resource=tun") {
+				t.Errorf("got %q, want a logfmt line", line)
+			}
+		}},
+		// Unknown formats fall back to text.
+		{format: "yaml", check: func(t *testing.T, line string) {
+			if !strings.HasSuffix(line, "level=INFO msg=Started resource=tun") {
+				t.Errorf("got %q, want a logfmt line", line)
+			}
+		}},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			log := slog.New(logHandler(tc.format, &buf, slog.LevelInfo))
+			log.Debug("Filtered out", "resource", "tun")
+			log.Info("Started", "resource", "tun")
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("got %d lines, want 1: %q", len(lines), buf.String())
+			}
+			tc.check(t, lines[0])
+		})
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin.log")
+	if err := os.WriteFile(path, []byte("previous run\n"), 0o600); err != nil {
+		t.Fatalf("failed to create the log file: %v", err)
+	}
+
+	out, closeLog, err := logOutput(path)
+	if err != nil {
+		t.Fatalf("logOutput() failed: %v", err)
+	}
+	slog.New(logHandler("text", out, slog.LevelInfo)).Info("Starting plugin", "version", "test")
+	if err := closeLog(); err != nil {
+		t.Fatalf("failed to close the log file: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the log file: %v", err)
+	}
+	// Logs are appended to the existing content.
+	if !strings.HasPrefix(string(data), "previous run\n") ||
+		!strings.Contains(string(data), `msg="Starting plugin" version=test`) {
+		t.Errorf("got log file content %q, want the previous run followed by the new record", data)
+	}
+
+	t.Run("stdout", func(t *testing.T) {
+		out, closeLog, err := logOutput("")
+		if err != nil {
+			t.Fatalf("logOutput() failed: %v", err)
+		}
+		if out != os.Stdout {
+			t.Errorf("got log output %v, want stdout", out)
+		}
+		if err := closeLog(); err != nil {
+			t.Errorf("closing stdout = %v, want nil", err)
+		}
+	})
+
+	t.Run("unwritable", func(t *testing.T) {
+		_, _, err := logOutput(filepath.Join(t.TempDir(), "missing", "plugin.log"))
+		if err == nil || !strings.Contains(err.Error(), "failed to open log file") {
+			t.Errorf("logOutput() = %v, want an open error", err)
+		}
+	})
+}
+
+func TestReportFeatureGates(t *testing.T) {
+	var buf bytes.Buffer
+	reportFeatureGates(slog.New(slog.NewTextHandler(&buf, nil)), map[string]bool{
+		"NodeDrain": false,
+		"CDI":       true,
+	})
+
+	for gate, want := range map[string]float64{"CDI": 1, "NodeDrain": 0} {
+		if got := testutil.ToFloat64(metrics.FeatureGateEnabled.WithLabelValues(gate)); got != want {
+			t.Errorf("tun_feature_gate_enabled{gate=%q} = %v, want %v", gate, got, want)
+		}
+	}
+	// The gates are logged on a single line, sorted by name.
+	if want := `msg="Feature gates" CDI=true NodeDrain=false`; !strings.Contains(buf.String(), want) {
+		t.Errorf("got %q, want it to contain %q", buf.String(), want)
+	}
+
+	reportFeatureGates(slog.New(slog.DiscardHandler), map[string]bool{"CDI": false})
+	if got := testutil.ToFloat64(metrics.FeatureGateEnabled.WithLabelValues("CDI")); got != 0 {
+		t.Errorf("got CDI gate %v after disabling it, want 0", got)
+	}
+}
+
+func TestListenWithRetry(t *testing.T) {
+	addrInUse := &net.OpError{Op: "listen", Net: "unix", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+
+	for _, tc := range []struct {
+		name      string
+		errs      []error
+		cancel    bool
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "transient", errs: []error{addrInUse, addrInUse}, wantCalls: 3},
+		{name: "permanent", errs: []error{syscall.EACCES}, wantCalls: 1, wantErr: syscall.EACCES},
+		{name: "exhausted", errs: slices.Repeat([]error{addrInUse}, bindMaxRetries), wantCalls: bindMaxRetries,
+			wantErr: syscall.EADDRINUSE},
+		{name: "cancelled", errs: []error{addrInUse}, cancel: true, wantCalls: 1, wantErr: context.Canceled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			if tc.cancel {
+				cancel()
+			}
+
+			var calls int
+			lis, err := listenWithRetry(ctx, slog.New(slog.DiscardHandler), func() (net.Listener, error) {
+				calls++
+				if calls <= len(tc.errs) {
+					return nil, tc.errs[calls-1]
+				}
+				return net.Listen("tcp", "127.0.0.1:0")
+			})
+			if lis != nil {
+				_ = lis.Close()
+			}
+
+			if tc.wantErr == nil && err != nil {
+				t.Fatalf("listenWithRetry() failed: %v", err)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("listenWithRetry() = %v, want %v", err, tc.wantErr)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("got %d attempts, want %d", calls, tc.wantCalls)
+			}
+		})
+	}
+}
+
+// busyServers returns a gRPC and an HTTP server, each with a call in flight
+// when busy is set.
+func busyServers(t *testing.T, busy bool) (*grpc.Server, *http.Server) {
+	t.Helper()
+
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	grpcServer := grpc.NewServer()
+	healthgrpc.RegisterHealthServer(grpcServer, health.NewServer())
+	grpcLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go grpcServer.Serve(grpcLis) //nolint:errcheck // stopped by shutdown
+
+	started := make(chan struct{})
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(started)
+		<-release
+	})}
+	httpLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go httpServer.Serve(httpLis) //nolint:errcheck // stopped by shutdown
+
+	if !busy {
+		return grpcServer, httpServer
+	}
+
+	conn, err := grpc.NewClient(grpcLis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	watch, err := healthgrpc.NewHealthClient(conn).Watch(t.Context(), &healthgrpc.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Watch() failed: %v", err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatalf("failed to receive the health: %v", err)
+	}
+
+	go func() {
+		if resp, err := http.Get("http://" + httpLis.Addr().String()); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+
+	return grpcServer, httpServer
+}
+
+func TestShutdownCounters(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		busy  bool
+		cause error
+		want  string
+	}{
+		{name: "idle servers", cause: context.Canceled, want: metrics.ShutdownGraceful},
+		// A fast shutdown has no grace period, calls in flight are cut.
+		{name: "calls in flight", busy: true, cause: errFastShutdown, want: metrics.ShutdownForced},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			grpcServer, httpServer := busyServers(t, tc.busy)
+
+			counters := map[string]float64{}
+			for _, server := range []string{"grpc", "http"} {
+				counters[server] = testutil.ToFloat64(metrics.ShutdownTotal.WithLabelValues(server, tc.want))
+			}
+
+			ctx, cancel := context.WithCancelCause(t.Context())
+			cancel(tc.cause)
+			err := shutdown(ctx, slog.New(slog.DiscardHandler), []*grpc.Server{grpcServer},
+				[]*http.Server{httpServer}, shutdownHooks{}, 0, 5*time.Second)
+			if err != nil {
+				t.Fatalf("shutdown() failed: %v", err)
+			}
+
+			for server, before := range counters {
+				if got := testutil.ToFloat64(metrics.ShutdownTotal.WithLabelValues(server, tc.want)) - before; got != 1 {
+					t.Errorf("got %v %s %s shutdowns, want 1", got, tc.want, server)
+				}
+			}
+		})
+	}
+}
+
+func TestRunMetricsPath(t *testing.T) {
+	addr := freeAddr(t)
+	setFlags(t, baseFlags(t, "-metrics-addr", "tcp://"+addr, "-metrics-path", "/custom/metrics")...)
+	startRun(t, slog.New(slog.DiscardHandler))
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{path: "/custom/metrics", want: http.StatusOK},
+		{path: "/metrics", want: http.StatusNotFound},
+		{path: "/readyz", want: http.StatusOK},
+	} {
+		resp, err := get(t, http.DefaultClient, "http://"+addr+tc.path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", tc.path, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("GET %s: got status %d, want %d", tc.path, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestRunMetricsDisabled(t *testing.T) {
+	endpoint, addr := freeTCPEndpoint(t), freeAddr(t)
+	setFlags(t, baseFlags(t, "-grpc-listen", endpoint, "-metrics-addr", "tcp://"+addr, "-metrics-enabled=false")...)
+	stop := startRun(t, slog.New(slog.DiscardHandler))
+
+	// The plugin serves once the gRPC server answers.
+	conn, err := grpc.NewClient(strings.TrimPrefix(endpoint, "tcp://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	_, err = v1beta1.NewDevicePluginClient(conn).GetDevicePluginOptions(ctx, &v1beta1.Empty{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatalf("GetDevicePluginOptions() failed: %v", err)
+	}
+
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		_ = conn.Close()
+		t.Errorf("the metrics address %s accepts connections, want no listener", addr)
+	}
+
+	// shutdown copes without the HTTP server.
+	if err := stop(); err != nil {
+		t.Errorf("run() = %v, want nil", err)
+	}
+}
+
+func TestRunPprof(t *testing.T) {
+	addr := freeAddr(t)
+	setFlags(t, baseFlags(t, "-pprof-addr", "tcp://"+addr, "-metrics-enabled=false")...)
+	startRun(t, slog.New(slog.DiscardHandler))
+
+	resp, err := get(t, http.DefaultClient, "http://"+addr+"/debug/pprof/")
+	if err != nil {
+		t.Fatalf("GET /debug/pprof/ failed: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("got status %d and body %q, want the pprof index", resp.StatusCode, body)
+	}
+}
+
+func TestShutdownIncompleteRegistration(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pending []string
+	}{
+		{name: "registered"},
+		{name: "pending", pending: []string{"anza-labs.dev/tap"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			counter := metrics.ShutdownRegistrationIncomplete.WithLabelValues("anza-labs.dev/tap")
+			before := testutil.ToFloat64(counter)
+
+			var logs bytes.Buffer
+			ctx, cancel := context.WithCancel(t.Context())
+			cancel()
+			hooks := shutdownHooks{unregistered: func() []string { return tc.pending }}
+			if err := shutdown(ctx, slog.New(slog.NewTextHandler(&logs, nil)), nil, nil, hooks, 0, time.Second); err != nil {
+				t.Fatalf("shutdown() failed: %v", err)
+			}
+
+			want := float64(len(tc.pending))
+			if got := testutil.ToFloat64(counter) - before; got != want {
+				t.Errorf("got %v incomplete registrations, want %v", got, want)
+			}
+			reported := strings.Contains(logs.String(),
+				`msg="Shutting down before kubelet registration completed" resources=[anza-labs.dev/tap]`)
+			if reported != (len(tc.pending) > 0) {
+				t.Errorf("got the incomplete registration reported %t, want %t: %s", reported, len(tc.pending) > 0, logs.String())
+			}
+		})
+	}
+}
+
+func TestShutdownOrder(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	socket := filepath.Join(t.TempDir(), "tun.sock")
+	lis, cleanup, err := listener(t.Context(), slog.New(slog.DiscardHandler), "unix://"+socket)
+	if err != nil {
+		t.Fatalf("listener() failed: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		_ = grpcServer.Serve(lis)
+		record("grpc stopped")
+		cleanup()
+		record("socket removed")
+	}()
+
+	hooks := shutdownHooks{
+		drain: func() { record("drain") },
+		stop: func() {
+			// The final update is sent while the server still serves.
+			if _, err := os.Stat(socket); err != nil {
+				t.Errorf("the socket is gone before the streams ended: %v", err)
+			}
+			record("stop")
+		},
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	err = shutdown(ctx, slog.New(slog.DiscardHandler), []*grpc.Server{grpcServer}, nil, hooks, 0, time.Second)
+	if err != nil {
+		t.Fatalf("shutdown() failed: %v", err)
+	}
+	<-served
+
+	want := []string{"drain", "stop", "grpc stopped", "socket removed"}
+	if !slices.Equal(events, want) {
+		t.Errorf("got shutdown order %v, want %v", events, want)
+	}
+	if _, err := os.Stat(socket); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got the socket left behind: %v", err)
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	const gracePeriod = 200 * time.Millisecond
+
+	grpcServer, httpServer := busyServers(t, true)
+	forced := map[string]float64{}
+	for _, server := range []string{"grpc", "http"} {
+		forced[server] = testutil.ToFloat64(metrics.ShutdownTotal.WithLabelValues(server, metrics.ShutdownForced))
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	started := time.Now()
+	err := shutdown(ctx, slog.New(slog.DiscardHandler), []*grpc.Server{grpcServer},
+		[]*http.Server{httpServer}, shutdownHooks{}, 0, gracePeriod)
+	if err != nil {
+		t.Fatalf("shutdown() failed: %v", err)
+	}
+
+	// The calls in flight are waited for until the deadline, then cut.
+	if elapsed := time.Since(started); elapsed < gracePeriod || elapsed > gracePeriod+time.Second {
+		t.Errorf("shutdown took %s, want about the grace period %s", elapsed, gracePeriod)
+	}
+	for server, before := range forced {
+		counter := metrics.ShutdownTotal.WithLabelValues(server, metrics.ShutdownForced)
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("got %v forced %s shutdowns, want 1", got, server)
+		}
+	}
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("the HTTP server was not closed: %v", err)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ok := func() error { return nil }
+	notRegistered := func() error { return errors.New("not registered with the kubelet: anza-labs.dev/tun") }
+
+	for _, tc := range []struct {
+		name     string
+		checks   []func() error
+		want     int
+		wantBody string
+	}{
+		{name: "no checks", want: http.StatusOK, wantBody: "ok"},
+		{name: "ready", checks: []func() error{ok, ok}, want: http.StatusOK, wantBody: "ok"},
+		{name: "not ready", checks: []func() error{ok, notRegistered}, want: http.StatusServiceUnavailable,
+			wantBody: "not registered with the kubelet: anza-labs.dev/tun"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			readyz(tc.checks...).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tc.want {
+				t.Errorf("got status %d, want %d", rec.Code, tc.want)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tc.wantBody {
+				t.Errorf("got body %q, want %q", got, tc.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/anza-labs/tun-manager/pkg/servers/tundeviceplugin"
+)
+
+// maxSocketPathLen is the size of sun_path on Linux, minus the NUL byte.
+const maxSocketPathLen = 107
+
+// preflightCheck is the result of a single preflight check.
+type preflightCheck struct {
+	Name     string `json:"name"`
+	Resource string `json:"resource,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// preflightReport is the result of all preflight checks.
+type preflightReport struct {
+	OK     bool             `json:"ok"`
+	Checks []preflightCheck `json:"checks"`
+}
+
+func (r *preflightReport) add(name, resource string, err error) {
+	check := preflightCheck{Name: name, Resource: resource, OK: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// preflight checks that the plugin can serve on this node without serving:
+// the configuration is valid, the devices can be opened and the plugin
+// sockets can be created in the device plugin directory.
+func preflight() *preflightReport {
+	report := &preflightReport{OK: true}
+
+	resources, err := resourceConfigs()
+	report.add("config", "", err)
+	if err != nil {
+		return report
+	}
+
+	report.add("socket-dir", "", checkSocketDir(devicePluginPath))
+
+	for _, res := range resources {
+		srv, err := tundeviceplugin.New(pluginNamespace,
+			tundeviceplugin.WithDeviceCount(res.Count),
+			tundeviceplugin.WithKind(tundeviceplugin.Kind(res.Kind)),
+			tundeviceplugin.WithResourceName(res.Name),
+			tundeviceplugin.WithDevicePaths(res.HostPath, res.ContainerPath),
+			tundeviceplugin.WithSocketDir(devicePluginPath),
+			tundeviceplugin.WithDeviceIDFormat(deviceIDFormat),
+		)
+		report.add("resource", res.Name, err)
+		if err != nil {
+			continue
+		}
+		report.add("device", res.Name, srv.CheckDevice())
+		report.add("socket", res.Name, checkSocket(srv.Socket()))
+	}
+	return report
+}
+
+// checkSocketDir checks that the socket directory exists, or can be created,
+// and is writable.
+func checkSocketDir(dir string) error {
+	if err := ensureSocketDir(dir); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("the device-plugins dir must be writable: %w", err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkSocket checks that a unix socket can be created next to the plugin
+// socket. The plugin socket itself is left alone, as a running plugin may be
+// serving on it.
+func checkSocket(endpoint string) error {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("unable to parse plugin endpoint: %w", err)
+	}
+	if len(endpointURL.Path) > maxSocketPathLen {
+		return fmt.Errorf("socket path %s is longer than %d characters", endpointURL.Path, maxSocketPathLen)
+	}
+
+	path := filepath.Join(filepath.Dir(endpointURL.Path), fmt.Sprintf(".preflight-%d.sock", os.Getpid()))
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("unable to create socket: %w", err)
+	}
+	// Closing a unix listener removes its socket file.
+	if err := lis.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("unable to close socket: %w", err)
+	}
+	return nil
+}
+
+// writePreflight prints the report as JSON, or as one line per check.
+func writePreflight(w io.Writer, format string, report *preflightReport) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	for _, check := range report.Checks {
+		result := "PASS"
+		if !check.OK {
+			result = "FAIL"
+		}
+		name := check.Name
+		if check.Resource != "" {
+			name += " (" + check.Resource + ")"
+		}
+		line := fmt.Sprintf("%s %s", result, name)
+		if check.Error != "" {
+			line += ": " + check.Error
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failedChecks returns the names of the failed checks of report.
+func failedChecks(report *preflightReport) []string {
+	var failed []string
+	for _, check := range report.Checks {
+		if !check.OK {
+			failed = append(failed, check.Name)
+		}
+	}
+	return failed
+}
+
+func TestPreflight(t *testing.T) {
+	// A regular file where a directory is expected cannot be written to, even
+	// as root.
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o600); err != nil {
+		t.Fatalf("failed to create the file: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		args       []string
+		wantFailed []string
+		wantChecks int
+	}{
+		{
+			name:       "pass",
+			args:       []string{"-device-host-path", fakeDevice(t), "-device-plugin-path", t.TempDir()},
+			wantChecks: 5,
+		},
+		{
+			name: "missing device",
+			args: []string{
+				"-device-host-path", filepath.Join(t.TempDir(), "tun"),
+				"-device-plugin-path", t.TempDir(),
+			},
+			wantFailed: []string{"device"},
+			wantChecks: 5,
+		},
+		{
+			name:       "unwritable socket dir",
+			args:       []string{"-device-host-path", fakeDevice(t), "-device-plugin-path", filepath.Join(notDir, "plugins")},
+			wantFailed: []string{"socket-dir", "socket"},
+			wantChecks: 5,
+		},
+		{
+			// Nothing else is checked without a valid config.
+			name:       "invalid config",
+			args:       []string{"-num-devices", "0", "-device-plugin-path", t.TempDir()},
+			wantFailed: []string{"config"},
+			wantChecks: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setFlags(t, tc.args...)
+
+			report := preflight()
+			if got := failedChecks(report); strings.Join(got, ",") != strings.Join(tc.wantFailed, ",") {
+				t.Errorf("got failed checks %v, want %v", got, tc.wantFailed)
+			}
+			if report.OK != (len(tc.wantFailed) == 0) {
+				t.Errorf("got report OK %t, want %t", report.OK, len(tc.wantFailed) == 0)
+			}
+			if len(report.Checks) != tc.wantChecks {
+				t.Errorf("got %d checks, want %d: %+v", len(report.Checks), tc.wantChecks, report.Checks)
+			}
+		})
+	}
+}
+
+func TestCheckSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := checkSocket("unix://" + filepath.Join(dir, "tun.sock")); err != nil {
+		t.Fatalf("checkSocket() = %v, want nil", err)
+	}
+	// The probe socket is removed and the plugin socket never created.
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("got %v, %v left in the socket dir, want nothing", entries, err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		endpoint string
+		wantErr  string
+	}{
+		{
+			name:     "missing dir",
+			endpoint: "unix://" + filepath.Join(dir, "missing", "tun.sock"),
+			wantErr:  "unable to create socket",
+		},
+		{
+			name:     "path too long",
+			endpoint: "unix://" + filepath.Join(dir, strings.Repeat("a", maxSocketPathLen)+".sock"),
+			wantErr:  "longer than",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkSocket(tc.endpoint); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("checkSocket() = %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestWritePreflight(t *testing.T) {
+	report := &preflightReport{OK: true}
+	report.add("config", "", nil)
+	report.add("device", "tun", os.ErrNotExist)
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writePreflight(&buf, "text", report); err != nil {
+			t.Fatalf("writePreflight() failed: %v", err)
+		}
+		want := "PASS config\nFAIL device (tun): file does not exist\n"
+		if buf.String() != want {
+			t.Errorf("got report %q, want %q", buf.String(), want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writePreflight(&buf, "json", report); err != nil {
+			t.Fatalf("writePreflight() failed: %v", err)
+		}
+		var got preflightReport
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("failed to decode the report: %v", err)
+		}
+		if got.OK || len(got.Checks) != 2 || got.Checks[1].Error != "file does not exist" {
+			t.Errorf("got report %+v, want the failed device check", got)
+		}
+	})
+}
@@ -15,11 +15,16 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	semver "github.com/Masterminds/semver/v3"
@@ -32,7 +37,20 @@ const (
 	defaultPluginImageRef  = "ghcr.io/anza-labs/tun-device-plugin"
 )
 
+// dryRun makes runCommand record and log commands instead of running them.
+var (
+	dryRun   bool
+	wouldRun []string
+)
+
 func runCommand(name string, args ...string) error {
+	if dryRun {
+		line := strings.Join(append([]string{name}, args...), " ")
+		wouldRun = append(wouldRun, line)
+		log.Printf("[dry-run] %s", line)
+		return nil
+	}
+
 	cmd := exec.Command(name, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -43,23 +61,45 @@ func gitCmd(args ...string) error {
 	return runCommand("git", args...)
 }
 
-func branchPrep(version, fullVersion string) error {
-	branch := fmt.Sprintf("release-%s", version)
+// releaseVersion is a parsed release tag.
+type releaseVersion struct {
+	// Minor is the Major.Minor release line, shared by its patch releases.
+	Minor string
+	// Full is the normalized tag, including pre-release and build metadata.
+	Full string
+	// Prerelease is set for pre-releases, e.g. release candidates.
+	Prerelease bool
+}
+
+// Branch returns the release branch of the release line.
+func (v releaseVersion) Branch() string {
+	return fmt.Sprintf("release-%s", v.Minor)
+}
+
+// branchPrep checks out the branch the release is cut from and returns it.
+// Patch releases reuse the release branch of their line. Pre-releases use it
+// when it exists, otherwise they are cut from a detached origin/main and no
+// branch is returned, so no release branch is created for them.
+func branchPrep(v releaseVersion) (string, error) {
+	branch := v.Branch()
 
-	if branchExists(branch) {
+	switch {
+	case branchExists(branch):
 		if err := switchToBranch(branch); err != nil {
-			return err
+			return "", err
 		}
-	} else {
+	case v.Prerelease:
+		return "", gitCmd("checkout", "--detach", "origin/main")
+	default:
 		if err := createBranch(branch); err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	return gitCmd(
+	return branch, gitCmd(
 		"merge",
 		"origin/main",
-		"-m", fmt.Sprintf("chore(%s): merge changes for %s", version, fullVersion),
+		"-m", fmt.Sprintf("chore(%s): merge changes for %s", v.Minor, v.Full),
 		"--signoff",
 	)
 }
@@ -78,13 +118,17 @@ func createBranch(branchName string) error {
 	return gitCmd("checkout", "-b", branchName)
 }
 
-func parseVersion(version string) (string, error) {
-	parsed, err := semver.NewVersion(strings.TrimPrefix(version, "v"))
+func parseVersion(version string) (releaseVersion, error) {
+	parsed, err := semver.StrictNewVersion(strings.TrimPrefix(version, "v"))
 	if err != nil {
-		return "", fmt.Errorf("failed to parse version: %w", err)
+		return releaseVersion{}, fmt.Errorf("failed to parse version: %w", err)
 	}
 
-	return fmt.Sprintf("%d.%d", parsed.Major(), parsed.Minor()), nil
+	return releaseVersion{
+		Minor:      fmt.Sprintf("%d.%d", parsed.Major(), parsed.Minor()),
+		Full:       "v" + parsed.String(),
+		Prerelease: parsed.Prerelease() != "",
+	}, nil
 }
 
 func createKustomization(resources []string, imageName, newImageName, newTag string) map[string]interface{} {
@@ -111,29 +155,75 @@ func writeKustomization(kustomization map[string]interface{}, filepath string) e
 	return os.WriteFile(filepath, content, 0644)
 }
 
-func release(version, fullVersion string) error {
+// checksums returns the sha256sum compatible checksums of the files under
+// paths, which may be files or directories.
+func checksums(paths []string) ([]byte, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			files = append(files, filepath.ToSlash(file))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", path, err)
+		}
+	}
+	slices.Sort(files)
+
+	var buf bytes.Buffer
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		fmt.Fprintf(&buf, "%x  %s\n", sha256.Sum256(content), file)
+	}
+	return buf.Bytes(), nil
+}
+
+func writeChecksums(paths []string, out string) error {
+	content, err := checksums(paths)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, content, 0644)
+}
+
+func generateSBOM(tool, out string) error {
+	return runCommand(tool, "dir:.", "-o", "spdx-json="+out)
+}
+
+func release(v releaseVersion, branch string) error {
 	if err := gitCmd("add", "."); err != nil {
 		return err
 	}
 	if err := gitCmd(
 		"commit",
-		"-sm", fmt.Sprintf("chore(%s): create release commit %s", version, fullVersion),
+		"-sm", fmt.Sprintf("chore(%s): create release commit %s", v.Minor, v.Full),
 	); err != nil {
 		return err
 	}
-	if err := gitCmd("push", "origin", fmt.Sprintf("release-%s", version)); err != nil {
-		return err
+	if branch != "" {
+		if err := gitCmd("push", "origin", branch); err != nil {
+			return err
+		}
 	}
-	if err := gitCmd("tag", fullVersion); err != nil {
+	if err := gitCmd("tag", v.Full); err != nil {
 		return err
 	}
-	return gitCmd("push", "--tags")
+	return gitCmd("push", "origin", v.Full)
 }
 
 func main() {
 	versionFlag := flag.String("version", "", "Tagged version to build")
 	imageFlag := flag.String("plugin-image-name", defaultPluginImageName, "Default image name")
 	newImageFlag := flag.String("plugin-image", defaultPluginImageRef, "Default image reference")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the git commands instead of running them")
+	sbomFlag := flag.Bool("sbom", false, "Generate an SPDX SBOM of the repository, requires the SBOM tool")
+	sbomToolFlag := flag.String("sbom-tool", "syft", "SBOM generator invoked with syft compatible arguments")
 
 	flag.Parse()
 
@@ -144,16 +234,41 @@ func main() {
 		log.Fatalf("Failed to parse version: %v", err)
 	}
 
-	if err := branchPrep(version, *versionFlag); err != nil {
+	branch, err := branchPrep(version)
+	if err != nil {
 		log.Fatalf("Failed to prepare branch: %v", err)
 	}
 
-	kustomization := createKustomization(resources, *imageFlag, *newImageFlag, *versionFlag)
-	if err := writeKustomization(kustomization, "./kustomization.yaml"); err != nil {
+	kustomization := createKustomization(resources, *imageFlag, *newImageFlag, version.Full)
+	outDir := "."
+	if dryRun {
+		outDir, err = os.MkdirTemp("", "release-")
+		if err != nil {
+			log.Fatalf("Failed to create temp dir: %v", err)
+		}
+		log.Printf("[dry-run] writing release artifacts to %s", outDir)
+	}
+	kustomizationPath := filepath.Join(outDir, "kustomization.yaml")
+	if err := writeKustomization(kustomization, kustomizationPath); err != nil {
 		log.Fatalf("Failed to write kustomization: %v", err)
 	}
 
-	if err := release(version, *versionFlag); err != nil {
+	manifests := append([]string{kustomizationPath}, resources...)
+	if err := writeChecksums(manifests, filepath.Join(outDir, "checksums.txt")); err != nil {
+		log.Fatalf("Failed to write checksums: %v", err)
+	}
+
+	if *sbomFlag {
+		if err := generateSBOM(*sbomToolFlag, filepath.Join(outDir, "sbom.spdx.json")); err != nil {
+			log.Fatalf("Failed to generate SBOM: %v", err)
+		}
+	}
+
+	if err := release(version, branch); err != nil {
 		log.Fatalf("Failed to release: %v", err)
 	}
+
+	if dryRun {
+		log.Printf("[dry-run] %d commands would run", len(wouldRun))
+	}
 }
@@ -0,0 +1,178 @@
+// Copyright 2024 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		want    releaseVersion
+		branch  string
+	}{
+		{
+			version: "v1.2.3",
+			want:    releaseVersion{Minor: "1.2", Full: "v1.2.3"},
+			branch:  "release-1.2",
+		},
+		{
+			version: "v1.2.0-rc.1",
+			want:    releaseVersion{Minor: "1.2", Full: "v1.2.0-rc.1", Prerelease: true},
+			branch:  "release-1.2",
+		},
+		{
+			version: "v1.3.0",
+			want:    releaseVersion{Minor: "1.3", Full: "v1.3.0"},
+			branch:  "release-1.3",
+		},
+		{
+			version: "1.3.0+build.5",
+			want:    releaseVersion{Minor: "1.3", Full: "v1.3.0+build.5"},
+			branch:  "release-1.3",
+		},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			got, err := parseVersion(tc.version)
+			if err != nil {
+				t.Fatalf("parseVersion() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+			if got.Branch() != tc.branch {
+				t.Errorf("got branch %s, want %s", got.Branch(), tc.branch)
+			}
+		})
+	}
+}
+
+func TestParseVersionInvalid(t *testing.T) {
+	for _, version := range []string{"", "v1.2", "latest", "v1.2.3.4"} {
+		if _, err := parseVersion(version); err == nil {
+			t.Errorf("parseVersion(%q) succeeded, want an error", version)
+		}
+	}
+}
+
+// fakeGit puts a git recording its invocations first in PATH and returns the
+// path of the record.
+func fakeGit(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	record := filepath.Join(dir, "invocations")
+	script := "#!/bin/sh\necho \"$@\" >> " + record + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "git"), []byte(script), 0o755); err != nil {
+		t.Fatalf("failed to write fake git: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return record
+}
+
+func TestDryRun(t *testing.T) {
+	record := fakeGit(t)
+
+	dryRun, wouldRun = true, nil
+	t.Cleanup(func() { dryRun, wouldRun = false, nil })
+
+	v, err := parseVersion("v1.2.3")
+	if err != nil {
+		t.Fatalf("parseVersion() failed: %v", err)
+	}
+	if err := release(v, v.Branch()); err != nil {
+		t.Fatalf("release() failed: %v", err)
+	}
+
+	want := []string{
+		"git add .",
+		"git commit -sm chore(1.2): create release commit v1.2.3",
+		"git push origin release-1.2",
+		"git tag v1.2.3",
+		"git push origin v1.2.3",
+	}
+	if !slices.Equal(wouldRun, want) {
+		t.Errorf("got would-run commands %q, want %q", wouldRun, want)
+	}
+	if _, err := os.Stat(record); !os.IsNotExist(err) {
+		t.Errorf("git was executed in dry-run mode: %v", err)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	record := fakeGit(t)
+
+	if err := gitCmd("tag", "v1.2.3"); err != nil {
+		t.Fatalf("gitCmd() failed: %v", err)
+	}
+	got, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatalf("git was not executed: %v", err)
+	}
+	if string(got) != "tag v1.2.3\n" {
+		t.Errorf("got git invocations %q, want %q", got, "tag v1.2.3\n")
+	}
+	if len(wouldRun) != 0 {
+		t.Errorf("got would-run commands %q outside of dry-run mode", wouldRun)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"kustomization.yaml":       "namespace: anza-labs-kubelet-plugins\n",
+		"config/rbac/role.yaml":    "kind: ClusterRole\n",
+		"config/plugin/plugin.yml": "kind: DaemonSet\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	t.Chdir(dir)
+
+	out := filepath.Join(t.TempDir(), "checksums.txt")
+	if err := writeChecksums([]string{"kustomization.yaml", "config"}, out); err != nil {
+		t.Fatalf("writeChecksums() failed: %v", err)
+	}
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("failed to read checksums: %v", err)
+	}
+	// Matches the output of sha256sum, sorted by path.
+	want := "" +
+		"09e6af4300f21b78dfd48e37b00a14e814093898f11341bbd45f95749e4e2296  config/plugin/plugin.yml\n" +
+		"486560fd4b89c2d5c888536832dc61b00b89fa6609e314f7511f16060ac015d8  config/rbac/role.yaml\n" +
+		"5342308ee10d89d90728b48817303541f70c8d05f3b900dbc8a82bbb22cfeb06  kustomization.yaml\n"
+	if string(got) != want {
+		t.Errorf("got checksums\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestChecksumsMissing(t *testing.T) {
+	if _, err := checksums([]string{filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("checksums() of a missing path succeeded, want an error")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"sigs.k8s.io/yaml"
+)
+
+// nameRegexp matches valid resource names, which are also used as socket
+// names and device ID prefixes.
+var nameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// Config declares the device resources served by the plugin.
+type Config struct {
+	Resources []ResourceConfig `json:"resources"`
+}
+
+// ResourceConfig declares a single device resource.
+type ResourceConfig struct {
+	// Name of the resource, without the plugin namespace.
+	Name string `json:"name"`
+	// Kind of device advertised, tun (default) or tap.
+	Kind string `json:"kind,omitempty"`
+	// Count of devices advertised.
+	Count uint `json:"count"`
+	// HostPath of the device, defaults to /dev/net/tun.
+	HostPath string `json:"hostPath,omitempty"`
+	// ContainerPath the device is exposed at, defaults to /dev/net/tun.
+	ContainerPath string `json:"containerPath,omitempty"`
+	// Annotations added to every allocation, merged over the flag ones.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Load reads and validates the config file at path.
+func Load(path string) ([]ResourceConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return Parse(content)
+}
+
+// Parse decodes and validates a YAML config.
+func Parse(content []byte) ([]ResourceConfig, error) {
+	var cfg Config
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if len(cfg.Resources) == 0 {
+		return nil, errors.New("config declares no resources")
+	}
+
+	names := map[string]struct{}{}
+	for i, res := range cfg.Resources {
+		if !nameRegexp.MatchString(res.Name) {
+			return nil, fmt.Errorf("resource %d: invalid name %q", i, res.Name)
+		}
+		if _, ok := names[res.Name]; ok {
+			return nil, fmt.Errorf("resource %d: duplicate name %q", i, res.Name)
+		}
+		names[res.Name] = struct{}{}
+
+		if res.Count == 0 {
+			return nil, fmt.Errorf("resource %q: count must be greater than zero", res.Name)
+		}
+		switch res.Kind {
+		case "", "tun", "tap":
+		default:
+			return nil, fmt.Errorf("resource %q: unknown kind %q", res.Name, res.Kind)
+		}
+	}
+
+	return cfg.Resources, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anza-labs/tun-manager/pkg/servers/tundeviceplugin"
+)
+
+func TestLoadTwoResources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `resources:
+- name: tun
+  count: 8
+- name: tap
+  kind: tap
+  count: 2
+  annotations:
+    team: net
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	resources, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("got %d resources, want 2", len(resources))
+	}
+
+	// Every resource gets its own server, socket and devices.
+	sockets := map[string]struct{}{}
+	for _, res := range resources {
+		srv, err := tundeviceplugin.New("anza-labs.dev",
+			tundeviceplugin.WithResourceName(res.Name),
+			tundeviceplugin.WithKind(tundeviceplugin.Kind(res.Kind)),
+			tundeviceplugin.WithDeviceCount(res.Count),
+			tundeviceplugin.WithProber(func() error { return nil }),
+		)
+		if err != nil {
+			t.Fatalf("New(%s) failed: %v", res.Name, err)
+		}
+		if want := "anza-labs.dev/" + res.Name; srv.Name() != want {
+			t.Errorf("got server %s, want %s", srv.Name(), want)
+		}
+		if got := len(srv.Status().Devices); got != int(res.Count) {
+			t.Errorf("%s: got %d devices, want %d", res.Name, got, res.Count)
+		}
+		sockets[srv.Socket()] = struct{}{}
+	}
+	if len(sockets) != 2 {
+		t.Errorf("got sockets %v, want one per resource", sockets)
+	}
+	if got := resources[1].Annotations["team"]; got != "net" {
+		t.Errorf("got annotation %q, want net", got)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "no resources", content: "resources: []", want: "no resources"},
+		{name: "unknown field", content: "resources:\n- name: tun\n  count: 1\n  size: 2", want: "failed to parse"},
+		{name: "empty name", content: "resources:\n- count: 1", want: "invalid name"},
+		{name: "uppercase name", content: "resources:\n- name: Tun\n  count: 1", want: "invalid name"},
+		{name: "trailing dash", content: "resources:\n- name: tun-\n  count: 1", want: "invalid name"},
+		{
+			name:    "duplicate name",
+			content: "resources:\n- name: tun\n  count: 1\n- name: tun\n  count: 2",
+			want:    "duplicate name",
+		},
+		{name: "zero count", content: "resources:\n- name: tun\n  count: 0", want: "count must be greater than zero"},
+		{name: "negative count", content: "resources:\n- name: tun\n  count: -1", want: "failed to parse"},
+		{name: "unknown kind", content: "resources:\n- name: tun\n  kind: tunnel\n  count: 1", want: "unknown kind"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Parse() = %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+)
+
+const (
+	RedactNone = "none"
+	RedactHash = "hash"
+)
+
+// IdentifierKeys are the log attribute keys holding pod and container identifiers.
+var IdentifierKeys = []string{"pod", "namespace", "container"}
+
+// MetadataKeys maps the request metadata keys carrying pod and container
+// identifiers, injected by a proxy in front of the plugin, to the identifier
+// keys they are logged under.
+var MetadataKeys = map[string]string{
+	"container-name": "container",
+	"pod-name":       "pod",
+	"pod-namespace":  "namespace",
+}
+
+// Identifiers returns the identifiers found in the request metadata md as
+// key-value pairs for slog, redacted by the handler returned by Redact.
+func Identifiers(md map[string][]string) []any {
+	var attrs []any
+	for _, key := range slices.Sorted(maps.Keys(MetadataKeys)) {
+		if values := md[key]; len(values) > 0 {
+			attrs = append(attrs, MetadataKeys[key], strings.Join(values, ","))
+		}
+	}
+	return attrs
+}
+
+// Redact wraps h according to the redaction policy.
+func Redact(h slog.Handler, policy string) (slog.Handler, error) {
+	switch policy {
+	case RedactNone, "":
+		return h, nil
+	case RedactHash:
+		keys := make(map[string]struct{}, len(IdentifierKeys))
+		for _, k := range IdentifierKeys {
+			keys[k] = struct{}{}
+		}
+		return &redactHandler{next: h, keys: keys}, nil
+	default:
+		return nil, fmt.Errorf("unknown log redaction policy %q", policy)
+	}
+}
+
+// Hash returns a stable, short hash of an identifier, so log lines can still
+// be correlated without exposing the raw value.
+func Hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+type redactHandler struct {
+	next slog.Handler
+	keys map[string]struct{}
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.redact(a))
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted), keys: h.keys}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), keys: h.keys}
+}
+
+func (h *redactHandler) redact(a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, 0, len(attrs))
+		for _, ga := range attrs {
+			redacted = append(redacted, h.redact(ga))
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+
+	if _, ok := h.keys[a.Key]; ok {
+		return slog.String(a.Key, Hash(a.Value.String()))
+	}
+	return a
+}
@@ -0,0 +1,106 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// records decodes the JSON log lines written to buf.
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+
+	var recs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		rec := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("failed to decode %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestRedactHash(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := Redact(slog.NewJSONHandler(&buf, nil), RedactHash)
+	if err != nil {
+		t.Fatalf("Redact() failed: %v", err)
+	}
+	log := slog.New(handler)
+
+	// The same identifiers logged directly, through With and in a group.
+	log.Info("first", "pod", "web-0", "namespace", "prod", "container", "app", "devices", "tun0")
+	log.With("pod", "web-0", "namespace", "prod").Info("second", "container", "app")
+	log.Info("third", slog.Group("request", "pod", "web-0", "namespace", "prod", "container", "app"))
+	log.Info("other", "pod", "web-1")
+
+	if out := buf.String(); strings.Contains(out, "web-0") || strings.Contains(out, "prod") ||
+		strings.Contains(out, `"app"`) {
+		t.Fatalf("raw identifiers were logged: %s", out)
+	}
+
+	recs := records(t, &buf)
+	for _, rec := range recs[:2] {
+		for key, raw := range map[string]string{"pod": "web-0", "namespace": "prod", "container": "app"} {
+			if got := rec[key]; got != Hash(raw) {
+				t.Errorf("%s: got %s %v, want %s", rec["msg"], key, got, Hash(raw))
+			}
+		}
+	}
+	if got := recs[2]["request"].(map[string]any)["pod"]; got != Hash("web-0") {
+		t.Errorf("third: got grouped pod %v, want %s", got, Hash("web-0"))
+	}
+	if got := recs[0]["devices"]; got != "tun0" {
+		t.Errorf("got devices %v, want tun0 unredacted", got)
+	}
+	if recs[3]["pod"] == recs[0]["pod"] {
+		t.Errorf("different pods share the hash %v", recs[0]["pod"])
+	}
+}
+
+func TestRedactNone(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := Redact(slog.NewJSONHandler(&buf, nil), RedactNone)
+	if err != nil {
+		t.Fatalf("Redact() failed: %v", err)
+	}
+	slog.New(handler).Info("allocated", "pod", "web-0")
+
+	if got := records(t, &buf)[0]["pod"]; got != "web-0" {
+		t.Errorf("got pod %v, want web-0", got)
+	}
+
+	if _, err := Redact(slog.NewJSONHandler(&buf, nil), "mask"); err == nil {
+		t.Error("Redact() with an unknown policy succeeded")
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	got := Identifiers(map[string][]string{
+		"container-name": {"app"},
+		"pod-name":       {"web-0"},
+		"authorization":  {"secret"},
+	})
+	want := []any{"container", "app", "pod", "web-0"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Identifiers() = %v, want %v", got, want)
+	}
+}
@@ -15,6 +15,12 @@
 package metrics
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
 	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -30,11 +36,237 @@ var (
 		Name: "grpc_server_panic_total",
 		Help: "Total number of panics in the gRPC server.",
 	})
+	PanicsByMethod = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_grpc_panics_total",
+		Help: "Total number of panics in the gRPC server by method.",
+	}, []string{"method"})
+)
+
+var (
+	DevicesTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_devices_total",
+		Help: "Number of devices advertised to the kubelet.",
+	}, []string{"resource"})
+	DevicesDrained = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_devices_drained",
+		Help: "Number of device slots currently drained for maintenance.",
+	}, []string{"resource"})
+	DevicesUnhealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_devices_unhealthy",
+		Help: "Number of device slots currently unhealthy, e.g. missing device, failed probe or unexpected numbers.",
+	}, []string{"resource"})
+	DevicesAllocated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_devices_allocated",
+		Help: "Number of advertised devices allocated at least once since startup.",
+	}, []string{"resource"})
+	AllocationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_allocations_total",
+		Help: "Total number of containers granted devices.",
+	}, []string{"resource"})
+	DeviceMajor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_device_major",
+		Help: "Major number of the discovered device, 0 when unknown.",
+	}, []string{"resource"})
+	DeviceMinor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_device_minor",
+		Help: "Minor number of the discovered device.",
+	}, []string{"resource"})
+	ListAndWatchCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tun_listandwatch_coalesced_total",
+		Help: "Total number of intermediate device states dropped in favor of a newer one.",
+	})
+	ListAndWatchWatchers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_listandwatch_watchers",
+		Help: "Number of ListAndWatch watchers currently tracked.",
+	}, []string{"resource"})
+	ListAndWatchActiveStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_listandwatch_active_streams",
+		Help: "Number of ListAndWatch calls currently in progress.",
+	}, []string{"resource"})
+	ListAndWatchRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_listandwatch_rejected_total",
+		Help: "Total number of ListAndWatch streams rejected, e.g. over the stream limit.",
+	}, []string{"resource"})
+	ListAndWatchSendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_listandwatch_send_errors_total",
+		Help: "Total number of failed ListAndWatch sends, each closing its stream.",
+	}, []string{"resource"})
+	DeviceLastAllocation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_device_last_allocation_timestamp_seconds",
+		Help: "Unix time of the last allocation of each device.",
+	}, []string{"resource", "device"})
+	RegistrationMode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_registration_mode",
+		Help: "Active kubelet registration mode, the value is always 1.",
+	}, []string{"mode"})
+	BuildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_build_info",
+		Help: "Build information of the running plugin, the value is always 1.",
+	}, []string{"version", "commit", "build_date"})
+	FeatureGateEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_feature_gate_enabled",
+		Help: "Whether an experimental feature is enabled (1) or disabled (0).",
+	}, []string{"gate"})
+	ShutdownTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_shutdown_total",
+		Help: "Total number of server shutdowns by outcome.",
+	}, []string{"server", "result"})
+	KubeletRegisterAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_kubelet_register_attempts_total",
+		Help: "Total number of attempts to register with the kubelet.",
+	}, []string{"resource"})
+	KubeletRegisterFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_kubelet_register_failures_total",
+		Help: "Total number of failed attempts to register with the kubelet.",
+	}, []string{"resource"})
+	KubeletRegistered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tun_kubelet_registered",
+		Help: "Whether the resource is registered with the kubelet (1) or not (0).",
+	}, []string{"resource"})
+	ShutdownRegistrationIncomplete = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_shutdown_registration_incomplete_total",
+		Help: "Total number of shutdowns before the kubelet registration of a resource completed.",
+	}, []string{"resource"})
+	SelfProbeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_self_probe_failures_total",
+		Help: "Total number of failed self allocation probes.",
+	}, []string{"resource"})
+	HealthProbeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tun_health_probe_failures_total",
+		Help: "Total number of failed active device health probes.",
+	}, []string{"resource"})
+	OpenFDs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tun_plugin_open_fds",
+		Help: "Number of file descriptors currently open by the plugin.",
+	})
+)
+
+const (
+	ShutdownGraceful = "graceful"
+	ShutdownForced   = "forced"
+)
+
+const (
+	LatencyHistogram = "histogram"
+	LatencySummary   = "summary"
+	LatencyBoth      = "both"
+)
+
+// Outcomes of an Allocate call.
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
 )
 
+var (
+	// AllocateDuration buckets range from 1ms to ~4s, Allocate is expected to
+	// be fast unless it blocks on the ListAndWatch update channel.
+	AllocateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tun_allocate_duration_seconds",
+		Help:    "Duration of Allocate calls by outcome.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 13),
+	}, []string{"outcome"})
+	// AllocateDurationSummary is nil unless enabled with RegisterAllocateLatency.
+	AllocateDurationSummary prometheus.Summary
+)
+
+// RegisterAllocateLatency registers the Allocate latency histogram, summary,
+// or both. It may be called again, e.g. by tests running the plugin several
+// times, and then replaces the previous summary.
+func RegisterAllocateLatency(mode string, objectives map[float64]float64) error {
+	summary := func() error {
+		if AllocateDurationSummary != nil {
+			Registry.Unregister(AllocateDurationSummary)
+		}
+		AllocateDurationSummary = prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       "tun_allocate_duration_summary_seconds",
+			Help:       "Duration of Allocate calls.",
+			Objectives: objectives,
+		})
+		return Registry.Register(AllocateDurationSummary)
+	}
+	histogram := func() error {
+		err := Registry.Register(AllocateDuration)
+		if are := (prometheus.AlreadyRegisteredError{}); errors.As(err, &are) && are.ExistingCollector == AllocateDuration {
+			return nil
+		}
+		return err
+	}
+
+	switch mode {
+	case LatencyHistogram:
+		return histogram()
+	case LatencySummary:
+		return summary()
+	case LatencyBoth:
+		if err := histogram(); err != nil {
+			return err
+		}
+		return summary()
+	default:
+		return fmt.Errorf("unknown latency metric mode %q", mode)
+	}
+}
+
+// ObserveAllocate records the duration and outcome of an Allocate call.
+func ObserveAllocate(d time.Duration, err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeError
+	}
+	AllocateDuration.WithLabelValues(outcome).Observe(d.Seconds())
+	if AllocateDurationSummary != nil {
+		AllocateDurationSummary.Observe(d.Seconds())
+	}
+}
+
 func init() {
 	Registry.MustRegister(
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		PanicCounter,
+		PanicsByMethod,
+		DevicesTotal,
+		DevicesDrained,
+		DevicesUnhealthy,
+		DevicesAllocated,
+		AllocationsTotal,
+		DeviceMajor,
+		DeviceMinor,
+		ListAndWatchCoalesced,
+		ListAndWatchWatchers,
+		ListAndWatchActiveStreams,
+		ListAndWatchRejected,
+		ListAndWatchSendErrors,
+		DeviceLastAllocation,
+		RegistrationMode,
+		FeatureGateEnabled,
+		BuildInfo,
+		ShutdownTotal,
+		ShutdownRegistrationIncomplete,
+		KubeletRegisterAttempts,
+		KubeletRegisterFailures,
+		KubeletRegistered,
+		HealthProbeFailures,
+		SelfProbeFailures,
+		OpenFDs,
 	)
 }
+
+// SampleOpenFDs periodically updates OpenFDs from /proc/self/fd until ctx is done.
+func SampleOpenFDs(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+			OpenFDs.Set(float64(len(entries)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
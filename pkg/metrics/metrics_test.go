@@ -0,0 +1,105 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// sampleOpenFDs samples the open file descriptors once.
+func sampleOpenFDs(t *testing.T) float64 {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if err := SampleOpenFDs(ctx, time.Hour); err != nil {
+		t.Fatalf("SampleOpenFDs() failed: %v", err)
+	}
+	return testutil.ToFloat64(OpenFDs)
+}
+
+func TestSampleOpenFDs(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skipf("no procfs: %v", err)
+	}
+
+	before := sampleOpenFDs(t)
+	if before <= 0 {
+		t.Fatalf("got %v open fds, want a positive count", before)
+	}
+
+	for i := range 5 {
+		f, err := os.Create(filepath.Join(t.TempDir(), "fd"))
+		if err != nil {
+			t.Fatalf("failed to open file %d: %v", i, err)
+		}
+		defer f.Close() //nolint:errcheck // best effort call
+	}
+
+	if got := sampleOpenFDs(t) - before; got != 5 {
+		t.Errorf("got %v more open fds, want 5", got)
+	}
+}
+
+func TestAllocateLatencySummary(t *testing.T) {
+	if err := RegisterAllocateLatency(LatencyBoth, map[float64]float64{0.5: 0.01, 0.9: 0.01}); err != nil {
+		t.Fatalf("RegisterAllocateLatency() failed: %v", err)
+	}
+
+	for i := 1; i <= 100; i++ {
+		ObserveAllocate(time.Duration(i)*time.Millisecond, nil)
+	}
+
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+	var found bool
+	for _, mf := range families {
+		if mf.GetName() != "tun_allocate_duration_summary_seconds" {
+			continue
+		}
+		found = true
+
+		summary := mf.GetMetric()[0].GetSummary()
+		if summary.GetSampleCount() != 100 {
+			t.Errorf("got %d samples, want 100", summary.GetSampleCount())
+		}
+		want := map[float64]float64{0.5: 0.050, 0.9: 0.090}
+		for _, q := range summary.GetQuantile() {
+			// The error of the objectives allows one rank off either way.
+			if got := q.GetValue(); got < want[q.GetQuantile()]-0.0011 || got > want[q.GetQuantile()]+0.0011 {
+				t.Errorf("got quantile %v = %v, want %v", q.GetQuantile(), got, want[q.GetQuantile()])
+			}
+		}
+		if got := len(summary.GetQuantile()); got != len(want) {
+			t.Errorf("got %d quantiles, want %d", got, len(want))
+		}
+	}
+	if !found {
+		t.Fatal("the summary is not registered")
+	}
+
+	// The histogram keeps recording along with the summary.
+	if got := testutil.CollectAndCount(AllocateDuration); got == 0 {
+		t.Error("the histogram recorded nothing")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// HealthHealthy and HealthUnhealthy are the values of the health annotation.
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+
+	annotateTimeout = 10 * time.Second
+)
+
+// Annotator sets annotations on a node.
+type Annotator interface {
+	Annotate(ctx context.Context, name string, annotations map[string]string) error
+}
+
+// HealthAnnotator returns a function publishing the health of a resource as
+// the "<prefix>/<resource>-health" annotation of the node. The function never
+// blocks: the latest health of every resource is handed to a single worker,
+// running until ctx is done, so the last reported health wins even when the
+// health flaps during a slow patch. Errors are logged.
+func HealthAnnotator(
+	ctx context.Context,
+	log *slog.Logger,
+	annotator Annotator,
+	name, prefix string,
+) func(resource string, healthy bool) {
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+
+	var mu sync.Mutex
+	pending := map[string]bool{}
+	wake := make(chan struct{}, 1)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			}
+
+			mu.Lock()
+			updates := pending
+			pending = map[string]bool{}
+			mu.Unlock()
+
+			for resource, healthy := range updates {
+				annotateHealth(ctx, log, annotator, name, prefix+"/"+resource+"-health", healthy)
+			}
+		}
+	}()
+
+	return func(resource string, healthy bool) {
+		mu.Lock()
+		pending[resource] = healthy
+		mu.Unlock()
+
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func annotateHealth(ctx context.Context, log *slog.Logger, annotator Annotator, name, key string, healthy bool) {
+	value := HealthUnhealthy
+	if healthy {
+		value = HealthHealthy
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, annotateTimeout)
+	defer cancel()
+
+	if err := annotator.Annotate(ctx, name, map[string]string{key: value}); err != nil {
+		log.Error("Failed to annotate node health", "node", name, "annotation", key, "error", err)
+		return
+	}
+	log.Info("Annotated node health", "node", name, "annotation", key, "value", value)
+}
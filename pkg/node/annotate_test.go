@@ -0,0 +1,160 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// recordPatches reports every node patch of the clientset on the returned
+// channel, before the patch is applied.
+func recordPatches(clientset *fake.Clientset) <-chan k8stesting.PatchAction {
+	patches := make(chan k8stesting.PatchAction, 8)
+	clientset.PrependReactor("patch", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches <- action.(k8stesting.PatchAction)
+		return false, nil, nil
+	})
+	return patches
+}
+
+func nextPatch(t *testing.T, patches <-chan k8stesting.PatchAction) k8stesting.PatchAction {
+	t.Helper()
+
+	select {
+	case patch := <-patches:
+		return patch
+	case <-time.After(5 * time.Second):
+		t.Fatal("the node was not patched")
+		return nil
+	}
+}
+
+func healthAnnotation(t *testing.T, clientset *fake.Clientset) string {
+	t.Helper()
+
+	n, err := clientset.CoreV1().Nodes().Get(context.Background(), "worker", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	return n.Annotations["anza-labs.dev/tun-health"]
+}
+
+func TestHealthAnnotator(t *testing.T) {
+	clientset := fake.NewClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker"}})
+	patches := recordPatches(clientset)
+	annotate := HealthAnnotator(t.Context(), nil, NewClient(clientset), "worker", "anza-labs.dev")
+
+	for _, tc := range []struct {
+		healthy bool
+		want    string
+	}{
+		{healthy: false, want: HealthUnhealthy},
+		{healthy: true, want: HealthHealthy},
+	} {
+		annotate("tun", tc.healthy)
+
+		patch := nextPatch(t, patches)
+		if patch.GetName() != "worker" {
+			t.Fatalf("got a patch of node %s, want worker", patch.GetName())
+		}
+		if patch.GetPatchType() != types.MergePatchType {
+			t.Errorf("got patch type %s, want %s", patch.GetPatchType(), types.MergePatchType)
+		}
+		want := `{"metadata":{"annotations":{"anza-labs.dev/tun-health":"` + tc.want + `"}}}`
+		if string(patch.GetPatch()) != want {
+			t.Errorf("got patch %s, want %s", patch.GetPatch(), want)
+		}
+
+		// The reactor reports the patch before the tracker applies it.
+		deadline := time.Now().Add(5 * time.Second)
+		for healthAnnotation(t, clientset) != tc.want && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := healthAnnotation(t, clientset); got != tc.want {
+			t.Errorf("got annotation %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestHealthAnnotatorFlapping(t *testing.T) {
+	clientset := fake.NewClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker"}})
+
+	// The first patch is held until the health flapped a few times. Reactors
+	// run in reverse order, the patches are recorded before being held.
+	release := make(chan struct{})
+	var held bool
+	clientset.PrependReactor("patch", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if !held {
+			held = true
+			<-release
+		}
+		return false, nil, nil
+	})
+	patches := recordPatches(clientset)
+
+	annotate := HealthAnnotator(t.Context(), nil, NewClient(clientset), "worker", "anza-labs.dev")
+
+	annotate("tun", false)
+	first := nextPatch(t, patches)
+	for _, healthy := range []bool{true, false, true} {
+		annotate("tun", healthy)
+	}
+	close(release)
+
+	// The intermediate states are coalesced into one patch with the latest.
+	last := nextPatch(t, patches)
+	for i, tc := range []struct {
+		patch k8stesting.PatchAction
+		want  string
+	}{
+		{patch: first, want: HealthUnhealthy},
+		{patch: last, want: HealthHealthy},
+	} {
+		want := `{"metadata":{"annotations":{"anza-labs.dev/tun-health":"` + tc.want + `"}}}`
+		if string(tc.patch.GetPatch()) != want {
+			t.Errorf("patch %d: got %s, want %s", i, tc.patch.GetPatch(), want)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for healthAnnotation(t, clientset) != HealthHealthy && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := healthAnnotation(t, clientset); got != HealthHealthy {
+		t.Errorf("got annotation %q, want %q", got, HealthHealthy)
+	}
+	if len(patches) != 0 {
+		t.Errorf("got %d unexpected patches", len(patches))
+	}
+}
+
+func TestHealthAnnotatorMissingNode(t *testing.T) {
+	clientset := fake.NewClientset()
+	patches := recordPatches(clientset)
+	annotate := HealthAnnotator(t.Context(), nil, NewClient(clientset), "worker", "anza-labs.dev")
+
+	// Errors are only logged.
+	annotate("tun", false)
+	nextPatch(t, patches)
+}
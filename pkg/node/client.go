@@ -0,0 +1,72 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Client is a client for the Node API.
+type Client struct {
+	clientset kubernetes.Interface
+}
+
+// NewClient returns a Client using clientset.
+func NewClient(clientset kubernetes.Interface) *Client {
+	return &Client{clientset: clientset}
+}
+
+// InClusterClient returns a Client authenticated with the service account
+// mounted into the pod.
+func InClusterClient() (*Client, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create clientset: %w", err)
+	}
+	return NewClient(clientset), nil
+}
+
+// Clientset returns the clientset of the client, e.g. for WatchDrain.
+func (c *Client) Clientset() kubernetes.Interface {
+	return c.clientset
+}
+
+// Annotate sets the given annotations on the node with a merge patch.
+func (c *Client) Annotate(ctx context.Context, name string, annotations map[string]string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"annotations": annotations},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+
+	_, err = c.clientset.CoreV1().Nodes().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to annotate node %s: %w", name, err)
+	}
+	return nil
+}
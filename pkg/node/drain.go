@@ -0,0 +1,106 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DrainFunc drains (true) or restores (false) the device capacity.
+type DrainFunc func(drained bool)
+
+// DrainReason returns why the node should be drained, or an empty string
+// when it should not. A node is drained when it is cordoned or when any of
+// the given conditions is True.
+func DrainReason(n *corev1.Node, conditions []string) string {
+	if n.Spec.Unschedulable {
+		return "unschedulable"
+	}
+	for _, c := range n.Status.Conditions {
+		if c.Status == corev1.ConditionTrue && slices.Contains(conditions, string(c.Type)) {
+			return string(c.Type)
+		}
+	}
+	return ""
+}
+
+// WatchDrain watches the node and calls drain on every change of its drain
+// state, until ctx is done. The watch is limited to the node with a field
+// selector, and the node is resynced every resync period.
+func WatchDrain(
+	ctx context.Context,
+	log *slog.Logger,
+	clientset kubernetes.Interface,
+	name string,
+	conditions []string,
+	resync time.Duration,
+	drain DrainFunc,
+) error {
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, resync,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	defer factory.Shutdown()
+
+	// Handlers of an informer are called sequentially, drained needs no lock.
+	drained := false
+	update := func(obj any) {
+		n, ok := obj.(*corev1.Node)
+		if !ok || n.Name != name {
+			return
+		}
+
+		reason := DrainReason(n, conditions)
+		if (reason != "") == drained {
+			return
+		}
+		drained = reason != ""
+		if drained {
+			log.Info("Draining devices because of node state", "node", name, "reason", reason)
+		} else {
+			log.Info("Restoring devices, node state cleared", "node", name)
+		}
+		drain(drained)
+	}
+
+	informer := factory.Core().V1().Nodes().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj any) { update(obj) },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch node %s: %w", name, err)
+	}
+
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWatchDrain(t *testing.T) {
+	worker := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker"}}
+	clientset := fake.NewClientset(worker, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "other"}})
+
+	// Events sent before the informer watches are lost, wait for the watch.
+	watching := make(chan struct{})
+	var once sync.Once
+	clientset.PrependWatchReactor("nodes", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := clientset.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		once.Do(func() { close(watching) })
+		return true, w, err
+	})
+
+	calls := make(chan bool, 8)
+	done := make(chan error, 1)
+	ctx, cancel := context.WithCancel(t.Context())
+	go func() {
+		done <- WatchDrain(ctx, nil, clientset, "worker", []string{"NetworkUnavailable"}, time.Hour, func(drained bool) {
+			calls <- drained
+		})
+	}()
+
+	update := func(n *corev1.Node) {
+		t.Helper()
+		if _, err := clientset.CoreV1().Nodes().Update(ctx, n, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("failed to update node %s: %v", n.Name, err)
+		}
+	}
+	expect := func(want bool) {
+		t.Helper()
+		select {
+		case got := <-calls:
+			if got != want {
+				t.Fatalf("got drained %t, want %t", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("drain(%t) was not called", want)
+		}
+	}
+
+	select {
+	case <-watching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the node is not watched")
+	}
+
+	// Another node being cordoned is ignored.
+	update(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "other"}, Spec: corev1.NodeSpec{Unschedulable: true}})
+
+	cordoned := worker.DeepCopy()
+	cordoned.Spec.Unschedulable = true
+	update(cordoned)
+	expect(true)
+
+	update(worker)
+	expect(false)
+
+	unavailable := worker.DeepCopy()
+	unavailable.Status.Conditions = []corev1.NodeCondition{
+		{Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionTrue},
+	}
+	update(unavailable)
+	expect(true)
+
+	// Unrelated conditions do not restore the devices.
+	unavailable.Status.Conditions = append(unavailable.Status.Conditions,
+		corev1.NodeCondition{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse})
+	update(unavailable)
+
+	update(worker)
+	expect(false)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("WatchDrain() = %v, want nil", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("got %d unexpected drain calls", len(calls))
+	}
+}
+
+func TestDrainReason(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		node corev1.Node
+		want string
+	}{
+		{name: "schedulable"},
+		{name: "cordoned", node: corev1.Node{Spec: corev1.NodeSpec{Unschedulable: true}}, want: "unschedulable"},
+		{
+			name: "condition true",
+			node: corev1.Node{Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionTrue},
+			}}},
+			want: "NetworkUnavailable",
+		},
+		{
+			name: "condition false",
+			node: corev1.Node{Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeNetworkUnavailable, Status: corev1.ConditionFalse},
+			}}},
+		},
+		{
+			name: "other condition",
+			node: corev1.Node{Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+				{Type: corev1.NodeDiskPressure, Status: corev1.ConditionTrue},
+			}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := DrainReason(&tc.node, []string{"NetworkUnavailable"}); got != tc.want {
+				t.Errorf("DrainReason() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+)
+
+// NameEnv is the environment variable populated via the downward API.
+const NameEnv = "NODE_NAME"
+
+var ErrNameUnavailable = errors.New("node name is not available, set -node-name or the NODE_NAME env var")
+
+// ResolveName returns the node name from, in order: the given flag value,
+// the NODE_NAME environment variable and the hostname.
+func ResolveName(flagValue string, log *slog.Logger) (string, error) {
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+
+	if flagValue != "" {
+		log.Debug("Resolved node name", "name", flagValue, "source", "flag")
+		return flagValue, nil
+	}
+
+	if name := os.Getenv(NameEnv); name != "" {
+		log.Debug("Resolved node name", "name", name, "source", "env")
+		return name, nil
+	}
+
+	if name, err := os.Hostname(); err == nil && name != "" {
+		log.Debug("Resolved node name", "name", name, "source", "hostname")
+		return name, nil
+	}
+
+	return "", ErrNameUnavailable
+}
@@ -0,0 +1,50 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package node
+
+import (
+	"os"
+	"testing"
+)
+
+func TestResolveName(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		t.Skipf("no hostname: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		flag string
+		env  string
+		want string
+	}{
+		{name: "flag wins", flag: "from-flag", env: "from-env", want: "from-flag"},
+		{name: "env fallback", env: "from-env", want: "from-env"},
+		{name: "hostname fallback", want: hostname},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(NameEnv, tc.env)
+
+			got, err := ResolveName(tc.flag, nil)
+			if err != nil {
+				t.Fatalf("ResolveName() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("ResolveName() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// ListenFunc creates the listener of a plugin socket, along with a function
+// closing it.
+type ListenFunc func(ctx context.Context, socket string) (net.Listener, func(), error)
+
+// Endpoint serves a device plugin gRPC server on its socket. The kubelet wipes
+// the device-plugins directory when it restarts, plugin sockets included, so
+// the socket can be recreated with Recreate while the server keeps running.
+type Endpoint struct {
+	server  *grpc.Server
+	socket  string
+	listen  ListenFunc
+	serving func()
+
+	mu      sync.Mutex
+	gen     int
+	cleanup func()
+
+	results chan serveResult
+	done    chan struct{}
+}
+
+// serveResult is the result of serving one generation of the socket.
+type serveResult struct {
+	gen int
+	err error
+}
+
+// NewEndpoint returns an Endpoint serving server on socket. serving, when set,
+// is called every time the socket is listening, before it is served, e.g. to
+// mark the health service as serving only once it can be reached.
+func NewEndpoint(server *grpc.Server, socket string, listen ListenFunc, serving func()) *Endpoint {
+	return &Endpoint{
+		server:  server,
+		socket:  socket,
+		listen:  listen,
+		serving: serving,
+		results: make(chan serveResult),
+		done:    make(chan struct{}),
+	}
+}
+
+// Serve listens on the socket and serves until the gRPC server is stopped or
+// serving the current socket fails.
+func (e *Endpoint) Serve(ctx context.Context) error {
+	defer close(e.done)
+	defer e.close()
+
+	if err := e.Recreate(ctx); err != nil {
+		return err
+	}
+
+	for res := range e.results {
+		e.mu.Lock()
+		current := res.gen == e.gen
+		e.mu.Unlock()
+
+		// Closing a replaced socket fails its Serve, which is expected.
+		if current {
+			return res.err
+		}
+	}
+	return nil
+}
+
+// Recreate replaces the socket with a new one, served by the same server.
+func (e *Endpoint) Recreate(ctx context.Context) error {
+	// The old listener is closed first, as closing a unix listener unlinks
+	// its path, which is the path of the new socket.
+	e.mu.Lock()
+	e.gen++
+	gen := e.gen
+	e.mu.Unlock()
+	e.close()
+
+	lis, cleanup, err := e.listen(ctx, e.socket)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.cleanup = cleanup
+	e.mu.Unlock()
+
+	if e.serving != nil {
+		e.serving()
+	}
+
+	go func() {
+		err := e.server.Serve(lis)
+		select {
+		case e.results <- serveResult{gen: gen, err: err}:
+		case <-e.done:
+		}
+	}()
+	return nil
+}
+
+func (e *Endpoint) close() {
+	e.mu.Lock()
+	cleanup := e.cleanup
+	e.cleanup = nil
+	e.mu.Unlock()
+
+	if cleanup != nil {
+		cleanup()
+	}
+}
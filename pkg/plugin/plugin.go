@@ -16,72 +16,294 @@ package plugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/recovery"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
+	tmlogging "github.com/anza-labs/tun-manager/pkg/logging"
 	"github.com/anza-labs/tun-manager/pkg/metrics"
 
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
+var (
+	// ErrPluginNotReady is returned when the plugin's own gRPC server does not
+	// become healthy.
+	ErrPluginNotReady = errors.New("plugin not ready")
+	// ErrKubeletUnreachable is returned when the kubelet registration service
+	// cannot be reached.
+	ErrKubeletUnreachable = errors.New("kubelet unreachable")
+	// ErrRegistrationRejected is returned when the kubelet refuses the registration.
+	ErrRegistrationRejected = errors.New("registration rejected by kubelet")
+)
+
+const (
+	// stackDumpInterval limits how often full goroutine dumps are logged on panic recovery.
+	stackDumpInterval = time.Minute
+	stackDumpBufSize  = 1 << 20
+)
+
+// RegistrationMode describes how the plugin registers with the kubelet.
+type RegistrationMode string
+
+const (
+	// RegistrationModeLegacy registers through the kubelet Registration RPC.
+	RegistrationModeLegacy RegistrationMode = "legacy"
+	// RegistrationModeWatcher serves a registration socket in the plugins
+	// registry directory, discovered by the kubelet plugin watcher.
+	RegistrationModeWatcher RegistrationMode = "watcher"
+)
+
+// ParseRegistrationMode parses a registration mode, legacy or watcher.
+func ParseRegistrationMode(mode string) (RegistrationMode, error) {
+	switch m := RegistrationMode(mode); m {
+	case RegistrationModeLegacy, RegistrationModeWatcher:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown registration mode %q", mode)
+	}
+}
+
 type Plugin struct {
-	log *slog.Logger
+	log    *slog.Logger
+	health *health.Server
+
+	dumpStacks    bool
+	lastStackDump atomic.Int64
+
+	panicThreshold int
+	panicWindow    time.Duration
+	panicMu        sync.Mutex
+	panics         []time.Time
+	fatal          chan error
+
+	clock       Clock
+	retryConfig RetryConfig
+	reflection  bool
+
+	kubeletSocket    string
+	registerTimeout  time.Duration
+	registrationMode RegistrationMode
+
+	// healthServices maps resource names to custom health service names.
+	healthServices map[string]string
+
+	// registered tracks whether each resource completed kubelet registration.
+	regMu      sync.Mutex
+	registered map[string]bool
+	// reRegisterCh is closed and replaced to trigger a manual re-registration.
+	reRegisterCh chan struct{}
+}
+
+type Option func(*Plugin)
+
+// RetryConfig controls the exponential backoff used while connecting to the
+// plugin socket and registering with the kubelet.
+type RetryConfig struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	MaxRetries int
+}
+
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		BaseDelay:  100 * time.Millisecond,
+		MaxDelay:   5 * time.Second,
+		MaxRetries: 5,
+	}
+}
+
+// WithRetryConfig replaces the default retry configuration.
+func WithRetryConfig(cfg RetryConfig) Option {
+	return func(p *Plugin) {
+		p.retryConfig = cfg
+	}
+}
+
+// WithReflection registers gRPC server reflection on the device plugin server.
+func WithReflection(enabled bool) Option {
+	return func(p *Plugin) {
+		p.reflection = enabled
+	}
+}
+
+// DefaultRegisterTimeout bounds a single kubelet Register call.
+const DefaultRegisterTimeout = 10 * time.Second
+
+// WithRegisterTimeout bounds every kubelet Register call, so a wedged kubelet
+// fails the attempt with DeadlineExceeded and the retry loop takes over.
+func WithRegisterTimeout(timeout time.Duration) Option {
+	return func(p *Plugin) {
+		p.registerTimeout = timeout
+	}
+}
+
+// WithKubeletSocket sets the path of the kubelet registration socket, which
+// differs from v1beta1.KubeletSocket with a custom kubelet root dir.
+func WithKubeletSocket(socket string) Option {
+	return func(p *Plugin) {
+		p.kubeletSocket = socket
+	}
 }
 
-func New(log *slog.Logger) *Plugin {
+// WithHealthServiceNames overrides the gRPC health service name of the given
+// resources, which defaults to the resource name.
+func WithHealthServiceNames(names map[string]string) Option {
+	return func(p *Plugin) {
+		p.healthServices = names
+	}
+}
+
+// healthService returns the health service name of the named resource.
+func (p *Plugin) healthService(name string) string {
+	if service, ok := p.healthServices[name]; ok {
+		return service
+	}
+	return name
+}
+
+// WithPanicStackDump enables logging of a full goroutine dump when a panic is recovered.
+func WithPanicStackDump(enabled bool) Option {
+	return func(p *Plugin) {
+		p.dumpStacks = enabled
+	}
+}
+
+// WithPanicEscalation makes WatchPanics return a fatal error once more than
+// threshold panics are recovered within window. Zero threshold disables it.
+func WithPanicEscalation(threshold int, window time.Duration) Option {
+	return func(p *Plugin) {
+		p.panicThreshold = threshold
+		p.panicWindow = window
+	}
+}
+
+func New(log *slog.Logger, opts ...Option) *Plugin {
 	if log == nil {
 		log = slog.New(slog.DiscardHandler)
 	}
 
-	return &Plugin{
-		log: log,
+	p := &Plugin{
+		log:    log,
+		health: health.NewServer(),
+		fatal:  make(chan error, 1),
+
+		clock:       realClock{},
+		retryConfig: DefaultRetryConfig(),
+
+		registered:   map[string]bool{},
+		reRegisterCh: make(chan struct{}),
+
+		kubeletSocket:    v1beta1.KubeletSocket,
+		registerTimeout:  DefaultRegisterTimeout,
+		registrationMode: RegistrationModeLegacy,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
 }
 
 func (p *Plugin) DevicePluginServer(plugin v1beta1.DevicePluginServer) *grpc.Server {
-	srv := grpc.NewServer(
+	srv := p.GRPCServer()
+
+	metrics.GRPCServerMetrics.InitializeMetrics(srv)
+	v1beta1.RegisterDevicePluginServer(srv, plugin)
+	grpc_health_v1.RegisterHealthServer(srv, p.health)
+	if p.reflection {
+		reflection.Register(srv)
+	}
+
+	return srv
+}
+
+// GRPCServer returns a gRPC server with the logging, metrics and recovery interceptors.
+func (p *Plugin) GRPCServer() *grpc.Server {
+	return grpc.NewServer(
 		grpc.ChainUnaryInterceptor(
 			metrics.GRPCServerMetrics.UnaryServerInterceptor(),
 			logging.UnaryServerInterceptor(&grpcLogger{log: p.log}),
-			recovery.UnaryServerInterceptor(recovery.WithRecoveryHandler(grpcRecovery(p.log))),
+			recovery.UnaryServerInterceptor(recovery.WithRecoveryHandlerContext(p.grpcRecovery)),
 		),
 		grpc.ChainStreamInterceptor(
 			metrics.GRPCServerMetrics.StreamServerInterceptor(),
 			logging.StreamServerInterceptor(&grpcLogger{log: p.log}),
-			recovery.StreamServerInterceptor(recovery.WithRecoveryHandler(grpcRecovery(p.log))),
+			recovery.StreamServerInterceptor(recovery.WithRecoveryHandlerContext(p.grpcRecovery)),
 		),
 	)
+}
 
-	metrics.GRPCServerMetrics.InitializeMetrics(srv)
-	v1beta1.RegisterDevicePluginServer(srv, plugin)
+// WithRegistrationMode sets how the resources register with the kubelet,
+// RegistrationModeLegacy by default.
+func WithRegistrationMode(mode RegistrationMode) Option {
+	return func(p *Plugin) {
+		p.registrationMode = mode
+	}
+}
 
-	return srv
+// RegistrationMode returns the active registration mode.
+func (p *Plugin) RegistrationMode() RegistrationMode {
+	return p.registrationMode
+}
+
+// SetServing marks the named service as serving on the health server.
+// It is used once the plugin socket is listening and on every re-registration,
+// so health probes stay consistent after kubelet churn. Each resource has its own health
+// service, see WithHealthServiceNames, so a probe can target one resource.
+func (p *Plugin) SetServing(name string) {
+	p.health.SetServingStatus(p.healthService(name), grpc_health_v1.HealthCheckResponse_SERVING)
 }
 
+// RegisterDevicePlugin registers the named resource with the kubelet once its
+// health service is serving, see SetServing.
 func (p *Plugin) RegisterDevicePlugin(ctx context.Context, name, socket string) error {
+	p.setRegistered(name, false)
+
 	if err := p.waitForPluginReady(ctx, name, socket); err != nil {
-		return fmt.Errorf("plugin not ready: %w", err)
+		if ctx.Err() != nil {
+			p.log.Info("Registration aborted", "name", name)
+			return nil
+		}
+		return err
 	}
 
-	if err := p.registerWithKubelet(ctx, name, socket); err != nil {
+	err := p.retry(ctx, func() error {
+		return p.registerWithKubelet(ctx, name, socket)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			p.log.Info("Registration aborted", "name", name)
+			return nil
+		}
 		return fmt.Errorf("registration failed: %w", err)
 	}
 
 	return nil
 }
 
-func (p *Plugin) connectGRPCWithRetry(socket string) (*grpc.ClientConn, error) {
+func (p *Plugin) connectGRPCWithRetry(ctx context.Context, socket string) (*grpc.ClientConn, error) {
 	var conn *grpc.ClientConn
 
-	err := p.retry(func() error {
+	err := p.retry(ctx, func() error {
 		var err error
 		conn, err = grpc.NewClient(
 			socket,
@@ -93,45 +315,50 @@ func (p *Plugin) connectGRPCWithRetry(socket string) (*grpc.ClientConn, error) {
 	return conn, err
 }
 
-func (p *Plugin) retry(op func() error) error {
-	baseDelay := 100 * time.Millisecond // Initial backoff delay
-	maxDelay := 5 * time.Second         // Maximum backoff delay
-	maxRetries := 5                     // Maximum retry attempts
+func (p *Plugin) retry(ctx context.Context, op func() error) error {
+	cfg := p.retryConfig
 
 	var err error
-	for attempt := 0; attempt < maxRetries; attempt++ {
+	for attempt := 0; attempt < cfg.MaxRetries; attempt++ {
 		err = op()
 		if err == nil {
 			return nil
 		}
+		if attempt == cfg.MaxRetries-1 {
+			break
+		}
 
-		backoffDelay := baseDelay * (1 << attempt)
-		if backoffDelay > maxDelay {
-			backoffDelay = maxDelay
+		// Shifting is bounded to avoid overflowing for large retry counts.
+		backoffDelay := cfg.MaxDelay
+		if attempt < 32 {
+			if d := cfg.BaseDelay << attempt; d > 0 && d < cfg.MaxDelay {
+				backoffDelay = d
+			}
 		}
 
 		p.log.Debug("Failure, retrying", "backoff", backoffDelay)
-		time.Sleep(backoffDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.clock.After(backoffDelay):
+		}
 	}
 
-	return fmt.Errorf(
-		"failed to create connection to local gRPC server after %d attempts: %w",
-		maxRetries, err,
-	)
+	return fmt.Errorf("failed after %d attempts: %w", cfg.MaxRetries, err)
 }
 
 func (p *Plugin) waitForPluginReady(ctx context.Context, name, socket string) error {
 	p.log.Info("Waiting for socket ready", "name", name, "socket", socket)
 
-	conn, err := p.connectGRPCWithRetry(socket)
+	conn, err := p.connectGRPCWithRetry(ctx, socket)
 	if err != nil {
-		return fmt.Errorf("failed to create connection to local gRPC server: %w", err)
+		return fmt.Errorf("%w: failed to create connection to local gRPC server: %w", ErrPluginNotReady, err)
 	}
 	defer conn.Close() //nolint:errcheck // best effort call
 
 	health := grpc_health_v1.NewHealthClient(conn)
-	err = p.retry(func() error {
-		res, err := health.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: name})
+	err = p.retry(ctx, func() error {
+		res, err := health.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: p.healthService(name)})
 		if err != nil {
 			return err
 		}
@@ -141,7 +368,7 @@ func (p *Plugin) waitForPluginReady(ctx context.Context, name, socket string) er
 		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("failed to check health of the service: %w", err)
+		return fmt.Errorf("%w: failed to check health of the service: %w", ErrPluginNotReady, err)
 	}
 
 	return nil
@@ -151,39 +378,165 @@ func (p *Plugin) registerWithKubelet(ctx context.Context, name, socket string) e
 	p.log.Info("Registering device plugin",
 		"name", name,
 		"socket", socket,
-		"kubelet", v1beta1.KubeletSocket,
+		"kubelet", p.kubeletSocket,
 	)
 
-	conn, err := p.connectGRPCWithRetry(fmt.Sprintf("unix://%s", v1beta1.KubeletSocket))
+	metrics.KubeletRegisterAttempts.WithLabelValues(name).Inc()
+
+	conn, err := p.connectGRPCWithRetry(ctx, fmt.Sprintf("unix://%s", p.kubeletSocket))
 	if err != nil {
-		return fmt.Errorf("failed to connect to kubelet: %v", err)
+		metrics.KubeletRegisterFailures.WithLabelValues(name).Inc()
+		return fmt.Errorf("%w: %w", ErrKubeletUnreachable, err)
 	}
 	defer conn.Close() //nolint:errcheck // best effort call
 
-	_, err = v1beta1.NewRegistrationClient(conn).Register(ctx, &v1beta1.RegisterRequest{
+	registerCtx, cancel := context.WithTimeout(ctx, p.registerTimeout)
+	defer cancel()
+
+	_, err = v1beta1.NewRegistrationClient(conn).Register(registerCtx, &v1beta1.RegisterRequest{
 		Version:      v1beta1.Version,
 		ResourceName: name,
 		Endpoint:     filepath.Base(socket),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to register plugin with kubelet service: %v", err)
+		metrics.KubeletRegisterFailures.WithLabelValues(name).Inc()
+		// The connection is lazy, so an unreachable kubelet is only detected
+		// here. A wedged kubelet is reported the same way once the call times out.
+		if code := status.Code(err); code == codes.Unavailable || code == codes.DeadlineExceeded {
+			return fmt.Errorf("%w: %w", ErrKubeletUnreachable, err)
+		}
+		return fmt.Errorf("%w: %w", ErrRegistrationRejected, err)
 	}
+	p.setRegistered(name, true)
 
 	return nil
 }
 
+func (p *Plugin) setRegistered(name string, registered bool) {
+	p.regMu.Lock()
+	defer p.regMu.Unlock()
+
+	p.registered[name] = registered
+
+	value := 0.0
+	if registered {
+		value = 1
+	}
+	metrics.KubeletRegistered.WithLabelValues(name).Set(value)
+}
+
+// Ready returns an error until every resource completed its kubelet
+// registration, and again whenever the kubelet socket is lost.
+func (p *Plugin) Ready() error {
+	p.regMu.Lock()
+	empty := len(p.registered) == 0
+	p.regMu.Unlock()
+
+	if empty {
+		return errors.New("registration has not started")
+	}
+	if pending := p.Unregistered(); len(pending) > 0 {
+		return fmt.Errorf("not registered with the kubelet: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+// Unregistered returns the resources whose kubelet registration has not
+// completed, sorted by name.
+func (p *Plugin) Unregistered() []string {
+	p.regMu.Lock()
+	defer p.regMu.Unlock()
+
+	var names []string
+	for name, registered := range p.registered {
+		if !registered {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
 type grpcLogger struct {
 	log *slog.Logger
 }
 
+// Log logs the interceptor fields along with the pod and container identifiers
+// of the request metadata, which are hashed under the hash redaction policy.
 func (g *grpcLogger) Log(ctx context.Context, _ logging.Level, msg string, kv ...any) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		kv = append(kv, tmlogging.Identifiers(md)...)
+	}
 	g.log.Debug(msg, kv...)
 }
 
-func grpcRecovery(log *slog.Logger) func(p any) (err error) {
-	return func(p any) (err error) {
-		log.Error("Panic recovery", "panic", p)
-		metrics.PanicCounter.Inc()
+func (p *Plugin) grpcRecovery(ctx context.Context, r any) (err error) {
+	method, ok := grpc.Method(ctx)
+	if !ok {
+		method = "unknown"
+	}
+	p.log.Error("Panic recovery", "method", method, "panic", r)
+	metrics.PanicCounter.Inc()
+	metrics.PanicsByMethod.WithLabelValues(method).Inc()
+
+	if p.dumpStacks {
+		p.dumpGoroutines()
+	}
+
+	p.escalatePanic()
+
+	return nil
+}
+
+// WatchPanics blocks until ctx is done or the panic threshold is exceeded,
+// in which case it returns an error so the process can be restarted clean.
+func (p *Plugin) WatchPanics(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
 		return nil
+	case err := <-p.fatal:
+		return err
 	}
 }
+
+func (p *Plugin) escalatePanic() {
+	if p.panicThreshold <= 0 {
+		return
+	}
+
+	p.panicMu.Lock()
+	defer p.panicMu.Unlock()
+
+	now := p.clock.Now()
+	recent := p.panics[:0]
+	for _, t := range p.panics {
+		if now.Sub(t) < p.panicWindow {
+			recent = append(recent, t)
+		}
+	}
+	p.panics = append(recent, now)
+
+	if len(p.panics) > p.panicThreshold {
+		select {
+		case p.fatal <- fmt.Errorf("recovered %d panics within %s, exceeding threshold of %d",
+			len(p.panics), p.panicWindow, p.panicThreshold):
+		default:
+		}
+	}
+}
+
+func (p *Plugin) dumpGoroutines() {
+	now := p.clock.Now().UnixNano()
+	last := p.lastStackDump.Load()
+	if last != 0 && time.Duration(now-last) < stackDumpInterval {
+		p.log.Debug("Skipping goroutine dump, rate limited")
+		return
+	}
+	if !p.lastStackDump.CompareAndSwap(last, now) {
+		return
+	}
+
+	buf := make([]byte, stackDumpBufSize)
+	n := runtime.Stack(buf, true)
+	p.log.Error("Goroutine dump", "stacks", string(buf[:n]))
+}
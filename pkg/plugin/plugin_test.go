@@ -0,0 +1,639 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	tmlogging "github.com/anza-labs/tun-manager/pkg/logging"
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// syncBuffer is a log sink safe for use by concurrent gRPC handlers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type panickingPlugin struct {
+	v1beta1.UnimplementedDevicePluginServer
+}
+
+func (*panickingPlugin) GetDevicePluginOptions(context.Context, *v1beta1.Empty) (*v1beta1.DevicePluginOptions, error) {
+	panic("boom")
+}
+
+// fakeClock is a clock whose time only moves when advanced, and whose timers
+// fire immediately. The duration of every timer is recorded.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.sleeps = append(c.sleeps, d)
+	c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func (c *fakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.sleeps)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// callPanicking calls a panicking handler of a device plugin server served by p.
+func callPanicking(t *testing.T, p *Plugin) {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := p.DevicePluginServer(&panickingPlugin{})
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+
+	// The recovered panic fails the call, only the logs matter.
+	_, _ = v1beta1.NewDevicePluginClient(conn).GetDevicePluginOptions(t.Context(), &v1beta1.Empty{})
+}
+
+// listServices lists the services of the device plugin server of p through
+// the reflection API.
+func listServices(t *testing.T, p *Plugin) ([]string, error) {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := p.DevicePluginServer(&v1beta1.UnimplementedDevicePluginServer{})
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(t.Context())
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	var services []string
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		services = append(services, svc.GetName())
+	}
+	return services, nil
+}
+
+func TestReflection(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		services, err := listServices(t, New(nil, WithReflection(true)))
+		if err != nil {
+			t.Fatalf("failed to list services: %v", err)
+		}
+		if !slices.Contains(services, "v1beta1.DevicePlugin") {
+			t.Errorf("got services %v, want v1beta1.DevicePlugin listed", services)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, err := listServices(t, New(nil))
+		if status.Code(err) != codes.Unimplemented {
+			t.Errorf("listing services = %v, want %s", err, codes.Unimplemented)
+		}
+	})
+}
+
+func TestPanicCounters(t *testing.T) {
+	options := metrics.PanicsByMethod.WithLabelValues("/v1beta1.DevicePlugin/GetDevicePluginOptions")
+	allocate := metrics.PanicsByMethod.WithLabelValues("/v1beta1.DevicePlugin/Allocate")
+	optionsBefore, allocateBefore := testutil.ToFloat64(options), testutil.ToFloat64(allocate)
+	totalBefore := testutil.ToFloat64(metrics.PanicCounter)
+
+	callPanicking(t, New(nil))
+
+	if got := testutil.ToFloat64(options) - optionsBefore; got != 1 {
+		t.Errorf("got %v GetDevicePluginOptions panics, want 1", got)
+	}
+	if got := testutil.ToFloat64(allocate) - allocateBefore; got != 0 {
+		t.Errorf("got %v Allocate panics, want 0", got)
+	}
+	// The unlabeled counter is kept for compatibility.
+	if got := testutil.ToFloat64(metrics.PanicCounter) - totalBefore; got != 1 {
+		t.Errorf("got %v panics, want 1", got)
+	}
+}
+
+func TestPanicStackDump(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		enabled bool
+		calls   int
+		advance time.Duration
+		want    int
+	}{
+		{name: "disabled", enabled: false, calls: 1, want: 0},
+		{name: "enabled", enabled: true, calls: 1, want: 1},
+		{name: "rate limited", enabled: true, calls: 3, want: 1},
+		{name: "after the interval", enabled: true, calls: 2, advance: stackDumpInterval, want: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs syncBuffer
+			clock := &fakeClock{now: time.Unix(1, 0)}
+			p := New(slog.New(slog.NewTextHandler(&logs, nil)), WithPanicStackDump(tc.enabled), WithClock(clock))
+
+			for range tc.calls {
+				callPanicking(t, p)
+				clock.Advance(tc.advance)
+			}
+
+			out := logs.String()
+			if !strings.Contains(out, "Panic recovery") {
+				t.Error("the panic was not logged")
+			}
+			if got := strings.Count(out, "Goroutine dump"); got != tc.want {
+				t.Errorf("got %d goroutine dumps, want %d", got, tc.want)
+			}
+			if tc.want > 0 && !strings.Contains(out, "goroutine ") {
+				t.Error("the dump holds no goroutine stacks")
+			}
+		})
+	}
+}
+
+func TestPanicEscalation(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		threshold int
+		calls     int
+		advance   time.Duration
+		wantFatal bool
+	}{
+		{name: "disabled", threshold: 0, calls: 4},
+		{name: "at the threshold", threshold: 2, calls: 2},
+		{name: "over the threshold", threshold: 2, calls: 3, wantFatal: true},
+		{name: "outside the window", threshold: 2, calls: 4, advance: time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1, 0)}
+			p := New(slog.New(slog.DiscardHandler), WithPanicEscalation(tc.threshold, time.Minute), WithClock(clock))
+
+			for range tc.calls {
+				callPanicking(t, p)
+				clock.Advance(tc.advance)
+			}
+
+			ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+			defer cancel()
+			if err := p.WatchPanics(ctx); (err != nil) != tc.wantFatal {
+				t.Errorf("WatchPanics() = %v, want fatal %t", err, tc.wantFatal)
+			}
+		})
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	p := New(nil, WithRetryConfig(RetryConfig{BaseDelay: time.Hour, MaxDelay: time.Hour, MaxRetries: 5}))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	attempts := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- p.retry(ctx, func() error {
+			attempts++
+			cancel()
+			return errors.New("failed")
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("retry() = %v, want %v", err, context.Canceled)
+		}
+		if attempts != 1 {
+			t.Errorf("got %d attempts, want 1", attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry() did not return after the context was cancelled")
+	}
+}
+
+func TestRetryConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxRetries int
+		succeedOn  int
+		want       int
+		wantErr    bool
+	}{
+		{name: "exhausted", maxRetries: 3, want: 3, wantErr: true},
+		{name: "single attempt", maxRetries: 1, want: 1, wantErr: true},
+		{name: "succeeds", maxRetries: 5, succeedOn: 2, want: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := New(nil,
+				WithRetryConfig(RetryConfig{BaseDelay: time.Hour, MaxDelay: time.Hour, MaxRetries: tc.maxRetries}),
+				WithClock(&fakeClock{}),
+			)
+
+			attempts := 0
+			err := p.retry(t.Context(), func() error {
+				attempts++
+				if attempts == tc.succeedOn {
+					return nil
+				}
+				return errors.New("failed")
+			})
+			if (err != nil) != tc.wantErr {
+				t.Errorf("retry() = %v, want error %t", err, tc.wantErr)
+			}
+			if attempts != tc.want {
+				t.Errorf("got %d attempts, want %d", attempts, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		cfg       RetryConfig
+		succeedOn int
+		want      []time.Duration
+	}{
+		{
+			name: "exponential up to the maximum",
+			cfg:  RetryConfig{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, MaxRetries: 7},
+			want: []time.Duration{
+				100 * time.Millisecond,
+				200 * time.Millisecond,
+				400 * time.Millisecond,
+				800 * time.Millisecond,
+				time.Second,
+				time.Second,
+			},
+		},
+		{
+			name:      "succeeds",
+			cfg:       RetryConfig{BaseDelay: time.Second, MaxDelay: time.Minute, MaxRetries: 5},
+			succeedOn: 3,
+			want:      []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name: "single attempt",
+			cfg:  RetryConfig{BaseDelay: time.Second, MaxDelay: time.Minute, MaxRetries: 1},
+		},
+		{
+			name: "shift overflow",
+			cfg:  RetryConfig{BaseDelay: time.Hour, MaxDelay: 24 * time.Hour, MaxRetries: 40},
+			want: slices.Concat(
+				[]time.Duration{time.Hour, 2 * time.Hour, 4 * time.Hour, 8 * time.Hour, 16 * time.Hour},
+				slices.Repeat([]time.Duration{24 * time.Hour}, 34),
+			),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := &fakeClock{}
+			p := New(nil, WithRetryConfig(tc.cfg), WithClock(clock))
+
+			attempts := 0
+			_ = p.retry(t.Context(), func() error {
+				attempts++
+				if attempts == tc.succeedOn {
+					return nil
+				}
+				return errors.New("failed")
+			})
+
+			// There is no sleep after the last attempt.
+			if got := clock.Sleeps(); !slices.Equal(got, tc.want) {
+				t.Errorf("got sleeps %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+type stubKubelet struct {
+	v1beta1.UnimplementedRegistrationServer
+
+	register func(ctx context.Context) error
+}
+
+func (k *stubKubelet) Register(ctx context.Context, _ *v1beta1.RegisterRequest) (*v1beta1.Empty, error) {
+	if err := k.register(ctx); err != nil {
+		return nil, err
+	}
+	return &v1beta1.Empty{}, nil
+}
+
+// serveUnix serves srv on a unix socket until the test ends.
+func serveUnix(t *testing.T, srv *grpc.Server, socket string) {
+	t.Helper()
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socket, err)
+	}
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+	t.Cleanup(srv.Stop)
+}
+
+// newRegisterPlugin returns a plugin registering with a fake kubelet, and the
+// endpoint of its device plugin socket. The plugin is only served when serve
+// is set, and the kubelet only runs with a register function.
+func newRegisterPlugin(t *testing.T, serve bool, register func(ctx context.Context) error) (*Plugin, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	kubeletSocket := filepath.Join(dir, "kubelet.sock")
+	socket := filepath.Join(dir, "tun.sock")
+
+	p := New(nil,
+		WithKubeletSocket(kubeletSocket),
+		WithRetryConfig(RetryConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxRetries: 2}),
+		WithClock(&fakeClock{}),
+	)
+	if serve {
+		serveUnix(t, p.DevicePluginServer(&v1beta1.UnimplementedDevicePluginServer{}), socket)
+		p.SetServing("anza-labs.dev/tun")
+	}
+	if register != nil {
+		kubelet := grpc.NewServer()
+		v1beta1.RegisterRegistrationServer(kubelet, &stubKubelet{register: register})
+		serveUnix(t, kubelet, kubeletSocket)
+	}
+	return p, "unix://" + socket
+}
+
+func TestRegisterDevicePluginErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		serve    bool
+		register func(ctx context.Context) error
+		want     error
+	}{
+		{
+			name: "plugin not ready",
+			register: func(context.Context) error {
+				return nil
+			},
+			want: ErrPluginNotReady,
+		},
+		{
+			name:  "kubelet unreachable",
+			serve: true,
+			want:  ErrKubeletUnreachable,
+		},
+		{
+			name:  "registration rejected",
+			serve: true,
+			register: func(context.Context) error {
+				return status.Error(codes.InvalidArgument, "unsupported version")
+			},
+			want: ErrRegistrationRejected,
+		},
+		{
+			name:  "registered",
+			serve: true,
+			register: func(context.Context) error {
+				return nil
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, socket := newRegisterPlugin(t, tc.serve, tc.register)
+
+			err := p.RegisterDevicePlugin(t.Context(), "anza-labs.dev/tun", socket)
+			if !errors.Is(err, tc.want) || (tc.want == nil && err != nil) {
+				t.Fatalf("RegisterDevicePlugin() = %v, want %v", err, tc.want)
+			}
+			if registered := p.Ready() == nil; registered != (tc.want == nil) {
+				t.Errorf("got registered %t, want %t", registered, tc.want == nil)
+			}
+		})
+	}
+}
+
+func TestRegisterDevicePluginCounters(t *testing.T) {
+	accept := func(context.Context) error { return nil }
+	reject := func(context.Context) error { return status.Error(codes.InvalidArgument, "unsupported version") }
+
+	for _, tc := range []struct {
+		name         string
+		serve        bool
+		register     func(ctx context.Context) error
+		wantAttempts float64
+		wantFailures float64
+	}{
+		// The kubelet is not contacted before the plugin serves.
+		{name: "plugin not ready", register: accept},
+		// Failed attempts are retried up to MaxRetries.
+		{name: "kubelet unreachable", serve: true, wantAttempts: 2, wantFailures: 2},
+		{name: "registration rejected", serve: true, register: reject, wantAttempts: 2, wantFailures: 2},
+		{name: "registered", serve: true, register: accept, wantAttempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := metrics.KubeletRegisterAttempts.WithLabelValues("anza-labs.dev/tun")
+			failures := metrics.KubeletRegisterFailures.WithLabelValues("anza-labs.dev/tun")
+			attemptsBefore, failuresBefore := testutil.ToFloat64(attempts), testutil.ToFloat64(failures)
+
+			p, socket := newRegisterPlugin(t, tc.serve, tc.register)
+			_ = p.RegisterDevicePlugin(t.Context(), "anza-labs.dev/tun", socket)
+
+			if got := testutil.ToFloat64(attempts) - attemptsBefore; got != tc.wantAttempts {
+				t.Errorf("got %v register attempts, want %v", got, tc.wantAttempts)
+			}
+			if got := testutil.ToFloat64(failures) - failuresBefore; got != tc.wantFailures {
+				t.Errorf("got %v register failures, want %v", got, tc.wantFailures)
+			}
+		})
+	}
+}
+
+func TestRegisterTimeout(t *testing.T) {
+	dir := t.TempDir()
+	kubeletSocket := filepath.Join(dir, "kubelet.sock")
+	socket := filepath.Join(dir, "tun.sock")
+
+	p := New(nil,
+		WithKubeletSocket(kubeletSocket),
+		WithRegisterTimeout(50*time.Millisecond),
+		WithRetryConfig(RetryConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxRetries: 3}),
+		WithClock(&fakeClock{}),
+	)
+	serveUnix(t, p.DevicePluginServer(&v1beta1.UnimplementedDevicePluginServer{}), socket)
+	p.SetServing("anza-labs.dev/tun")
+
+	var calls atomic.Int32
+	kubelet := grpc.NewServer()
+	v1beta1.RegisterRegistrationServer(kubelet, &stubKubelet{register: func(ctx context.Context) error {
+		calls.Add(1)
+		// A wedged kubelet never answers.
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	serveUnix(t, kubelet, kubeletSocket)
+
+	start := time.Now()
+	err := p.RegisterDevicePlugin(t.Context(), "anza-labs.dev/tun", "unix://"+socket)
+	if !errors.Is(err, ErrKubeletUnreachable) || status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("RegisterDevicePlugin() = %v, want %v with %s", err, ErrKubeletUnreachable, codes.DeadlineExceeded)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("got %d Register calls, want 3", got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("registration took %s, the timeout was not applied", elapsed)
+	}
+}
+
+func TestPerResourceHealth(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "tun.sock")
+
+	p := New(nil,
+		WithHealthServiceNames(map[string]string{"anza-labs.dev/tap": "tap"}),
+		WithRetryConfig(RetryConfig{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxRetries: 2}),
+		WithClock(&fakeClock{}),
+	)
+	serveUnix(t, p.DevicePluginServer(&v1beta1.UnimplementedDevicePluginServer{}), socket)
+
+	p.SetServing("anza-labs.dev/tun")
+
+	for _, tc := range []struct {
+		service string
+		want    grpc_health_v1.HealthCheckResponse_ServingStatus
+		wantErr codes.Code
+	}{
+		{service: "anza-labs.dev/tun", want: grpc_health_v1.HealthCheckResponse_SERVING},
+		{service: "tap", wantErr: codes.NotFound},
+	} {
+		resp, err := p.health.Check(t.Context(), &grpc_health_v1.HealthCheckRequest{Service: tc.service})
+		if status.Code(err) != tc.wantErr || resp.GetStatus() != tc.want {
+			t.Errorf("service %s: got %s, %v, want %s, %s", tc.service, resp.GetStatus(), err, tc.want, tc.wantErr)
+		}
+	}
+
+	if err := p.waitForPluginReady(t.Context(), "anza-labs.dev/tun", "unix://"+socket); err != nil {
+		t.Errorf("waitForPluginReady(tun) = %v, want nil", err)
+	}
+	err := p.waitForPluginReady(t.Context(), "anza-labs.dev/tap", "unix://"+socket)
+	if !errors.Is(err, ErrPluginNotReady) {
+		t.Errorf("waitForPluginReady(tap) = %v, want %v", err, ErrPluginNotReady)
+	}
+
+	// The tap resource is checked on its own service name.
+	p.SetServing("anza-labs.dev/tap")
+	if err := p.waitForPluginReady(t.Context(), "anza-labs.dev/tap", "unix://"+socket); err != nil {
+		t.Errorf("waitForPluginReady(tap) = %v, want nil", err)
+	}
+}
+
+func TestGRPCLoggerIdentifiers(t *testing.T) {
+	var buf syncBuffer
+	handler, err := tmlogging.Redact(
+		slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}), tmlogging.RedactHash)
+	if err != nil {
+		t.Fatalf("Redact() failed: %v", err)
+	}
+	g := &grpcLogger{log: slog.New(handler)}
+
+	ctx := metadata.NewIncomingContext(t.Context(), metadata.Pairs("container-name", "app"))
+	g.Log(ctx, logging.LevelInfo, "finished call", "grpc.method", "Allocate")
+
+	out := buf.String()
+	if !strings.Contains(out, "container="+tmlogging.Hash("app")) || strings.Contains(out, "container=app") {
+		t.Errorf("got %q, want the hashed container", out)
+	}
+	if !strings.Contains(out, "grpc.method=Allocate") {
+		t.Errorf("got %q, want the interceptor fields", out)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// DefaultPluginsRegistryDir is the directory watched by the kubelet plugin watcher.
+const DefaultPluginsRegistryDir = "/var/lib/kubelet/plugins_registry"
+
+// RegistrationSocket returns the endpoint of the plugin watcher registration
+// socket of the named resource in dir.
+func RegistrationSocket(dir, name string) string {
+	return "unix://" + filepath.Join(dir, strings.ReplaceAll(name, "/", "_")+"-reg.sock")
+}
+
+// RegistrationServer returns a gRPC server answering the kubelet plugin
+// watcher for the named resource, whose device plugin is served on socket.
+// It is used in RegistrationModeWatcher instead of RegisterDevicePlugin, the
+// resource is registered once the kubelet reports a successful registration.
+func (p *Plugin) RegistrationServer(name, socket string) *grpc.Server {
+	p.setRegistered(name, false)
+
+	srv := p.GRPCServer()
+	registerapi.RegisterRegistrationServer(srv, &registrationServer{
+		plugin:   p,
+		name:     name,
+		endpoint: strings.TrimPrefix(socket, "unix://"),
+	})
+	return srv
+}
+
+type registrationServer struct {
+	plugin   *Plugin
+	name     string
+	endpoint string
+}
+
+// GetInfo describes the device plugin, the kubelet dials the endpoint as is.
+func (r *registrationServer) GetInfo(context.Context, *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              r.name,
+		Endpoint:          r.endpoint,
+		SupportedVersions: []string{v1beta1.Version},
+	}, nil
+}
+
+func (r *registrationServer) NotifyRegistrationStatus(
+	_ context.Context,
+	st *registerapi.RegistrationStatus,
+) (*registerapi.RegistrationStatusResponse, error) {
+	metrics.KubeletRegisterAttempts.WithLabelValues(r.name).Inc()
+	if !st.PluginRegistered {
+		metrics.KubeletRegisterFailures.WithLabelValues(r.name).Inc()
+		r.plugin.log.Error("Registration rejected by the kubelet plugin watcher", "name", r.name, "error", st.Error)
+		r.plugin.setRegistered(r.name, false)
+		return &registerapi.RegistrationStatusResponse{}, nil
+	}
+
+	r.plugin.log.Info("Registered with the kubelet plugin watcher", "name", r.name)
+	r.plugin.setRegistered(r.name, true)
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+func TestParseRegistrationMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode    string
+		want    RegistrationMode
+		wantErr bool
+	}{
+		{mode: "legacy", want: RegistrationModeLegacy},
+		{mode: "watcher", want: RegistrationModeWatcher},
+		{mode: "", wantErr: true},
+		{mode: "Watcher", wantErr: true},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			got, err := ParseRegistrationMode(tc.mode)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseRegistrationMode(%q) error = %v, want error %t", tc.mode, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("ParseRegistrationMode(%q) = %q, want %q", tc.mode, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegistrationSocket(t *testing.T) {
+	got := RegistrationSocket("/var/lib/kubelet/plugins_registry", "anza-labs.dev/tun")
+	if want := "unix:///var/lib/kubelet/plugins_registry/anza-labs.dev_tun-reg.sock"; got != want {
+		t.Errorf("RegistrationSocket() = %q, want %q", got, want)
+	}
+}
+
+func TestRegistrationServer(t *testing.T) {
+	const name = "anza-labs.dev/tun"
+	dir := t.TempDir()
+	socket := RegistrationSocket(dir, name)
+
+	p := New(slog.New(slog.DiscardHandler), WithRegistrationMode(RegistrationModeWatcher))
+	serveUnix(t, p.RegistrationServer(name, "unix:///var/lib/kubelet/device-plugins/tun.sock"),
+		filepath.Join(dir, "anza-labs.dev_tun-reg.sock"))
+	if err := p.Ready(); err == nil {
+		t.Fatal("Ready() = nil before the plugin watcher registered the resource")
+	}
+
+	conn, err := grpc.NewClient(socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+	client := registerapi.NewRegistrationClient(conn)
+
+	info, err := client.GetInfo(t.Context(), &registerapi.InfoRequest{})
+	if err != nil {
+		t.Fatalf("GetInfo() failed: %v", err)
+	}
+	if info.GetType() != registerapi.DevicePlugin || info.GetName() != name ||
+		info.GetEndpoint() != "/var/lib/kubelet/device-plugins/tun.sock" ||
+		len(info.GetSupportedVersions()) != 1 || info.GetSupportedVersions()[0] != v1beta1.Version {
+		t.Errorf("unexpected plugin info: %v", info)
+	}
+
+	for _, tc := range []struct {
+		registered bool
+		wantReady  bool
+	}{
+		{registered: true, wantReady: true},
+		{registered: false, wantReady: false},
+	} {
+		_, err := client.NotifyRegistrationStatus(t.Context(),
+			&registerapi.RegistrationStatus{PluginRegistered: tc.registered, Error: "rejected"})
+		if err != nil {
+			t.Fatalf("NotifyRegistrationStatus() failed: %v", err)
+		}
+		if err := p.Ready(); (err == nil) != tc.wantReady {
+			t.Errorf("registered %t: Ready() = %v, want ready %t", tc.registered, err, tc.wantReady)
+		}
+	}
+}
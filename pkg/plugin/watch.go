@@ -0,0 +1,124 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TriggerReRegister makes every WatchKubelet loop re-register its device
+// plugin, as if the kubelet socket was recreated.
+func (p *Plugin) TriggerReRegister() {
+	p.regMu.Lock()
+	defer p.regMu.Unlock()
+
+	close(p.reRegisterCh)
+	p.reRegisterCh = make(chan struct{})
+}
+
+func (p *Plugin) reRegisterTrigger() <-chan struct{} {
+	p.regMu.Lock()
+	defer p.regMu.Unlock()
+
+	return p.reRegisterCh
+}
+
+// WatchKubelet re-registers the device plugin every time the kubelet socket is
+// recreated, which happens when the kubelet restarts, or on TriggerReRegister.
+// A restarting kubelet also removes the plugin socket, so it is recreated with
+// recreate, when set, before re-registering. It blocks until ctx is done.
+func (p *Plugin) WatchKubelet(
+	ctx context.Context,
+	name, socket string,
+	recreate func(ctx context.Context) error,
+) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create kubelet socket watcher: %w", err)
+	}
+	defer watcher.Close() //nolint:errcheck // best effort call
+
+	dir := filepath.Dir(p.kubeletSocket)
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.reRegisterTrigger():
+			p.log.Info("Manual re-registration triggered", "resource", name)
+			if err := p.reRegister(ctx, name, socket); err != nil {
+				if ctx.Err() != nil {
+					p.log.Info("Re-registration aborted", "name", name)
+					return nil
+				}
+				p.log.Error("Re-registration failed", "error", err)
+			}
+		case ev := <-watcher.Events:
+			if filepath.Clean(ev.Name) != filepath.Clean(p.kubeletSocket) {
+				continue
+			}
+			if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				p.log.Warn("Kubelet socket removed, waiting for it to be recreated", "socket", ev.Name)
+				p.setRegistered(name, false)
+				continue
+			}
+			if !ev.Has(fsnotify.Create) {
+				continue
+			}
+
+			p.log.Info("Kubelet socket recreated, re-registering", "socket", ev.Name)
+			if recreate != nil {
+				if err := recreate(ctx); err != nil {
+					p.log.Error("Failed to recreate the plugin socket", "socket", socket, "error", err)
+					continue
+				}
+			}
+			if err := p.reRegister(ctx, name, socket); err != nil {
+				if ctx.Err() != nil {
+					p.log.Info("Re-registration aborted", "name", name)
+					return nil
+				}
+				p.log.Error("Re-registration failed", "error", err)
+			}
+		case err := <-watcher.Errors:
+			p.log.Error("Kubelet socket watcher error", "error", err)
+		}
+	}
+}
+
+// reRegister retries the registration until it succeeds, the retries are
+// exhausted or ctx is cancelled, e.g. on SIGTERM, so it never holds up the
+// shutdown. In RegistrationModeWatcher the kubelet plugin watcher registers
+// the resource again on its own, only the health is re-asserted.
+func (p *Plugin) reRegister(ctx context.Context, name, socket string) error {
+	if p.registrationMode == RegistrationModeWatcher {
+		p.SetServing(name)
+		return nil
+	}
+
+	p.setRegistered(name, false)
+	p.SetServing(name)
+
+	return p.retry(ctx, func() error {
+		return p.registerWithKubelet(ctx, name, socket)
+	})
+}
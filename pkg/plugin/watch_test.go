@@ -0,0 +1,239 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeKubelet is a kubelet registration server which dials back every
+// registered plugin, like the kubelet does.
+type fakeKubelet struct {
+	v1beta1.UnimplementedRegistrationServer
+
+	dir    string
+	dialed chan error
+}
+
+func (k *fakeKubelet) Register(ctx context.Context, req *v1beta1.RegisterRequest) (*v1beta1.Empty, error) {
+	err := dialPlugin(ctx, filepath.Join(k.dir, req.Endpoint))
+	k.dialed <- err
+	if err != nil {
+		return nil, err
+	}
+	return &v1beta1.Empty{}, nil
+}
+
+func dialPlugin(ctx context.Context, socket string) error {
+	conn, err := grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	_, err = v1beta1.NewDevicePluginClient(conn).GetDevicePluginOptions(ctx, &v1beta1.Empty{})
+	return err
+}
+
+func startFakeKubelet(t *testing.T, kubelet *fakeKubelet) *grpc.Server {
+	t.Helper()
+
+	lis, err := net.Listen("unix", filepath.Join(kubelet.dir, "kubelet.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen on the kubelet socket: %v", err)
+	}
+
+	srv := grpc.NewServer()
+	v1beta1.RegisterRegistrationServer(srv, kubelet)
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+
+	return srv
+}
+
+type fakeDevicePlugin struct {
+	v1beta1.UnimplementedDevicePluginServer
+}
+
+func (*fakeDevicePlugin) GetDevicePluginOptions(context.Context, *v1beta1.Empty) (*v1beta1.DevicePluginOptions, error) {
+	return &v1beta1.DevicePluginOptions{}, nil
+}
+
+func listenUnix(_ context.Context, socket string) (net.Listener, func(), error) {
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lis, func() { _ = lis.Close() }, nil
+}
+
+// waitDialed waits for the kubelet to dial the plugin, calling poke, if set,
+// until it does.
+func waitDialed(t *testing.T, kubelet *fakeKubelet, poke func()) {
+	t.Helper()
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case err := <-kubelet.dialed:
+			if err == nil {
+				return
+			}
+		case <-tick.C:
+			if poke != nil {
+				poke()
+			}
+		case <-timeout:
+			t.Fatal("the kubelet could not dial the plugin")
+		}
+	}
+}
+
+func TestWatchKubeletRecreatesPluginSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	dir := t.TempDir()
+	kubelet := &fakeKubelet{dir: dir, dialed: make(chan error, 16)}
+	socket := filepath.Join(dir, "tun.sock")
+
+	p := New(nil,
+		WithKubeletSocket(filepath.Join(dir, "kubelet.sock")),
+		WithRetryConfig(RetryConfig{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, MaxRetries: 20}),
+	)
+
+	kubeletSrv := startFakeKubelet(t, kubelet)
+
+	srv := p.DevicePluginServer(&fakeDevicePlugin{})
+	defer srv.Stop()
+
+	endpoint := NewEndpoint(srv, socket, listenUnix, func() { p.SetServing("anza-labs.dev/tun") })
+	served := make(chan error, 1)
+	go func() { served <- endpoint.Serve(ctx) }()
+
+	watched := make(chan error, 1)
+	go func() { watched <- p.WatchKubelet(ctx, "anza-labs.dev/tun", socket, endpoint.Recreate) }()
+
+	// The manual trigger is only handled once the watcher is running.
+	waitDialed(t, kubelet, p.TriggerReRegister)
+
+	// A restarting kubelet removes every socket of the directory.
+	kubeletSrv.Stop()
+	if err := os.Remove(socket); err != nil {
+		t.Fatalf("failed to remove the plugin socket: %v", err)
+	}
+	if err := dialPlugin(ctx, socket); err == nil {
+		t.Fatal("dialing the removed plugin socket succeeded")
+	}
+
+	restarted := &fakeKubelet{dir: dir, dialed: make(chan error, 16)}
+	kubeletSrv = startFakeKubelet(t, restarted)
+	defer kubeletSrv.Stop()
+
+	waitDialed(t, restarted, nil)
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("WatchKubelet() = %v, want nil", err)
+	}
+	srv.Stop()
+	if err := <-served; err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		t.Errorf("Serve() = %v, want nil", err)
+	}
+}
+
+func TestReRegisterKeepsServing(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	dir := t.TempDir()
+	kubelet := &fakeKubelet{dir: dir, dialed: make(chan error, 16)}
+	socket := filepath.Join(dir, "tun.sock")
+	name := "anza-labs.dev/tun"
+
+	p := New(nil,
+		WithKubeletSocket(filepath.Join(dir, "kubelet.sock")),
+		WithRetryConfig(RetryConfig{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, MaxRetries: 20}),
+	)
+
+	kubeletSrv := startFakeKubelet(t, kubelet)
+	defer kubeletSrv.Stop()
+
+	srv := p.DevicePluginServer(&fakeDevicePlugin{})
+	defer srv.Stop()
+
+	checkServing := func(want grpc_health_v1.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		resp, err := p.health.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: name})
+		if err != nil {
+			t.Fatalf("health check failed: %v", err)
+		}
+		if resp.GetStatus() != want {
+			t.Fatalf("got health %s, want %s", resp.GetStatus(), want)
+		}
+	}
+
+	// Nothing is reported before the socket exists.
+	_, err := p.health.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: name})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("health check = %v, want %s", err, codes.NotFound)
+	}
+
+	endpoint := NewEndpoint(srv, socket, listenUnix, func() { p.SetServing(name) })
+	go endpoint.Serve(ctx) //nolint:errcheck // stopped by the test
+
+	if err := p.RegisterDevicePlugin(ctx, name, "unix://"+socket); err != nil {
+		t.Fatalf("RegisterDevicePlugin() = %v, want nil", err)
+	}
+	<-kubelet.dialed
+	checkServing(grpc_health_v1.HealthCheckResponse_SERVING)
+
+	// The health state is lost, e.g. by a recreated gRPC server, and
+	// re-asserted by the re-registration.
+	p.health.SetServingStatus(name, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+
+	go p.WatchKubelet(ctx, name, "unix://"+socket, endpoint.Recreate) //nolint:errcheck // stopped by the test
+	waitDialed(t, kubelet, p.TriggerReRegister)
+
+	checkServing(grpc_health_v1.HealthCheckResponse_SERVING)
+
+	// The kubelet dials the plugin before answering the registration.
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Ready() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := p.Ready(); err != nil {
+		t.Errorf("Ready() = %v, want nil", err)
+	}
+}
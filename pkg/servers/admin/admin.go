@@ -0,0 +1,139 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin implements the Admin gRPC service, defined in
+// api/admin/v1/admin.proto, for managing the plugin from node agents.
+package admin
+
+import (
+	"context"
+	"log/slog"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	adminv1 "github.com/anza-labs/tun-manager/api/admin/v1"
+	"github.com/anza-labs/tun-manager/pkg/servers/tundeviceplugin"
+)
+
+type Backend interface {
+	Name() string
+	Status() tundeviceplugin.Status
+	SetDrained(drained bool, ids ...string)
+	Rediscover()
+}
+
+type Server struct {
+	adminv1.UnimplementedAdminServer
+
+	log      *slog.Logger
+	backends map[string]Backend
+}
+
+// New returns an admin server managing backends, addressed by their resource
+// name.
+func New(log *slog.Logger, backends ...Backend) *Server {
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+
+	s := &Server{
+		log:      log,
+		backends: make(map[string]Backend, len(backends)),
+	}
+	for _, b := range backends {
+		s.backends[b.Name()] = b
+	}
+	return s
+}
+
+// Register registers the admin service on srv.
+func Register(srv *grpc.Server, s *Server) {
+	adminv1.RegisterAdminServer(srv, s)
+}
+
+func (s *Server) backend(resource string) (Backend, error) {
+	if resource == "" {
+		return nil, status.Error(codes.InvalidArgument, "resource is required")
+	}
+	b, ok := s.backends[resource]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown resource %q", resource)
+	}
+	return b, nil
+}
+
+func (s *Server) GetStatus(_ context.Context, req *adminv1.GetStatusRequest) (*adminv1.GetStatusResponse, error) {
+	b, err := s.backend(req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+
+	st := b.Status()
+	resp := &adminv1.ResourceStatus{
+		Name:             st.Name,
+		RegistrationMode: st.RegistrationMode,
+		Present:          st.Present,
+		Major:            st.Major,
+		Minor:            st.Minor,
+		Devices:          make([]*adminv1.DeviceStatus, 0, len(st.Devices)),
+	}
+	for _, dev := range st.Devices {
+		ds := &adminv1.DeviceStatus{
+			Id:      dev.ID,
+			Health:  dev.Health,
+			Drained: dev.Drained,
+		}
+		if dev.LastAllocated != nil {
+			ds.LastAllocated = timestamppb.New(*dev.LastAllocated)
+		}
+		resp.Devices = append(resp.Devices, ds)
+	}
+	return &adminv1.GetStatusResponse{Status: resp}, nil
+}
+
+func (s *Server) Drain(_ context.Context, req *adminv1.DrainRequest) (*adminv1.DrainResponse, error) {
+	b, err := s.backend(req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Info("Draining devices", "resource", b.Name(), "devices", req.GetDeviceIds())
+	b.SetDrained(true, req.GetDeviceIds()...)
+	return &adminv1.DrainResponse{}, nil
+}
+
+func (s *Server) Undrain(_ context.Context, req *adminv1.UndrainRequest) (*adminv1.UndrainResponse, error) {
+	b, err := s.backend(req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Info("Undraining devices", "resource", b.Name(), "devices", req.GetDeviceIds())
+	b.SetDrained(false, req.GetDeviceIds()...)
+	return &adminv1.UndrainResponse{}, nil
+}
+
+func (s *Server) Rediscover(_ context.Context, req *adminv1.RediscoverRequest) (*adminv1.RediscoverResponse, error) {
+	b, err := s.backend(req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Info("Rediscovering devices", "resource", b.Name())
+	b.Rediscover()
+	return &adminv1.RediscoverResponse{}, nil
+}
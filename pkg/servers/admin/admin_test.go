@@ -0,0 +1,228 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	adminv1 "github.com/anza-labs/tun-manager/api/admin/v1"
+	"github.com/anza-labs/tun-manager/pkg/servers/tundeviceplugin"
+)
+
+type fakeBackend struct {
+	name        string
+	drained     map[string]bool
+	rediscovers int
+	allocated   time.Time
+}
+
+func newFakeBackend(name string) *fakeBackend {
+	return &fakeBackend{
+		name:      name,
+		drained:   map[string]bool{},
+		allocated: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func (b *fakeBackend) Name() string { return b.name }
+
+func (b *fakeBackend) Status() tundeviceplugin.Status {
+	return tundeviceplugin.Status{
+		Name:    b.name,
+		Present: true,
+		Major:   10,
+		Minor:   200,
+		Devices: []tundeviceplugin.DeviceStatus{
+			{ID: "tun-0", Health: "Healthy", Drained: b.drained["tun-0"], LastAllocated: &b.allocated},
+			{ID: "tun-1", Health: "Healthy", Drained: b.drained["tun-1"]},
+		},
+	}
+}
+
+func (b *fakeBackend) SetDrained(drained bool, ids ...string) {
+	if len(ids) == 0 {
+		ids = []string{"tun-0", "tun-1"}
+	}
+	for _, id := range ids {
+		b.drained[id] = drained
+	}
+}
+
+func (b *fakeBackend) Rediscover() { b.rediscovers++ }
+
+func newClient(t *testing.T, backends ...Backend) adminv1.AdminClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	Register(srv, New(nil, backends...))
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return adminv1.NewAdminClient(conn)
+}
+
+func TestGetStatus(t *testing.T) {
+	client := newClient(t, newFakeBackend("anza-labs.dev/tun"))
+
+	resp, err := client.GetStatus(t.Context(), &adminv1.GetStatusRequest{Resource: "anza-labs.dev/tun"})
+	if err != nil {
+		t.Fatalf("GetStatus() failed: %v", err)
+	}
+
+	st := resp.GetStatus()
+	if st.GetName() != "anza-labs.dev/tun" || !st.GetPresent() || st.GetMajor() != 10 || st.GetMinor() != 200 {
+		t.Errorf("got status %v", st)
+	}
+	if len(st.GetDevices()) != 2 {
+		t.Fatalf("got %d devices, want 2", len(st.GetDevices()))
+	}
+	if got := st.GetDevices()[0].GetLastAllocated().AsTime(); !got.Equal(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("got last allocation %s", got)
+	}
+	if st.GetDevices()[1].GetLastAllocated() != nil {
+		t.Error("got a last allocation for a device never allocated")
+	}
+}
+
+func TestDrainUndrain(t *testing.T) {
+	tun, tap := newFakeBackend("anza-labs.dev/tun"), newFakeBackend("anza-labs.dev/tap")
+	client := newClient(t, tun, tap)
+
+	_, err := client.Drain(t.Context(), &adminv1.DrainRequest{Resource: "anza-labs.dev/tap", DeviceIds: []string{"tun-1"}})
+	if err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+	if !tap.drained["tun-1"] || tap.drained["tun-0"] {
+		t.Errorf("got drained %v, want tun-1 only", tap.drained)
+	}
+	if len(tun.drained) != 0 {
+		t.Errorf("draining another resource drained %v", tun.drained)
+	}
+
+	if _, err := client.Drain(t.Context(), &adminv1.DrainRequest{Resource: "anza-labs.dev/tun"}); err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+	if !tun.drained["tun-0"] || !tun.drained["tun-1"] {
+		t.Errorf("got drained %v, want every device", tun.drained)
+	}
+
+	if _, err := client.Undrain(t.Context(), &adminv1.UndrainRequest{Resource: "anza-labs.dev/tun"}); err != nil {
+		t.Fatalf("Undrain() failed: %v", err)
+	}
+	if tun.drained["tun-0"] || tun.drained["tun-1"] {
+		t.Errorf("got drained %v, want none", tun.drained)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		ids         []string
+		cancel      bool
+		want        codes.Code
+		wantDrained []string
+	}{
+		{name: "one device", ids: []string{"tun-1"}, want: codes.OK, wantDrained: []string{"tun-1"}},
+		{name: "every device", want: codes.OK, wantDrained: []string{"tun-0", "tun-1"}},
+		{name: "cancelled", ids: []string{"tun-1"}, cancel: true, want: codes.Canceled},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tun := newFakeBackend("anza-labs.dev/tun")
+			client := newClient(t, tun)
+
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			if tc.cancel {
+				cancel()
+			}
+
+			_, err := client.Drain(ctx, &adminv1.DrainRequest{Resource: "anza-labs.dev/tun", DeviceIds: tc.ids})
+			if got := status.Code(err); got != tc.want {
+				t.Fatalf("Drain() = %v, want %s", err, tc.want)
+			}
+
+			var drained []string
+			for id, ok := range tun.drained {
+				if ok {
+					drained = append(drained, id)
+				}
+			}
+			slices.Sort(drained)
+			if !slices.Equal(drained, tc.wantDrained) {
+				t.Errorf("got drained %v, want %v", drained, tc.wantDrained)
+			}
+		})
+	}
+}
+
+func TestRediscover(t *testing.T) {
+	tun := newFakeBackend("anza-labs.dev/tun")
+	client := newClient(t, tun)
+
+	if _, err := client.Rediscover(t.Context(), &adminv1.RediscoverRequest{Resource: "anza-labs.dev/tun"}); err != nil {
+		t.Fatalf("Rediscover() failed: %v", err)
+	}
+	if tun.rediscovers != 1 {
+		t.Errorf("got %d rediscoveries, want 1", tun.rediscovers)
+	}
+}
+
+func TestUnknownResource(t *testing.T) {
+	client := newClient(t, newFakeBackend("anza-labs.dev/tun"))
+
+	for _, tc := range []struct {
+		resource string
+		want     codes.Code
+	}{
+		{resource: "", want: codes.InvalidArgument},
+		{resource: "anza-labs.dev/tap", want: codes.NotFound},
+	} {
+		calls := []error{}
+		_, err := client.GetStatus(t.Context(), &adminv1.GetStatusRequest{Resource: tc.resource})
+		calls = append(calls, err)
+		_, err = client.Drain(t.Context(), &adminv1.DrainRequest{Resource: tc.resource})
+		calls = append(calls, err)
+		_, err = client.Undrain(t.Context(), &adminv1.UndrainRequest{Resource: tc.resource})
+		calls = append(calls, err)
+		_, err = client.Rediscover(t.Context(), &adminv1.RediscoverRequest{Resource: tc.resource})
+		calls = append(calls, err)
+
+		if i := slices.IndexFunc(calls, func(err error) bool { return status.Code(err) != tc.want }); i >= 0 {
+			t.Errorf("resource %q: call %d returned %v, want %s", tc.resource, i, calls[i], tc.want)
+		}
+	}
+}
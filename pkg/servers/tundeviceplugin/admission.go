@@ -0,0 +1,65 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"context"
+	"regexp"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AdmissionMetadataKey is the gRPC metadata key carrying the container name
+// matched by the AdmissionPolicy.
+const AdmissionMetadataKey = "container-name"
+
+// AdmissionPolicy is a best-effort guard restricting which containers may be
+// allocated a device. It is NOT a security boundary: the kubelet does not send
+// container identity in Allocate requests, so the policy only applies when the
+// AdmissionMetadataKey is injected into the request metadata (e.g. by a proxy).
+// Requests without that metadata are admitted.
+type AdmissionPolicy struct {
+	Allow *regexp.Regexp
+	Deny  *regexp.Regexp
+}
+
+// admit returns the name of the rejected container along with the error.
+func (p *AdmissionPolicy) admit(ctx context.Context) (string, error) {
+	if p == nil || (p.Allow == nil && p.Deny == nil) {
+		return "", nil
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	names := md.Get(AdmissionMetadataKey)
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	for _, name := range names {
+		if p.Deny != nil && p.Deny.MatchString(name) {
+			return name, status.Error(codes.PermissionDenied, "container denied by admission policy")
+		}
+		if p.Allow != nil && !p.Allow.MatchString(name) {
+			return name, status.Error(codes.PermissionDenied, "container not allowed by admission policy")
+		}
+	}
+
+	return "", nil
+}
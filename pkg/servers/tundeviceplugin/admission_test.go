@@ -0,0 +1,73 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"regexp"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestAllocateAdmission(t *testing.T) {
+	policy := &AdmissionPolicy{
+		Allow: regexp.MustCompile(`^vpn-`),
+		Deny:  regexp.MustCompile(`-debug$`),
+	}
+
+	for _, tc := range []struct {
+		name      string
+		container []string
+		want      codes.Code
+	}{
+		{name: "allowed", container: []string{"vpn-client"}, want: codes.OK},
+		{name: "not allowed", container: []string{"sidecar"}, want: codes.PermissionDenied},
+		{name: "denied", container: []string{"vpn-debug"}, want: codes.PermissionDenied},
+		{name: "one of several denied", container: []string{"vpn-client", "vpn-debug"}, want: codes.PermissionDenied},
+		{name: "no metadata", want: codes.OK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, 2, WithAdmissionPolicy(policy))
+
+			ctx := t.Context()
+			if tc.container != nil {
+				md := metadata.MD{}
+				md.Append(AdmissionMetadataKey, tc.container...)
+				ctx = metadata.NewIncomingContext(ctx, md)
+			}
+
+			_, err := s.Allocate(ctx, &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun0"}}},
+			})
+			if got := status.Code(err); got != tc.want {
+				t.Errorf("Allocate() = %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestAdmissionPolicyOutgoingMetadata(t *testing.T) {
+	policy := &AdmissionPolicy{Deny: regexp.MustCompile(`.*`)}
+
+	// Only the metadata received from the client is matched.
+	ctx := metadata.AppendToOutgoingContext(t.Context(), AdmissionMetadataKey, "vpn-client")
+	if _, err := policy.admit(ctx); err != nil {
+		t.Errorf("admit() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// AllocationStrategy selects the preferred devices returned by GetPreferredAllocation.
+type AllocationStrategy string
+
+const (
+	// AllocationStrategyNone disables preferred allocation.
+	AllocationStrategyNone AllocationStrategy = ""
+	// AllocationStrategyPacked prefers the lowest-numbered free devices.
+	AllocationStrategyPacked AllocationStrategy = "packed"
+	// AllocationStrategySpread prefers devices evenly distributed over the free ones.
+	AllocationStrategySpread AllocationStrategy = "spread"
+)
+
+func ParseAllocationStrategy(strategy string) (AllocationStrategy, error) {
+	switch st := AllocationStrategy(strategy); st {
+	case AllocationStrategyNone, AllocationStrategyPacked, AllocationStrategySpread:
+		return st, nil
+	default:
+		return "", fmt.Errorf("unknown allocation strategy %q", strategy)
+	}
+}
+
+// preferred returns size device IDs from available, always including mustInclude.
+func (st AllocationStrategy) preferred(available, mustInclude []string, size int) []string {
+	chosen := make([]string, 0, size)
+	included := map[string]struct{}{}
+	for _, id := range mustInclude {
+		if len(chosen) == size {
+			break
+		}
+		if _, ok := included[id]; ok {
+			continue
+		}
+		included[id] = struct{}{}
+		chosen = append(chosen, id)
+	}
+
+	free := make([]string, 0, len(available))
+	for _, id := range available {
+		if _, ok := included[id]; !ok {
+			free = append(free, id)
+		}
+	}
+	slices.SortFunc(free, compareDeviceIDs)
+
+	remaining := min(size-len(chosen), len(free))
+	if remaining <= 0 {
+		return chosen
+	}
+
+	switch st {
+	case AllocationStrategySpread:
+		for i := range remaining {
+			chosen = append(chosen, free[i*len(free)/remaining])
+		}
+	default:
+		chosen = append(chosen, free[:remaining]...)
+	}
+
+	return chosen
+}
+
+// compareDeviceIDs orders device IDs by their numeric suffix, then lexically.
+func compareDeviceIDs(a, b string) int {
+	ai, aok := deviceIndex(a)
+	bi, bok := deviceIndex(b)
+	if aok && bok && ai != bi {
+		return ai - bi
+	}
+	return strings.Compare(a, b)
+}
+
+func deviceIndex(id string) (int, bool) {
+	i := len(id)
+	for i > 0 && id[i-1] >= '0' && id[i-1] <= '9' {
+		i--
+	}
+	n, err := strconv.Atoi(id[i:])
+	return n, err == nil
+}
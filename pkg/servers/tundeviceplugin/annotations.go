@@ -0,0 +1,70 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+)
+
+// deviceIDsAnnotation is appended to the plugin namespace and the resource.
+const deviceIDsAnnotation = "device-ids"
+
+// ParseAnnotations parses a comma separated list of key=value annotations.
+func ParseAnnotations(value string) (map[string]string, error) {
+	annotations := map[string]string{}
+	if value == "" {
+		return annotations, nil
+	}
+
+	for _, field := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid annotation %q, expected key=value", field)
+		}
+		annotations[key] = val
+	}
+	return annotations, nil
+}
+
+// WithAllocationAnnotations adds the given annotations to every allocation,
+// along with <namespace>/<resource>-device-ids listing the allocated devices,
+// so a CNI plugin or a sidecar can find them in the container runtime. A nil
+// map disables the annotations.
+func WithAllocationAnnotations(annotations map[string]string) Option {
+	return func(s *Server) {
+		s.annotations = annotations
+	}
+}
+
+// allocationAnnotations returns the annotations of an allocation of ids.
+func (s *Server) allocationAnnotations(ids []string) map[string]string {
+	if s.annotations == nil && s.cgroupDeviceRule == "" {
+		return nil
+	}
+
+	annotations := maps.Clone(s.annotations)
+	if annotations == nil {
+		annotations = map[string]string{}
+	} else {
+		annotations[path.Join(s.namespace, s.resource+"-"+deviceIDsAnnotation)] = strings.Join(ids, ",")
+	}
+	if s.cgroupDeviceRule != "" {
+		annotations[path.Join(s.namespace, cgroupRuleAnnotation)] = s.cgroupDeviceRule
+	}
+	return annotations
+}
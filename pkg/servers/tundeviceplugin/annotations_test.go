@@ -0,0 +1,91 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"maps"
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: "vpn.example.com/sidecar=wireguard", want: map[string]string{"vpn.example.com/sidecar": "wireguard"}},
+		{value: "a=1, b=", want: map[string]string{"a": "1", "b": ""}},
+		{value: "a", wantErr: true},
+		{value: "=1", wantErr: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := ParseAnnotations(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseAnnotations(%q) = %v, want error %t", tc.value, err, tc.wantErr)
+			}
+			if !tc.wantErr && !maps.Equal(got, tc.want) {
+				t.Errorf("got annotations %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAllocateAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		want        []map[string]string
+	}{
+		{name: "disabled", want: []map[string]string{nil, nil}},
+		{
+			name:        "static and device IDs",
+			annotations: map[string]string{"vpn.example.com/sidecar": "wireguard"},
+			want: []map[string]string{
+				{"vpn.example.com/sidecar": "wireguard", "anza-labs.dev/tun-device-ids": "tun0,tun1"},
+				{"vpn.example.com/sidecar": "wireguard", "anza-labs.dev/tun-device-ids": "tun2"},
+			},
+		},
+		{
+			name:        "device IDs only",
+			annotations: map[string]string{},
+			want: []map[string]string{
+				{"anza-labs.dev/tun-device-ids": "tun0,tun1"},
+				{"anza-labs.dev/tun-device-ids": "tun2"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, 4, WithAllocationAnnotations(tc.annotations))
+
+			resp, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{
+					{DevicesIDs: []string{"tun0", "tun1"}},
+					{DevicesIDs: []string{"tun2"}},
+				},
+			})
+			if err != nil {
+				t.Fatalf("Allocate() failed: %v", err)
+			}
+			for i, cresp := range resp.GetContainerResponses() {
+				if got := cresp.GetAnnotations(); !maps.Equal(got, tc.want[i]) {
+					t.Errorf("container %d: got annotations %v, want %v", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
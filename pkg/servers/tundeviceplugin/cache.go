@@ -0,0 +1,93 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// allocationCache is a bounded FIFO cache of allocation responses keyed by
+// the sorted requested device IDs. A nil cache is valid and never hits.
+type allocationCache struct {
+	mu      sync.Mutex
+	size    int
+	order   []string
+	entries map[string]*v1beta1.ContainerAllocateResponse
+}
+
+func newAllocationCache(size int) *allocationCache {
+	if size <= 0 {
+		return nil
+	}
+	return &allocationCache{
+		size:    size,
+		entries: map[string]*v1beta1.ContainerAllocateResponse{},
+	}
+}
+
+func allocationKey(ids []string) string {
+	sorted := slices.Clone(ids)
+	slices.Sort(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func (c *allocationCache) get(key string) (*v1beta1.ContainerAllocateResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp, ok := c.entries[key]
+	return resp, ok
+}
+
+func (c *allocationCache) put(key string, resp *v1beta1.ContainerAllocateResponse) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		c.entries[key] = resp
+		return
+	}
+
+	if len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.order = append(c.order, key)
+	c.entries[key] = resp
+}
+
+func (c *allocationCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order = nil
+	c.entries = map[string]*v1beta1.ContainerAllocateResponse{}
+}
@@ -0,0 +1,74 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// allocateOne allocates ids to a single container and returns its response.
+func allocateOne(t *testing.T, s *Server, ids ...string) *v1beta1.ContainerAllocateResponse {
+	t.Helper()
+
+	resp, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: ids}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate(%v) failed: %v", ids, err)
+	}
+	return resp.GetContainerResponses()[0]
+}
+
+func TestAllocationCache(t *testing.T) {
+	s := newTestServer(t, 4, WithAllocationCache(2))
+
+	first := allocateOne(t, s, "tun0", "tun1")
+	if hit := allocateOne(t, s, "tun1", "tun0"); hit != first {
+		t.Error("the same devices in another order missed the cache")
+	}
+	if other := allocateOne(t, s, "tun2"); other == first {
+		t.Error("other devices hit the cache")
+	}
+
+	// A reload changes the advertised devices and drops every response.
+	s.Reload(4)
+	if got := allocateOne(t, s, "tun0", "tun1"); got == first {
+		t.Error("the cache was not invalidated on Reload")
+	}
+}
+
+func TestAllocationCacheEviction(t *testing.T) {
+	c := newAllocationCache(2)
+	for _, key := range []string{"tun0", "tun1", "tun2"} {
+		c.put(key, &v1beta1.ContainerAllocateResponse{})
+	}
+
+	// The oldest entry is evicted first.
+	for key, want := range map[string]bool{"tun0": false, "tun1": true, "tun2": true} {
+		if _, ok := c.get(key); ok != want {
+			t.Errorf("get(%s) = %t, want %t", key, ok, want)
+		}
+	}
+}
+
+func TestAllocationCacheDisabled(t *testing.T) {
+	s := newTestServer(t, 2)
+
+	if first := allocateOne(t, s, "tun0"); allocateOne(t, s, "tun0") == first {
+		t.Error("got a cached response with the cache disabled")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	cdiVersion = "0.6.0"
+
+	// DefaultCDISpecPath is where the CDI spec is written when CDI is enabled.
+	DefaultCDISpecPath = "/etc/cdi/anza-tun.json"
+)
+
+type cdiSpec struct {
+	Version string      `json:"cdiVersion"`
+	Kind    string      `json:"kind"`
+	Devices []cdiDevice `json:"devices"`
+}
+
+type cdiDevice struct {
+	Name           string            `json:"name"`
+	ContainerEdits cdiContainerEdits `json:"containerEdits"`
+}
+
+type cdiContainerEdits struct {
+	DeviceNodes []cdiDeviceNode `json:"deviceNodes"`
+}
+
+type cdiDeviceNode struct {
+	Path        string `json:"path"`
+	HostPath    string `json:"hostPath,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// cdiSpecLocked builds the CDI spec for the advertised devices. It must be
+// called with s.mu held.
+func (s *Server) cdiSpecLocked() cdiSpec {
+	spec := cdiSpec{
+		Version: cdiVersion,
+		Kind:    s.Name(),
+		Devices: make([]cdiDevice, 0, len(s.devs)),
+	}
+	for _, dev := range s.devs {
+		spec.Devices = append(spec.Devices, cdiDevice{
+			Name: dev.ID,
+			ContainerEdits: cdiContainerEdits{
+				DeviceNodes: []cdiDeviceNode{{
+					Path:        s.containerPath,
+					HostPath:    s.hostPath,
+					Permissions: string(s.permissions),
+				}},
+			},
+		})
+	}
+	return spec
+}
+
+// writeCDISpecLocked writes the CDI spec, if enabled. It must be called with s.mu held.
+func (s *Server) writeCDISpecLocked() {
+	if s.cdiSpecPath == "" {
+		return
+	}
+
+	if err := writeCDISpec(s.cdiSpecPath, s.cdiSpecLocked()); err != nil {
+		s.log.Error("Failed to write CDI spec", "path", s.cdiSpecPath, "error", err)
+		return
+	}
+	s.log.Debug("Wrote CDI spec", "path", s.cdiSpecPath)
+}
+
+func writeCDISpec(path string, spec cdiSpec) error {
+	content, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal CDI spec: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create CDI spec directory: %w", err)
+	}
+
+	// Write to a temporary file first, so runtimes never read a partial spec.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write CDI spec: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Server) cdiDevices(ids []string) []*v1beta1.CDIDevice {
+	if s.cdiSpecPath == "" {
+		return nil
+	}
+
+	devices := make([]*v1beta1.CDIDevice, 0, len(ids))
+	for _, id := range ids {
+		devices = append(devices, &v1beta1.CDIDevice{Name: s.Name() + "=" + id})
+	}
+	return devices
+}
@@ -0,0 +1,99 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// readCDISpec decodes the spec at path into plain values, independently of
+// the types used to write it.
+func readCDISpec(t *testing.T, path string) map[string]any {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the CDI spec: %v", err)
+	}
+	spec := map[string]any{}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		t.Fatalf("failed to decode the CDI spec: %v", err)
+	}
+	return spec
+}
+
+// cdiDeviceNames returns the names of the devices of a decoded spec.
+func cdiDeviceNames(t *testing.T, spec map[string]any) []string {
+	t.Helper()
+
+	devices, ok := spec["devices"].([]any)
+	if !ok {
+		t.Fatalf("got devices %v, want a list", spec["devices"])
+	}
+	names := make([]string, 0, len(devices))
+	for _, dev := range devices {
+		names = append(names, dev.(map[string]any)["name"].(string))
+	}
+	return names
+}
+
+// specDeviceNode returns the only device node of the i-th device of a decoded spec.
+func specDeviceNode(t *testing.T, spec map[string]any, i int) map[string]any {
+	t.Helper()
+
+	dev := spec["devices"].([]any)[i].(map[string]any)
+	nodes := dev["containerEdits"].(map[string]any)["deviceNodes"].([]any)
+	if len(nodes) != 1 {
+		t.Fatalf("got %d device nodes, want 1", len(nodes))
+	}
+	return nodes[0].(map[string]any)
+}
+
+func TestCDISpec(t *testing.T) {
+	specPath := filepath.Join(t.TempDir(), "cdi", "anza-tun.json")
+	s := newTestServer(t, 2, WithCDI(specPath))
+
+	spec := readCDISpec(t, specPath)
+	if spec["cdiVersion"] != cdiVersion || spec["kind"] != "anza-labs.dev/tun" {
+		t.Errorf("got version %v and kind %v, want %s and anza-labs.dev/tun", spec["cdiVersion"], spec["kind"], cdiVersion)
+	}
+	if got := cdiDeviceNames(t, spec); !slices.Equal(got, []string{"tun0", "tun1"}) {
+		t.Errorf("got devices %v, want tun0 and tun1", got)
+	}
+
+	node := specDeviceNode(t, spec, 0)
+	if node["path"] != DefaultDevicePath || node["hostPath"] != s.hostPath || node["permissions"] != "rw" {
+		t.Errorf("got device node %v", node)
+	}
+
+	// The spec follows the advertised devices.
+	s.Reload(3)
+	if got := cdiDeviceNames(t, readCDISpec(t, specPath)); !slices.Equal(got, []string{"tun0", "tun1", "tun2"}) {
+		t.Errorf("got devices %v after the reload, want tun0 to tun2", got)
+	}
+	if _, err := os.Stat(specPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary spec was left behind: %v", err)
+	}
+
+	// Allocations reference the devices by their fully qualified CDI name.
+	cdiDevices := allocateOne(t, s, "tun1").GetCDIDevices()
+	if len(cdiDevices) != 1 || cdiDevices[0].GetName() != "anza-labs.dev/tun=tun1" {
+		t.Errorf("got CDI devices %v, want anza-labs.dev/tun=tun1", cdiDevices)
+	}
+}
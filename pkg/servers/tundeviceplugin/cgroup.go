@@ -0,0 +1,90 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cgroup v2 device access hints.
+//
+// On cgroup v2 the device controller is an eBPF program attached by the
+// runtime, instead of the devices.allow file of cgroup v1. When enabled, the
+// plugin annotates allocations with the device rule for the tun device, in the
+// "c MAJOR:MINOR PERMS" format, for runtimes that consume it:
+//
+//	runtime              | DeviceSpec | cgroup v2 hint annotation
+//	---------------------+------------+--------------------------
+//	containerd (runc)    | yes        | ignored
+//	containerd (crun)    | yes        | ignored
+//	CRI-O                | yes        | ignored
+//	custom/OCI hooks     | yes        | consumed if implemented
+//
+// The standard DeviceSpec is always returned, so the hint is purely additive.
+
+const (
+	// DefaultCgroupRoot is the cgroup mount point used unless set with WithCgroupRoot.
+	DefaultCgroupRoot = "/sys/fs/cgroup"
+
+	// cgroupRuleAnnotation is appended to the plugin namespace.
+	cgroupRuleAnnotation = "cgroup-device-rule"
+)
+
+// WithCgroupRoot sets the cgroup mount point inspected to detect cgroup v2,
+// e.g. when the host cgroup filesystem is mounted elsewhere.
+func WithCgroupRoot(root string) Option {
+	return func(s *Server) {
+		s.cgroupRoot = root
+	}
+}
+
+// cgroupV2 reports whether root is a cgroup v2 (unified) hierarchy.
+func cgroupV2(root string) bool {
+	_, err := os.Stat(filepath.Join(root, "cgroup.controllers"))
+	return err == nil
+}
+
+// deviceNumbers returns the major and minor numbers of the device node at path.
+func deviceNumbers(path string) (uint32, uint32, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return 0, 0, fmt.Errorf("%s is not a character device", path)
+	}
+	return unix.Major(st.Rdev), unix.Minor(st.Rdev), nil
+}
+
+// cgroupRule returns the cgroup v2 device rule for the tun device, or an empty
+// string when the node does not use cgroup v2.
+func (s *Server) cgroupRule() string {
+	if !cgroupV2(s.cgroupRoot) {
+		s.log.Debug("Not a cgroup v2 node, skipping device rule hints")
+		return ""
+	}
+
+	major, minor, err := deviceNumbers(s.hostPath)
+	if err != nil {
+		s.log.Warn("Unable to read device numbers, skipping device rule hints", "error", err)
+		return ""
+	}
+
+	return fmt.Sprintf("c %d:%d %s", major, minor, s.permissions)
+}
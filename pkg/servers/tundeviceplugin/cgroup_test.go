@@ -0,0 +1,79 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// fakeCgroupRoot returns a cgroup mount point, of the unified hierarchy when v2 is set.
+func fakeCgroupRoot(t *testing.T, v2 bool) string {
+	t.Helper()
+
+	root := t.TempDir()
+	if v2 {
+		if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte("cpu memory\n"), 0o600); err != nil {
+			t.Fatalf("failed to create cgroup.controllers: %v", err)
+		}
+	}
+	return root
+}
+
+func TestCgroupHints(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		v2       bool
+		hostPath string
+		want     string
+	}{
+		// /dev/null stands in for the tun device, it is the 1:3 character device.
+		{name: "cgroup v2", enabled: true, v2: true, hostPath: "/dev/null", want: "c 1:3 rw"},
+		{name: "cgroup v1", enabled: true, hostPath: "/dev/null"},
+		{name: "disabled", v2: true, hostPath: "/dev/null"},
+		{name: "not a device", enabled: true, v2: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := []Option{
+				WithCgroupHints(tc.enabled),
+				WithCgroupRoot(fakeCgroupRoot(t, tc.v2)),
+			}
+			if tc.hostPath != "" {
+				opts = append(opts, WithDevicePaths(tc.hostPath, DefaultDevicePath))
+			}
+			s := newTestServer(t, 1, opts...)
+
+			resp, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun0"}}},
+			})
+			if err != nil {
+				t.Fatalf("Allocate() failed: %v", err)
+			}
+			cresp := resp.GetContainerResponses()[0]
+
+			if got := cresp.GetAnnotations()["anza-labs.dev/"+cgroupRuleAnnotation]; got != tc.want {
+				t.Errorf("got cgroup rule %q, want %q", got, tc.want)
+			}
+			// The standard device spec is always returned.
+			if len(cresp.GetDevices()) != 1 || cresp.GetDevices()[0].GetContainerPath() != DefaultDevicePath {
+				t.Errorf("got devices %v, want %s", cresp.GetDevices(), DefaultDevicePath)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DeviceIDFormatUUID advertises devices with random UUIDs. Unlike the
+// template formats, those do not survive a restart of the plugin.
+const DeviceIDFormatUUID = "uuid"
+
+// deviceIDRegexp matches IDs that are valid as CDI device names as well.
+var deviceIDRegexp = regexp.MustCompile(`^[A-Za-z0-9][-A-Za-z0-9_.:]*$`)
+
+// ValidateDeviceIDFormat checks that format is DeviceIDFormatUUID or a
+// template with a single integer verb, e.g. "tun-%04d", producing distinct
+// and valid device IDs. An empty format uses the resource name followed by
+// the device index.
+func ValidateDeviceIDFormat(format string) error {
+	if format == "" || format == DeviceIDFormatUUID {
+		return nil
+	}
+
+	first, second := fmt.Sprintf(format, 0), fmt.Sprintf(format, 1)
+	if strings.Contains(first, "%!") || first == second {
+		return fmt.Errorf("invalid device ID format %q: must contain a single integer verb", format)
+	}
+	if !deviceIDRegexp.MatchString(first) {
+		return fmt.Errorf("invalid device ID format %q: produces invalid ID %q", format, first)
+	}
+	return nil
+}
+
+// WithDeviceIDFormat sets the format of the advertised device IDs, see
+// ValidateDeviceIDFormat.
+func WithDeviceIDFormat(format string) Option {
+	return func(s *Server) {
+		s.idFormat = format
+	}
+}
+
+// deviceID returns the ID of the device at index i. UUIDs are generated once
+// and kept for the lifetime of the server.
+func (s *Server) deviceID(i uint) string {
+	switch s.idFormat {
+	case "":
+		return fmt.Sprintf("%s%d", s.resource, i)
+	case DeviceIDFormatUUID:
+	default:
+		return fmt.Sprintf(s.idFormat, i)
+	}
+
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	for uint(len(s.uuids)) <= i {
+		s.uuids = append(s.uuids, newUUID())
+	}
+	return s.uuids[i]
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:]) // never returns an error
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
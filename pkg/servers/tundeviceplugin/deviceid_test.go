@@ -0,0 +1,98 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// deviceIDs returns the IDs of the devices advertised by s.
+func deviceIDs(s *Server) []string {
+	var ids []string
+	for _, dev := range s.Status().Devices {
+		ids = append(ids, dev.ID)
+	}
+	return ids
+}
+
+func TestDeviceIDFormatPadded(t *testing.T) {
+	s := newTestServer(t, 3, WithDeviceIDFormat("tun-%04d"))
+
+	want := []string{"tun-0000", "tun-0001", "tun-0002"}
+	if got := deviceIDs(s); !slices.Equal(got, want) {
+		t.Fatalf("got device IDs %v, want %v", got, want)
+	}
+
+	// A restarted plugin advertises the same IDs.
+	if got := deviceIDs(newTestServer(t, 3, WithDeviceIDFormat("tun-%04d"))); !slices.Equal(got, want) {
+		t.Errorf("got device IDs %v after a restart, want %v", got, want)
+	}
+
+	resp, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun-0001"}}},
+	})
+	if err != nil || len(resp.GetContainerResponses()) != 1 {
+		t.Errorf("Allocate(tun-0001) = %v, %v, want one container response", resp, err)
+	}
+}
+
+func TestDeviceIDFormatUUID(t *testing.T) {
+	s := newTestServer(t, 3, WithDeviceIDFormat(DeviceIDFormatUUID))
+
+	ids := deviceIDs(s)
+	for _, id := range ids {
+		if !uuidRegexp.MatchString(id) {
+			t.Errorf("got device ID %q, want a version 4 UUID", id)
+		}
+	}
+	if len(slices.Compact(slices.Sorted(slices.Values(ids)))) != len(ids) {
+		t.Errorf("got duplicate device IDs %v", ids)
+	}
+
+	// Existing devices keep their IDs when more are advertised.
+	s.Reload(4)
+	if got := deviceIDs(s); !slices.Equal(got[:3], ids) {
+		t.Errorf("got device IDs %v after the reload, want %v kept", got, ids)
+	}
+}
+
+func TestValidateDeviceIDFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		valid  bool
+	}{
+		{format: "", valid: true},
+		{format: DeviceIDFormatUUID, valid: true},
+		{format: "tun-%04d", valid: true},
+		{format: "tun%d", valid: true},
+		{format: "tun", valid: false},
+		{format: "tun-%s", valid: false},
+		{format: "tun-%d-%d", valid: false},
+		{format: "tun %d", valid: false},
+		{format: "-tun%d", valid: false},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			if err := ValidateDeviceIDFormat(tc.format); tc.valid != (err == nil) {
+				t.Errorf("ValidateDeviceIDFormat(%q) = %v, want valid %t", tc.format, err, tc.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+)
+
+// The conventional numbers of /dev/net/tun, assumed by many cgroup rules.
+const (
+	expectedMajor = 10
+	expectedMinor = 200
+)
+
+// WithStrictDeviceNumbers marks devices unhealthy when the device numbers
+// differ from the conventional 10:200, instead of only logging a warning.
+func WithStrictDeviceNumbers(strict bool) Option {
+	return func(s *Server) {
+		s.strictNumbers = strict
+	}
+}
+
+// readDeviceNumbers returns the major and minor of the device, or zeros when
+// they cannot be read.
+func (s *Server) readDeviceNumbers() (uint32, uint32) {
+	major, minor, err := deviceNumbers(s.hostPath)
+	if err != nil {
+		s.log.Debug("Unable to read device numbers", "error", err)
+		return 0, 0
+	}
+	return major, minor
+}
+
+// setDeviceNumbersLocked records the device numbers and reports whether the
+// health of the devices must be refreshed. It must be called with s.mu held.
+func (s *Server) setDeviceNumbersLocked(major, minor uint32) bool {
+	if major == s.major && minor == s.minor {
+		return false
+	}
+	s.major, s.minor = major, minor
+	metrics.DeviceMajor.WithLabelValues(s.Name()).Set(float64(major))
+	metrics.DeviceMinor.WithLabelValues(s.Name()).Set(float64(minor))
+
+	unexpected := major != 0 && (major != expectedMajor || minor != expectedMinor)
+	if unexpected {
+		s.log.Warn("Device has unexpected numbers",
+			"major", major,
+			"minor", minor,
+			"expectedMajor", expectedMajor,
+			"expectedMinor", expectedMinor,
+			"strict", s.strictNumbers,
+		)
+	}
+
+	bad := s.strictNumbers && unexpected
+	changed := bad != s.badNumbers
+	s.badNumbers = bad
+	return changed
+}
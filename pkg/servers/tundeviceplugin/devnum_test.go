@@ -0,0 +1,76 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestDeviceNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		strict     bool
+		wantHealth string
+	}{
+		{name: "lenient", wantHealth: v1beta1.Healthy},
+		{name: "strict", strict: true, wantHealth: v1beta1.Unhealthy},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			// /dev/null is a character device with the non-standard numbers 1:3.
+			s := newTestServer(t, 2,
+				WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+				WithDevicePaths("/dev/null", DefaultDevicePath),
+				WithStrictDeviceNumbers(tc.strict),
+			)
+
+			st := s.Status()
+			if st.Major != 1 || st.Minor != 3 {
+				t.Fatalf("got device numbers %d:%d, want 1:3", st.Major, st.Minor)
+			}
+			for _, dev := range st.Devices {
+				if dev.Health != tc.wantHealth {
+					t.Errorf("got device %s %s, want %s", dev.ID, dev.Health, tc.wantHealth)
+				}
+			}
+			if got := testutil.ToFloat64(metrics.DeviceMajor.WithLabelValues(s.Name())); got != 1 {
+				t.Errorf("got major metric %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(metrics.DeviceMinor.WithLabelValues(s.Name())); got != 3 {
+				t.Errorf("got minor metric %v, want 3", got)
+			}
+			if !strings.Contains(logs.String(), "Device has unexpected numbers") {
+				t.Error("the unexpected numbers were not logged")
+			}
+
+			// The conventional numbers restore the devices.
+			s.mu.Lock()
+			changed := s.setDeviceNumbersLocked(expectedMajor, expectedMinor)
+			s.mu.Unlock()
+			if changed != tc.strict {
+				t.Errorf("got health change %t for the conventional numbers, want %t", changed, tc.strict)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DiscoveryMode selects how device appearance and removal are detected.
+type DiscoveryMode string
+
+const (
+	// DiscoveryModePoll periodically stats the device path.
+	DiscoveryModePoll DiscoveryMode = "poll"
+	// DiscoveryModeWatch reacts to fsnotify events on the device directory,
+	// falling back to periodic polling as a safety net.
+	DiscoveryModeWatch DiscoveryMode = "watch"
+
+	debounceAttempts = 10
+)
+
+func ParseDiscoveryMode(mode string) (DiscoveryMode, error) {
+	switch m := DiscoveryMode(mode); m {
+	case DiscoveryModePoll, DiscoveryModeWatch:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown discovery mode %q", mode)
+	}
+}
+
+// discoverPaths returns the underlying device nodes found on the host.
+func (s *Server) discoverPaths() []string {
+	if _, err := os.Stat(s.hostPath); err != nil {
+		return nil
+	}
+	return []string{s.hostPath}
+}
+
+// stablePaths waits until the discovered paths stay unchanged for the debounce
+// window, so that capacity which immediately vanishes is not advertised. It
+// gives up after debounceAttempts windows and returns the latest result.
+func (s *Server) stablePaths() []string {
+	paths := s.discoverPaths()
+	if s.debounce <= 0 {
+		return paths
+	}
+
+	interval := max(s.debounce/10, 10*time.Millisecond)
+	deadline := time.Now().Add(debounceAttempts * s.debounce)
+	stableSince := time.Now()
+
+	for time.Now().Before(deadline) {
+		if time.Since(stableSince) >= s.debounce {
+			return paths
+		}
+
+		time.Sleep(interval)
+
+		current := s.discoverPaths()
+		if !slices.Equal(current, paths) {
+			s.log.Debug("Device flickered during startup, restarting debounce", "paths", current)
+			paths = current
+			stableSince = time.Now()
+		}
+	}
+
+	s.log.Warn("Device did not stabilize during startup", "debounce", s.debounce)
+	return paths
+}
+
+// Discover re-runs discovery until ctx is done, updating device health when
+// the device appears or disappears.
+func (s *Server) Discover(ctx context.Context, mode DiscoveryMode, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		watcher  *fsnotify.Watcher
+		watching bool
+		events   <-chan fsnotify.Event
+		errs     <-chan error
+
+		// settle fires once device events stopped for the debounce window.
+		settle  *time.Timer
+		settled <-chan time.Time
+	)
+	defer func() {
+		if settle != nil {
+			settle.Stop()
+		}
+	}()
+	if mode == DiscoveryModeWatch {
+		var err error
+		watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("failed to create device watcher: %w", err)
+		}
+		defer watcher.Close() //nolint:errcheck // best effort call
+
+		watching = s.watchDeviceDir(watcher)
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// The directory may only appear once the tun module is loaded.
+			if watcher != nil && !watching {
+				watching = s.watchDeviceDir(watcher)
+			}
+			s.Rediscover()
+		case ev := <-events:
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Remove) && !ev.Has(fsnotify.Rename) {
+				continue
+			}
+			switch filepath.Clean(ev.Name) {
+			case filepath.Dir(s.hostPath):
+				// The watch is dropped along with the directory.
+				watching = false
+			case s.hostPath:
+			default:
+				continue
+			}
+			s.log.Debug("Device event", "event", ev.Op.String())
+			if s.healthDebounce <= 0 {
+				s.Rediscover()
+				continue
+			}
+			if settle == nil {
+				settle = time.NewTimer(s.healthDebounce)
+				settled = settle.C
+			} else {
+				settle.Reset(s.healthDebounce)
+			}
+		case <-settled:
+			s.Rediscover()
+		case err := <-errs:
+			s.log.Error("Device watcher error", "error", err)
+		}
+	}
+}
+
+// WithHealthDebounce delays the propagation of device events until no event
+// was seen for the given window, so churn results in a single update.
+func WithHealthDebounce(window time.Duration) Option {
+	return func(s *Server) {
+		s.healthDebounce = window
+	}
+}
+
+// watchDeviceDir watches the parent of the device node, since the node itself
+// may not exist yet. It reports whether the watch was established.
+func (s *Server) watchDeviceDir(watcher *fsnotify.Watcher) bool {
+	dir := filepath.Dir(s.hostPath)
+	if err := watcher.Add(dir); err != nil {
+		s.log.Debug("Failed to watch device directory, polling until it appears", "dir", dir, "error", err)
+		return false
+	}
+	s.log.Debug("Watching device directory", "dir", dir)
+	return true
+}
+
+// Rediscover checks for the device and updates device health if it changed.
+func (s *Server) Rediscover() {
+	present := len(s.discoverPaths()) > 0
+	major, minor := s.readDeviceNumbers()
+
+	s.mu.Lock()
+	changed := present != s.present
+	if changed {
+		s.present = present
+		s.refreshHealth(reasonMissingDevice)
+	}
+	if s.setDeviceNumbersLocked(major, minor) {
+		changed = true
+		s.refreshHealth(reasonDeviceNumbers)
+	}
+	s.mu.Unlock()
+
+	if changed {
+		s.notify()
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// syncBuffer is a log sink safe for use by the discovery goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// startDiscover runs Discover until the test ends and waits for the device
+// directory to be watched.
+func startDiscover(t *testing.T, s *Server, logs *syncBuffer) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	// Polling never kicks in, only fs events drive the discovery.
+	go func() { done <- s.Discover(ctx, DiscoveryModeWatch, time.Hour) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Discover() = %v, want nil", err)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), "Watching device directory") {
+		if time.Now().After(deadline) {
+			t.Fatalf("the device directory is not watched: %s", logs.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// nextHealth waits for the next device list and returns the health of its
+// devices, which must all be the same.
+func nextHealth(t *testing.T, updates <-chan []*v1beta1.Device) string {
+	t.Helper()
+
+	select {
+	case devs := <-updates:
+		for _, dev := range devs[1:] {
+			if dev.Health != devs[0].Health {
+				t.Fatalf("got mixed device health %v", devs)
+			}
+		}
+		return devs[0].Health
+	case <-time.After(5 * time.Second):
+		t.Fatal("got no device update")
+		return ""
+	}
+}
+
+func TestDiscoverWatch(t *testing.T) {
+	var logs syncBuffer
+	handler := slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})
+	s := newTestServer(t, 2, WithLogger(slog.New(handler)))
+
+	updates, stop, err := s.watch()
+	if err != nil {
+		t.Fatalf("watch() failed: %v", err)
+	}
+	defer stop()
+	startDiscover(t, s, &logs)
+
+	if err := os.Remove(s.hostPath); err != nil {
+		t.Fatalf("failed to remove the device: %v", err)
+	}
+	if got := nextHealth(t, updates); got != v1beta1.Unhealthy {
+		t.Errorf("got %s devices after the removal, want %s", got, v1beta1.Unhealthy)
+	}
+
+	if err := os.WriteFile(s.hostPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to recreate the device: %v", err)
+	}
+	if got := nextHealth(t, updates); got != v1beta1.Healthy {
+		t.Errorf("got %s devices after the creation, want %s", got, v1beta1.Healthy)
+	}
+}
+
+func TestDiscoverWatchLateDirectory(t *testing.T) {
+	var logs syncBuffer
+	handler := slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})
+	dir := filepath.Join(t.TempDir(), "net")
+	hostPath := filepath.Join(dir, "tun")
+	s := newTestServer(t, 2, WithLogger(slog.New(handler)), WithDevicePaths(hostPath, DefaultDevicePath))
+
+	for _, dev := range s.Status().Devices {
+		if dev.Health != v1beta1.Unhealthy {
+			t.Fatalf("got device %s %s without the device node, want %s", dev.ID, dev.Health, v1beta1.Unhealthy)
+		}
+	}
+
+	updates, stop, err := s.watch()
+	if err != nil {
+		t.Fatalf("watch() failed: %v", err)
+	}
+	defer stop()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- s.Discover(ctx, DiscoveryModeWatch, 10*time.Millisecond) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The directory only appears with the tun module, the device follows.
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("failed to create the device dir: %v", err)
+	}
+	if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to create the device: %v", err)
+	}
+	if got := nextHealth(t, updates); got != v1beta1.Healthy {
+		t.Errorf("got %s devices once the device appeared, want %s", got, v1beta1.Healthy)
+	}
+	if !strings.Contains(logs.String(), "Watching device directory") {
+		t.Error("the late device directory is not watched")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("failed to remove the device dir: %v", err)
+	}
+	if got := nextHealth(t, updates); got != v1beta1.Unhealthy {
+		t.Errorf("got %s devices once the device disappeared, want %s", got, v1beta1.Unhealthy)
+	}
+}
+
+func TestDiscoveryDebounce(t *testing.T) {
+	const window = 200 * time.Millisecond
+
+	for _, tc := range []struct {
+		name        string
+		flicker     bool
+		wantElapsed time.Duration
+	}{
+		{name: "stable", wantElapsed: window},
+		// The device vanishes and comes back, restarting the window.
+		{name: "flicker", flicker: true, wantElapsed: window + window/2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs syncBuffer
+			handler := slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})
+			hostPath := filepath.Join(t.TempDir(), "tun")
+			if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+				t.Fatalf("failed to create the device: %v", err)
+			}
+
+			flickered := make(chan struct{})
+			go func() {
+				defer close(flickered)
+				if !tc.flicker {
+					return
+				}
+				time.Sleep(window / 2)
+				_ = os.Remove(hostPath)
+				time.Sleep(window / 4)
+				_ = os.WriteFile(hostPath, nil, 0o600)
+			}()
+
+			started := time.Now()
+			s := newTestServer(t, 2, WithLogger(slog.New(handler)),
+				WithDevicePaths(hostPath, DefaultDevicePath), WithDiscoveryDebounce(window))
+			elapsed := time.Since(started)
+			<-flickered
+
+			if elapsed < tc.wantElapsed {
+				t.Errorf("discovery took %s, want at least %s", elapsed, tc.wantElapsed)
+			}
+			for _, dev := range s.Status().Devices {
+				if dev.Health != v1beta1.Healthy {
+					t.Errorf("got device %s %s, want %s", dev.ID, dev.Health, v1beta1.Healthy)
+				}
+			}
+			if got := strings.Contains(logs.String(), "Device flickered during startup"); got != tc.flicker {
+				t.Errorf("got flicker logged %t, want %t", got, tc.flicker)
+			}
+		})
+	}
+}
+
+func TestHealthDebounce(t *testing.T) {
+	const window = 100 * time.Millisecond
+
+	var logs syncBuffer
+	handler := slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})
+	s := newTestServer(t, 2, WithLogger(slog.New(handler)), WithHealthDebounce(window))
+
+	updates, stop, err := s.watch()
+	if err != nil {
+		t.Fatalf("watch() failed: %v", err)
+	}
+	defer stop()
+	startDiscover(t, s, &logs)
+
+	// Every update is read as soon as it is sent, so none is coalesced.
+	var health []string
+	ctx, cancel := context.WithCancel(t.Context())
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case devs := <-updates:
+				health = append(health, devs[0].Health)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// The device churns while the module loads and ends up missing. Events
+	// are further apart than the discovery but closer than the window.
+	for range 5 {
+		if err := os.Remove(s.hostPath); err != nil {
+			t.Fatalf("failed to remove the device: %v", err)
+		}
+		time.Sleep(window / 5)
+		if err := os.WriteFile(s.hostPath, nil, 0o600); err != nil {
+			t.Fatalf("failed to recreate the device: %v", err)
+		}
+		time.Sleep(window / 5)
+	}
+	if err := os.Remove(s.hostPath); err != nil {
+		t.Fatalf("failed to remove the device: %v", err)
+	}
+
+	time.Sleep(5 * window)
+	cancel()
+	<-collected
+
+	if len(health) != 1 || health[0] != v1beta1.Unhealthy {
+		t.Errorf("got updates %v, want a single %s update", health, v1beta1.Unhealthy)
+	}
+}
+
+func TestRediscoverDevicePath(t *testing.T) {
+	hostPath := filepath.Join(t.TempDir(), "tun")
+	s := newTestServer(t, 2, WithDevicePaths(hostPath, DefaultDevicePath))
+
+	health := func() string {
+		devs := s.Status().Devices
+		for _, dev := range devs[1:] {
+			if dev.Health != devs[0].Health {
+				t.Fatalf("got mixed device health %v", devs)
+			}
+		}
+		return devs[0].Health
+	}
+
+	// The device does not exist at the configured path yet.
+	if got := health(); got != v1beta1.Unhealthy {
+		t.Fatalf("got %s devices without the device node, want %s", got, v1beta1.Unhealthy)
+	}
+
+	if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to create the device: %v", err)
+	}
+	s.Rediscover()
+	if got := health(); got != v1beta1.Healthy {
+		t.Fatalf("got %s devices once the device appeared, want %s", got, v1beta1.Healthy)
+	}
+
+	resp, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun0"}}},
+	})
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	spec := resp.GetContainerResponses()[0].GetDevices()[0]
+	if spec.GetHostPath() != hostPath || spec.GetContainerPath() != DefaultDevicePath {
+		t.Errorf("got device %s -> %s, want %s -> %s",
+			spec.GetHostPath(), spec.GetContainerPath(), hostPath, DefaultDevicePath)
+	}
+
+	if err := os.Remove(hostPath); err != nil {
+		t.Fatalf("failed to remove the device: %v", err)
+	}
+	s.Rediscover()
+	if got := health(); got != v1beta1.Unhealthy {
+		t.Errorf("got %s devices once the device disappeared, want %s", got, v1beta1.Unhealthy)
+	}
+}
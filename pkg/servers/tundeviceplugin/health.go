@@ -0,0 +1,91 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+)
+
+// Prober checks that the device is actually usable, not only present.
+type Prober func() error
+
+// openDevice opens the tun device read-write, which fails when the node is
+// stale (e.g. the tun module was unloaded) or inaccessible.
+func openDevice(path string) error {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return unix.Close(fd)
+}
+
+// CheckDevice opens the host device node once, like the default prober.
+func (s *Server) CheckDevice() error {
+	return openDevice(s.hostPath)
+}
+
+// Probe runs the active health probe every interval until ctx is done,
+// marking all devices unhealthy while it fails.
+func (s *Server) Probe(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.probe()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) probe() {
+	s.mu.RLock()
+	present := s.present
+	s.mu.RUnlock()
+
+	// A missing device is already reported by discovery.
+	var err error
+	if present {
+		err = s.prober()
+	}
+	if err != nil {
+		metrics.HealthProbeFailures.WithLabelValues(s.Name()).Inc()
+		s.log.Debug("Health probe failed", "error", err)
+	}
+
+	s.mu.Lock()
+	changed := (err == nil) != (s.probeErr == nil)
+	s.probeErr = err
+	if changed {
+		s.refreshHealth(reasonFailedProbe)
+	}
+	s.mu.Unlock()
+
+	if changed {
+		if err != nil {
+			s.log.Error("Device failed health probe", "error", err)
+		}
+		s.notify()
+	}
+}
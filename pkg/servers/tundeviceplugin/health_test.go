@@ -0,0 +1,88 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestProbeFlipsHealth(t *testing.T) {
+	var probeErr atomic.Pointer[error]
+	s := newTestServer(t, 2, WithProber(func() error {
+		if err := probeErr.Load(); err != nil {
+			return *err
+		}
+		return nil
+	}))
+
+	updates, stop, err := s.watch()
+	if err != nil {
+		t.Fatalf("watch() failed: %v", err)
+	}
+	defer stop()
+
+	failures := metrics.HealthProbeFailures.WithLabelValues(s.Name())
+	before := testutil.ToFloat64(failures)
+
+	broken := errors.New("stale device node")
+	for _, tc := range []struct {
+		name       string
+		err        *error
+		wantHealth string
+		wantUpdate bool
+	}{
+		{name: "healthy", wantHealth: v1beta1.Healthy},
+		{name: "failing", err: &broken, wantHealth: v1beta1.Unhealthy, wantUpdate: true},
+		{name: "still failing", err: &broken, wantHealth: v1beta1.Unhealthy},
+		{name: "recovered", wantHealth: v1beta1.Healthy, wantUpdate: true},
+	} {
+		probeErr.Store(tc.err)
+		s.probe()
+
+		select {
+		case devs := <-updates:
+			if !tc.wantUpdate {
+				t.Fatalf("%s: got an update, want none", tc.name)
+			}
+			for _, dev := range devs {
+				if dev.Health != tc.wantHealth {
+					t.Errorf("%s: got device %s %s, want %s", tc.name, dev.ID, dev.Health, tc.wantHealth)
+				}
+			}
+		default:
+			if tc.wantUpdate {
+				t.Fatalf("%s: got no update, want one", tc.name)
+			}
+		}
+
+		for _, dev := range s.Status().Devices {
+			if dev.Health != tc.wantHealth {
+				t.Errorf("%s: got status %s %s, want %s", tc.name, dev.ID, dev.Health, tc.wantHealth)
+			}
+		}
+	}
+
+	if got := testutil.ToFloat64(failures) - before; got != 2 {
+		t.Errorf("got %v probe failures, want 2", got)
+	}
+}
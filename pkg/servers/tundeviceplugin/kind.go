@@ -0,0 +1,59 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Kind selects the resource advertised by a Server.
+type Kind string
+
+const (
+	// KindTUN advertises L3 tun devices.
+	KindTUN Kind = "tun"
+	// KindTAP advertises L2 tap devices.
+	KindTAP Kind = "tap"
+)
+
+// deviceKind describes a resource backed by a character device. Both tun and
+// tap share /dev/net/tun and only differ in the flags passed to TUNSETIFF.
+type deviceKind struct {
+	name  string
+	path  string
+	flags uint16
+}
+
+var kinds = map[Kind]deviceKind{
+	KindTUN: {name: "tun", path: DefaultDevicePath, flags: unix.IFF_TUN},
+	KindTAP: {name: "tap", path: DefaultDevicePath, flags: unix.IFF_TAP},
+}
+
+// WithKind sets the kind of device advertised. Defaults to KindTUN.
+func WithKind(kind Kind) Option {
+	return func(s *Server) {
+		if k, ok := kinds[kind]; ok {
+			s.kind = k
+		}
+	}
+}
+
+// WithResourceName sets the resource name, which is also used for the socket
+// and as the device ID prefix. Defaults to the kind.
+func WithResourceName(name string) Option {
+	return func(s *Server) {
+		s.resource = name
+	}
+}
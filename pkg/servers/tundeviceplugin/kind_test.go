@@ -0,0 +1,87 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestTUNAndTAPResources(t *testing.T) {
+	// Both resources share the same device node.
+	hostPath := filepath.Join(t.TempDir(), "tun")
+	if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to create the device: %v", err)
+	}
+
+	sockets := map[string]struct{}{}
+	for _, tc := range []struct {
+		kind      Kind
+		devices   uint
+		wantName  string
+		wantFlags uint16
+	}{
+		{kind: KindTUN, devices: 4, wantName: "anza-labs.dev/tun", wantFlags: unix.IFF_TUN},
+		{kind: KindTAP, devices: 2, wantName: "anza-labs.dev/tap", wantFlags: unix.IFF_TAP},
+	} {
+		t.Run(string(tc.kind), func(t *testing.T) {
+			s := newTestServer(t, tc.devices, WithKind(tc.kind), WithDevicePaths(hostPath, DefaultDevicePath))
+			if s.Name() != tc.wantName {
+				t.Errorf("Name() = %q, want %q", s.Name(), tc.wantName)
+			}
+			sockets[s.Socket()] = struct{}{}
+
+			devs := s.Status().Devices
+			if len(devs) != int(tc.devices) {
+				t.Fatalf("got %d devices, want %d", len(devs), tc.devices)
+			}
+			for _, dev := range devs {
+				if !strings.HasPrefix(dev.ID, string(tc.kind)) {
+					t.Errorf("got device %s, want the %s prefix", dev.ID, tc.kind)
+				}
+			}
+
+			resp, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{devs[0].ID}}},
+			})
+			if err != nil {
+				t.Fatalf("Allocate() failed: %v", err)
+			}
+			cresp := resp.GetContainerResponses()[0]
+			if spec := cresp.GetDevices()[0]; spec.GetHostPath() != hostPath ||
+				spec.GetContainerPath() != DefaultDevicePath {
+				t.Errorf("got device spec %v, want %s mounted at %s", spec, hostPath, DefaultDevicePath)
+			}
+			envs := cresp.GetEnvs()
+			if got := envs[DefaultEnvPrefix+"_DEVICE_KIND"]; got != string(tc.kind) {
+				t.Errorf("got kind %q, want %q", got, tc.kind)
+			}
+			if got, want := envs[DefaultEnvPrefix+"_IFF_FLAGS"], fmt.Sprintf("%#x", tc.wantFlags); got != want {
+				t.Errorf("got flags %q, want %q", got, want)
+			}
+		})
+	}
+
+	if len(sockets) != 2 {
+		t.Errorf("got sockets %v, want one per resource", sockets)
+	}
+}
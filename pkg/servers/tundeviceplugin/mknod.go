@@ -0,0 +1,63 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+const devNodePerm = 0o666
+
+// MknodFunc creates a character device node.
+type MknodFunc func(path string, major, minor uint32) error
+
+func mknod(path string, major, minor uint32) error {
+	return unix.Mknod(path, unix.S_IFCHR|devNodePerm, int(unix.Mkdev(major, minor)))
+}
+
+// WithPrestartMknod makes PreStartContainer create the device node when it
+// is missing. It requires CAP_MKNOD. A nil fn uses mknod(2).
+func WithPrestartMknod(enabled bool, fn MknodFunc) Option {
+	return func(s *Server) {
+		s.prestartMknod = enabled
+		if fn != nil {
+			s.mknod = fn
+		}
+	}
+}
+
+// ensureDevice creates the parent directory and the device node when missing.
+func (s *Server) ensureDevice() error {
+	if _, err := os.Stat(s.hostPath); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to stat %s: %w", s.hostPath, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.hostPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(s.hostPath), err)
+	}
+	if err := s.mknod(s.hostPath, expectedMajor, expectedMinor); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("failed to create device node %s: %w", s.hostPath, err)
+	}
+
+	s.log.Info("Created missing device node", "path", s.hostPath)
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestPreStartMknod(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		enabled   bool
+		exists    bool
+		mknodErr  error
+		want      codes.Code
+		wantCalls int
+	}{
+		{name: "missing node", enabled: true, want: codes.OK, wantCalls: 1},
+		{name: "existing node", enabled: true, exists: true, want: codes.OK},
+		{name: "created concurrently", enabled: true, mknodErr: os.ErrExist, want: codes.OK, wantCalls: 1},
+		{name: "mknod failure", enabled: true, mknodErr: os.ErrPermission, want: codes.Internal, wantCalls: 1},
+		{name: "disabled", want: codes.OK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The parent directory is missing along with the node.
+			hostPath := filepath.Join(t.TempDir(), "net", "tun")
+			if tc.exists {
+				if err := os.MkdirAll(filepath.Dir(hostPath), 0o755); err != nil {
+					t.Fatalf("failed to create the device dir: %v", err)
+				}
+				if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+					t.Fatalf("failed to create the device: %v", err)
+				}
+			}
+
+			var calls int
+			fakeMknod := func(path string, major, minor uint32) error {
+				calls++
+				if path != hostPath || major != expectedMajor || minor != expectedMinor {
+					t.Errorf("got mknod(%s, %d, %d), want mknod(%s, %d, %d)",
+						path, major, minor, hostPath, expectedMajor, expectedMinor)
+				}
+				if tc.mknodErr != nil && !errors.Is(tc.mknodErr, os.ErrExist) {
+					return tc.mknodErr
+				}
+				// A regular file stands in for the character device.
+				if err := os.WriteFile(path, nil, 0o600); err != nil {
+					return err
+				}
+				return tc.mknodErr
+			}
+			s := newTestServer(t, 2, WithDevicePaths(hostPath, DefaultDevicePath), WithPrestartMknod(tc.enabled, fakeMknod))
+
+			opts, err := s.GetDevicePluginOptions(t.Context(), &v1beta1.Empty{})
+			if err != nil {
+				t.Fatalf("GetDevicePluginOptions() failed: %v", err)
+			}
+			if opts.GetPreStartRequired() != tc.enabled {
+				t.Errorf("got PreStartRequired %t, want %t", opts.GetPreStartRequired(), tc.enabled)
+			}
+
+			_, err = s.PreStartContainer(t.Context(), &v1beta1.PreStartContainerRequest{DevicesIDs: []string{"tun0"}})
+			if got := status.Code(err); got != tc.want {
+				t.Fatalf("PreStartContainer() = %v, want %s", err, tc.want)
+			}
+			if calls != tc.wantCalls {
+				t.Errorf("got %d mknod calls, want %d", calls, tc.wantCalls)
+			}
+
+			// A created node is picked up right away.
+			if tc.want == codes.OK && tc.enabled {
+				for _, dev := range s.Status().Devices {
+					if dev.Health != v1beta1.Healthy {
+						t.Errorf("got device %s %s, want %s", dev.ID, dev.Health, v1beta1.Healthy)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import "fmt"
+
+// DevicePermissions are the cgroup permissions granted on the device node.
+type DevicePermissions string
+
+const (
+	DevicePermissionsRead      DevicePermissions = "r"
+	DevicePermissionsReadWrite DevicePermissions = "rw"
+	// DevicePermissionsReadWriteMknod also allows creating the device node.
+	DevicePermissionsReadWriteMknod DevicePermissions = "rwm"
+)
+
+func ParseDevicePermissions(perm string) (DevicePermissions, error) {
+	switch p := DevicePermissions(perm); p {
+	case DevicePermissionsRead, DevicePermissionsReadWrite, DevicePermissionsReadWriteMknod:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown device permissions %q, expected r, rw or rwm", perm)
+	}
+}
+
+// WithDevicePermissions sets the permissions granted on the device node,
+// rw by default.
+func WithDevicePermissions(perm DevicePermissions) Option {
+	return func(s *Server) {
+		s.permissions = perm
+	}
+}
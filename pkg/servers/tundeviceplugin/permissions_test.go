@@ -0,0 +1,78 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"testing"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestParseDevicePermissions(t *testing.T) {
+	for _, tc := range []struct {
+		perm  string
+		valid bool
+	}{
+		{perm: "r", valid: true},
+		{perm: "rw", valid: true},
+		{perm: "rwm", valid: true},
+		{perm: "", valid: false},
+		{perm: "w", valid: false},
+		{perm: "wr", valid: false},
+		{perm: "RW", valid: false},
+	} {
+		t.Run(tc.perm, func(t *testing.T) {
+			got, err := ParseDevicePermissions(tc.perm)
+			if tc.valid != (err == nil) {
+				t.Fatalf("ParseDevicePermissions(%q) = %v, want valid %t", tc.perm, err, tc.valid)
+			}
+			if tc.valid && string(got) != tc.perm {
+				t.Errorf("got permissions %q, want %q", got, tc.perm)
+			}
+		})
+	}
+}
+
+func TestAllocateDevicePermissions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{name: "default", want: "rw"},
+		{name: "read", opts: []Option{WithDevicePermissions(DevicePermissionsRead)}, want: "r"},
+		{name: "mknod", opts: []Option{WithDevicePermissions(DevicePermissionsReadWriteMknod)}, want: "rwm"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, 2, tc.opts...)
+
+			resp, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun0", "tun1"}}},
+			})
+			if err != nil {
+				t.Fatalf("Allocate() failed: %v", err)
+			}
+			devices := resp.GetContainerResponses()[0].GetDevices()
+			if len(devices) == 0 {
+				t.Fatal("got no device specs")
+			}
+			for _, dev := range devices {
+				if dev.GetPermissions() != tc.want {
+					t.Errorf("got permissions %q on %s, want %q", dev.GetPermissions(), dev.GetContainerPath(), tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+)
+
+// SelfProbeMetadataKey marks synthetic Allocate calls made by the self probe.
+// Those are answered normally but not recorded as allocations.
+const SelfProbeMetadataKey = "tun-manager-self-probe"
+
+var errNotProbed = errors.New("self probe has not completed yet")
+
+// isSelfProbe reports whether the request was made by the self probe.
+func isSelfProbe(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(SelfProbeMetadataKey)) > 0
+}
+
+// SelfProbe periodically allocates a healthy device through the plugin
+// socket and checks that the returned device nodes can be opened.
+func (s *Server) SelfProbe(ctx context.Context, interval time.Duration) error {
+	s.mu.Lock()
+	s.selfProbeErr = errNotProbed
+	s.mu.Unlock()
+
+	// gRPC resolves unix:// targets, but plain host:port for TCP.
+	target := strings.TrimPrefix(s.Socket(), "tcp://")
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to create self probe client: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck // best effort call
+
+	client := v1beta1.NewDevicePluginClient(conn)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := s.selfProbe(ctx, client)
+		if err != nil {
+			metrics.SelfProbeFailures.WithLabelValues(s.Name()).Inc()
+			s.log.Warn("Self allocation probe failed", "error", err)
+		}
+
+		s.mu.Lock()
+		s.selfProbeErr = err
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) selfProbe(ctx context.Context, client v1beta1.DevicePluginClient) error {
+	var id string
+	for _, dev := range s.snapshot() {
+		if dev.Health == v1beta1.Healthy {
+			id = dev.ID
+			break
+		}
+	}
+	if id == "" {
+		return errors.New("no healthy device to allocate")
+	}
+
+	ctx, cancel := context.WithTimeout(metadata.AppendToOutgoingContext(ctx, SelfProbeMetadataKey, "true"), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Allocate(ctx, &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{id}}},
+	})
+	if err != nil {
+		return fmt.Errorf("allocate failed: %w", err)
+	}
+
+	if len(resp.GetContainerResponses()) != 1 {
+		return fmt.Errorf("expected 1 container response, got %d", len(resp.GetContainerResponses()))
+	}
+	specs := resp.GetContainerResponses()[0].GetDevices()
+	if len(specs) == 0 {
+		return errors.New("allocate returned no device")
+	}
+	for _, spec := range specs {
+		if err := openDevice(spec.GetHostPath()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ready returns the result of the last self probe, nil when the self probe
+// is not running.
+func (s *Server) Ready() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.selfProbeErr
+}
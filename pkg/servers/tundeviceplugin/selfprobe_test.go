@@ -0,0 +1,102 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newTestClient serves s in memory and returns a client of it.
+func newTestClient(t *testing.T, s *Server) v1beta1.DevicePluginClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	v1beta1.RegisterDevicePluginServer(srv, s)
+	go srv.Serve(lis) //nolint:errcheck // stopped by the test
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return v1beta1.NewDevicePluginClient(conn)
+}
+
+func TestSelfProbe(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		breakDevice func(t *testing.T, hostPath string)
+		wantErr     bool
+	}{
+		{name: "working device"},
+		{name: "removed device", breakDevice: func(t *testing.T, hostPath string) {
+			if err := os.Remove(hostPath); err != nil {
+				t.Fatalf("failed to remove the device: %v", err)
+			}
+		}, wantErr: true},
+		{name: "unopenable device", breakDevice: func(t *testing.T, hostPath string) {
+			if err := os.Remove(hostPath); err != nil {
+				t.Fatalf("failed to remove the device: %v", err)
+			}
+			if err := os.Mkdir(hostPath, 0o700); err != nil {
+				t.Fatalf("failed to replace the device: %v", err)
+			}
+		}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hostPath := filepath.Join(t.TempDir(), "tun")
+			if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+				t.Fatalf("failed to create the device: %v", err)
+			}
+			s := newTestServer(t, 2, WithDevicePaths(hostPath, DefaultDevicePath))
+			client := newTestClient(t, s)
+
+			// The devices are still advertised healthy, only the probe sees the breakage.
+			if tc.breakDevice != nil {
+				tc.breakDevice(t, hostPath)
+			}
+
+			err := s.selfProbe(t.Context(), client)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("selfProbe() = %v, want error %t", err, tc.wantErr)
+			}
+
+			// Self probes are not recorded as allocations.
+			for _, dev := range s.Status().Devices {
+				if dev.LastAllocated != nil {
+					t.Errorf("the self probe recorded an allocation of %s", dev.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+const (
+	numaSysfsDir = "/sys/devices/system/node"
+
+	// NUMANodesAuto stamps devices with every NUMA node found on the host.
+	NUMANodesAuto = "auto"
+)
+
+// ParseNUMANodes parses a comma separated list of NUMA node IDs, or
+// NUMANodesAuto to detect them from sysfs. An empty value disables topology.
+func ParseNUMANodes(value string) ([]int64, error) {
+	switch value {
+	case "":
+		return nil, nil
+	case NUMANodesAuto:
+		return detectNUMANodes(numaSysfsDir)
+	}
+
+	var nodes []int64
+	for _, field := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid NUMA node %q", field)
+		}
+		nodes = append(nodes, id)
+	}
+	return nodes, nil
+}
+
+func detectNUMANodes(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect NUMA nodes: %w", err)
+	}
+
+	var nodes []int64
+	for _, entry := range entries {
+		id, err := strconv.ParseInt(strings.TrimPrefix(entry.Name(), "node"), 10, 64)
+		if err != nil || !strings.HasPrefix(entry.Name(), "node") {
+			continue
+		}
+		nodes = append(nodes, id)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no NUMA nodes found in %s", filepath.Clean(dir))
+	}
+	slices.Sort(nodes)
+	return nodes, nil
+}
+
+// WithNUMANodes stamps every advertised device with the given NUMA nodes.
+// The tun device is virtual and has no real affinity, this only lets the
+// TopologyManager align it with other NUMA-pinned resources.
+func WithNUMANodes(nodes []int64) Option {
+	return func(s *Server) {
+		s.numaNodes = nodes
+	}
+}
+
+func (s *Server) topology() *v1beta1.TopologyInfo {
+	if len(s.numaNodes) == 0 {
+		return nil
+	}
+
+	info := &v1beta1.TopologyInfo{}
+	for _, id := range s.numaNodes {
+		info.Nodes = append(info.Nodes, &v1beta1.NUMANode{ID: id})
+	}
+	return info
+}
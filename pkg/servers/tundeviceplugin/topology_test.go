@@ -0,0 +1,109 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func TestTopology(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		nodes []int64
+	}{
+		{name: "disabled"},
+		{name: "one node", nodes: []int64{0}},
+		{name: "two nodes", nodes: []int64{0, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, 2, WithNUMANodes(tc.nodes))
+
+			ctx, cancel := context.WithCancel(t.Context())
+			defer cancel()
+			stream := &recordingStream{ctx: ctx, sends: make(chan []*v1beta1.Device, 1)}
+			go func() { _ = s.ListAndWatch(&v1beta1.Empty{}, stream) }()
+
+			var devs []*v1beta1.Device
+			select {
+			case devs = <-stream.sends:
+			case <-time.After(5 * time.Second):
+				t.Fatal("ListAndWatch() sent no device list")
+			}
+
+			for _, dev := range devs {
+				var got []int64
+				for _, node := range dev.GetTopology().GetNodes() {
+					got = append(got, node.GetID())
+				}
+				if !slices.Equal(got, tc.nodes) {
+					t.Errorf("got device %s on NUMA nodes %v, want %v", dev.ID, got, tc.nodes)
+				}
+				if tc.nodes == nil && dev.Topology != nil {
+					t.Errorf("got topology %v on device %s, want none", dev.Topology, dev.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNUMANodes(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		want    []int64
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "0", want: []int64{0}},
+		{value: "0, 1", want: []int64{0, 1}},
+		{value: "-1", wantErr: true},
+		{value: "a", wantErr: true},
+	} {
+		got, err := ParseNUMANodes(tc.value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseNUMANodes(%q) error = %v, want error %t", tc.value, err, tc.wantErr)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("ParseNUMANodes(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestDetectNUMANodes(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"node1", "node0", "possible", "has_cpu"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o700); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+	}
+
+	got, err := detectNUMANodes(dir)
+	if err != nil {
+		t.Fatalf("detectNUMANodes() failed: %v", err)
+	}
+	if !slices.Equal(got, []int64{0, 1}) {
+		t.Errorf("detectNUMANodes() = %v, want [0 1]", got)
+	}
+
+	if _, err := detectNUMANodes(t.TempDir()); err == nil {
+		t.Error("detectNUMANodes() = nil without any node, want an error")
+	}
+}
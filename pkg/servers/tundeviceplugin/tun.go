@@ -20,62 +20,670 @@ import (
 	"log/slog"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/anza-labs/tun-manager/pkg/logging"
+	"github.com/anza-labs/tun-manager/pkg/metrics"
 )
 
 const (
-	tunPath = "/dev/net/tun"
-	tunName = "tun"
-	rwPerm  = "rw"
+	// DefaultDeviceCount is the number of devices advertised unless set with
+	// WithDeviceCount.
+	DefaultDeviceCount = 64
+
+	// DefaultDevicePath is the device path used unless set with WithDevicePaths.
+	DefaultDevicePath = "/dev/net/tun"
+
+	// DefaultEnvPrefix prefixes the environment variables injected into containers.
+	DefaultEnvPrefix = "ANZA_TUN"
+
+	reasonMissingDevice = "missing device"
+	reasonDrain         = "drain"
+	reasonNodeDrain     = "node drain"
+	reasonReload        = "reload"
+	reasonFailedProbe   = "failed probe"
+	reasonDeviceNumbers = "unexpected device numbers"
+
+	// DefaultMaxWatchers bounds the number of tracked ListAndWatch streams.
+	// The kubelet only ever opens one.
+	DefaultMaxWatchers = 4
 )
 
 type Server struct {
 	log       *slog.Logger
 	namespace string
-	update    chan struct{}
+	kind      deviceKind
+	resource  string
 	devices   uint
-	devs      []*v1beta1.Device
+	admission *AdmissionPolicy
+
+	hostPath      string
+	containerPath string
+	socketDir     string
+	endpoint      string
+
+	maxWatchers     int
+	discoveryPolicy DiscoveryPolicy
+	cache           *allocationCache
+
+	registrationMode string
+	strategy         AllocationStrategy
+	envPrefix        string
+	debounce         time.Duration
+	healthDebounce   time.Duration
+	cdiSpecPath      string
+	cgroupHints      bool
+	cgroupRoot       string
+	cgroupDeviceRule string
+	prober           Prober
+	numaNodes        []int64
+	strictNumbers    bool
+	prestartMknod    bool
+	maxAllocations   int
+	mknod            MknodFunc
+	healthHook       HealthHook
+	idFormat         string
+	permissions      DevicePermissions
+	annotations      map[string]string
+
+	// idMu guards uuids, the IDs generated for the uuid device ID format.
+	idMu  sync.Mutex
+	uuids []string
+
+	mu      sync.RWMutex
+	devs    []*v1beta1.Device
+	present bool
+	drained map[string]struct{}
+
+	// nodeDrained drains every slot while the node is drained, independently
+	// of the slots drained with SetDrained.
+	nodeDrained bool
+
+	// probeErr holds the result of the last active health probe.
+	probeErr error
+
+	// selfProbeErr holds the result of the last self allocation probe.
+	selfProbeErr error
+
+	// major and minor are the numbers of the discovered device, badNumbers is
+	// set when they are unexpected in strict mode.
+	major, minor uint32
+	badNumbers   bool
+
+	// lastAllocated holds the time each device was last allocated.
+	lastAllocated map[string]time.Time
+
+	// healthy is the overall health last reported to the health hook.
+	healthy *bool
+
+	// watchers holds one bounded channel per ListAndWatch stream.
+	watchers map[chan []*v1beta1.Device]struct{}
+	stopped  bool
 }
 
 var _ v1beta1.DevicePluginServer = (*Server)(nil)
 
-func New(namespace string, devices uint, log *slog.Logger) *Server {
-	if log == nil {
-		log = slog.New(slog.DiscardHandler)
+type Option func(*Server)
+
+// DiscoveryPolicy controls how the number of advertised slots relates to the
+// number of underlying devices found during discovery.
+type DiscoveryPolicy string
+
+const (
+	// DiscoveryPolicyCap advertises exactly the configured count.
+	DiscoveryPolicyCap DiscoveryPolicy = "cap"
+	// DiscoveryPolicyExpand advertises the discovered count when it exceeds the configured one.
+	DiscoveryPolicyExpand DiscoveryPolicy = "expand"
+)
+
+func ParseDiscoveryPolicy(policy string) (DiscoveryPolicy, error) {
+	switch p := DiscoveryPolicy(policy); p {
+	case DiscoveryPolicyCap, DiscoveryPolicyExpand:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown discovery policy %q", policy)
+	}
+}
+
+// WithDiscoveryPolicy sets the policy applied when discovery finds more devices than configured.
+func WithDiscoveryPolicy(policy DiscoveryPolicy) Option {
+	return func(s *Server) {
+		s.discoveryPolicy = policy
+	}
+}
+
+// WithAdmissionPolicy restricts allocations to containers matching the policy.
+func WithAdmissionPolicy(policy *AdmissionPolicy) Option {
+	return func(s *Server) {
+		s.admission = policy
+	}
+}
+
+// WithMaxWatchers limits the number of concurrent ListAndWatch streams. Zero disables the limit.
+func WithMaxWatchers(n int) Option {
+	return func(s *Server) {
+		s.maxWatchers = n
+	}
+}
+
+// WithAllocationCache caches up to size allocation responses. Zero disables the cache.
+func WithAllocationCache(size int) Option {
+	return func(s *Server) {
+		s.cache = newAllocationCache(size)
+	}
+}
+
+// WithRegistrationMode sets the kubelet registration mode reported by Status.
+func WithRegistrationMode(mode string) Option {
+	return func(s *Server) {
+		s.registrationMode = mode
+	}
+}
+
+// WithAllocationStrategy enables GetPreferredAllocation with the given strategy.
+func WithAllocationStrategy(strategy AllocationStrategy) Option {
+	return func(s *Server) {
+		s.strategy = strategy
+	}
+}
+
+// WithEnvPrefix sets the prefix of the environment variables injected into containers.
+func WithEnvPrefix(prefix string) Option {
+	return func(s *Server) {
+		s.envPrefix = prefix
+	}
+}
+
+// WithDiscoveryDebounce requires the device to be stable for the given window
+// before it is advertised at startup.
+func WithDiscoveryDebounce(window time.Duration) Option {
+	return func(s *Server) {
+		s.debounce = window
+	}
+}
+
+// WithCDI writes a CDI spec for the advertised devices to specPath and
+// references the CDI devices in allocation responses. Empty path disables it.
+func WithCDI(specPath string) Option {
+	return func(s *Server) {
+		s.cdiSpecPath = specPath
+	}
+}
+
+// WithCgroupHints annotates allocations with the cgroup v2 device rule on cgroup v2 nodes.
+func WithCgroupHints(enabled bool) Option {
+	return func(s *Server) {
+		s.cgroupHints = enabled
+	}
+}
+
+// WithDevicePaths sets the path of the device on the host and the path it is
+// exposed at in containers. Empty paths default to DefaultDevicePath.
+func WithDevicePaths(hostPath, containerPath string) Option {
+	return func(s *Server) {
+		s.hostPath = hostPath
+		s.containerPath = containerPath
+	}
+}
+
+// WithMaxAllocations caps the number of concurrently allocated devices. Once
+// the cap is reached Allocate fails with ResourceExhausted, the slots beyond
+// the cap are advertised as unhealthy so the kubelet stops trying them. Zero
+// disables the cap.
+func WithMaxAllocations(n int) Option {
+	return func(s *Server) {
+		s.maxAllocations = n
+	}
+}
+
+// WithSocketDir overrides the directory of the plugin socket, which must be the
+// kubelet device-plugins directory. Defaults to v1beta1.DevicePluginPath.
+func WithSocketDir(dir string) Option {
+	return func(s *Server) {
+		s.socketDir = dir
 	}
+}
+
+// HealthHook is called with the overall health of the device whenever it
+// changes, drained slots are not considered. It is called in order with the
+// device state locked, so it must not block.
+type HealthHook func(resource string, healthy bool)
+
+// WithHealthHook registers a hook called on overall health changes.
+func WithHealthHook(hook HealthHook) Option {
+	return func(s *Server) {
+		s.healthHook = hook
+	}
+}
+
+// WithProber replaces the active health probe.
+func WithProber(prober Prober) Option {
+	return func(s *Server) {
+		s.prober = prober
+	}
+}
+
+// WithLogger sets the logger of the server, logs are discarded by default.
+func WithLogger(log *slog.Logger) Option {
+	return func(s *Server) {
+		if log != nil {
+			s.log = log
+		}
+	}
+}
+
+// WithDeviceCount sets the number of advertised devices, DefaultDeviceCount
+// by default.
+func WithDeviceCount(devices uint) Option {
+	return func(s *Server) {
+		s.devices = devices
+	}
+}
+
+// New creates a server for the namespace/resource extended resource. Without
+// options it advertises DefaultDeviceCount tun devices at DefaultDevicePath.
+func New(namespace string, opts ...Option) (*Server, error) {
 	s := &Server{
-		log:       log,
+		log:       slog.New(slog.DiscardHandler),
 		namespace: namespace,
-		devices:   devices,
-		update:    make(chan struct{}),
+		kind:      kinds[KindTUN],
+		devices:   DefaultDeviceCount,
 		devs:      []*v1beta1.Device{},
+		drained:   map[string]struct{}{},
+		watchers:  map[chan []*v1beta1.Device]struct{}{},
+
+		lastAllocated: map[string]time.Time{},
+
+		maxWatchers:     DefaultMaxWatchers,
+		discoveryPolicy: DiscoveryPolicyCap,
+		envPrefix:       DefaultEnvPrefix,
+		socketDir:       v1beta1.DevicePluginPath,
+		cgroupRoot:      DefaultCgroupRoot,
+		permissions:     DevicePermissionsReadWrite,
+		mknod:           mknod,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.hostPath == "" {
+		s.hostPath = s.kind.path
+	}
+	if s.containerPath == "" {
+		s.containerPath = s.kind.path
+	}
+	if s.prober == nil {
+		s.prober = func() error { return openDevice(s.hostPath) }
+	}
+	if s.resource == "" {
+		s.resource = s.kind.name
+	}
+	if err := validateResourceName(s.namespace, s.resource); err != nil {
+		return nil, err
 	}
+	if err := ValidateDeviceIDFormat(s.idFormat); err != nil {
+		return nil, err
+	}
+	s.log = s.log.With("resource", s.resource)
 	s.discover()
-	return s
+	if s.cgroupHints {
+		s.cgroupDeviceRule = s.cgroupRule()
+	}
+	return s, nil
 }
 
 func (s *Server) discover() {
-	if _, err := os.Stat(tunPath); err == nil {
-		s.log.Debug("Discovered tun device")
+	paths := s.stablePaths()
+	major, minor := s.readDeviceNumbers()
 
-		for i := uint(0); i < s.devices; i++ {
-			s.devs = append(s.devs, &v1beta1.Device{
-				ID:     fmt.Sprintf("%s%d", tunName, i),
-				Health: v1beta1.Healthy,
-			})
-		}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setDeviceNumbersLocked(major, minor)
+
+	if len(paths) > 0 {
+		s.log.Debug("Discovered device", "paths", paths)
+		s.present = true
 	} else {
-		s.log.Error("No tun device found")
+		s.log.Error("No device found, advertising devices as unhealthy")
+	}
+
+	// Slots are advertised even without the device, so they can become
+	// healthy once it appears.
+	s.devs = s.buildDevices(s.slots(uint(len(paths))))
+	metrics.DevicesTotal.WithLabelValues(s.Name()).Set(float64(len(s.devs)))
+	s.writeCDISpecLocked()
+
+	s.refreshHealth(reasonMissingDevice)
+}
+
+func (s *Server) buildDevices(n uint) []*v1beta1.Device {
+	devs := make([]*v1beta1.Device, 0, n)
+	for i := uint(0); i < n; i++ {
+		devs = append(devs, &v1beta1.Device{
+			ID:       s.deviceID(i),
+			Health:   v1beta1.Healthy,
+			Topology: s.topology(),
+		})
+	}
+	return devs
+}
+
+// Reload changes the number of advertised devices. The new device list is
+// built aside and swapped in under the lock, so watchers never observe a
+// partially rebuilt list.
+func (s *Server) Reload(devices uint) {
+	devs := s.buildDevices(devices)
+
+	s.mu.Lock()
+	old := make(map[string]string, len(s.devs))
+	for _, dev := range s.devs {
+		old[dev.ID] = dev.Health
+	}
+	for _, dev := range devs {
+		if health, ok := old[dev.ID]; ok {
+			dev.Health = health
+		}
+	}
+
+	s.devices = devices
+	s.devs = devs
+	for id := range s.drained {
+		if !hasDevice(devs, id) {
+			delete(s.drained, id)
+		}
 	}
+	metrics.DevicesTotal.WithLabelValues(s.Name()).Set(float64(len(s.devs)))
+	s.writeCDISpecLocked()
+	s.refreshHealth(reasonReload)
+	s.cache.invalidate()
+	s.mu.Unlock()
+
+	s.log.Info("Reloaded devices", "count", devices)
+	s.notify()
+}
+
+func hasDevice(devs []*v1beta1.Device, id string) bool {
+	for _, dev := range devs {
+		if dev.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+type Status struct {
+	Name             string         `json:"name"`
+	RegistrationMode string         `json:"registrationMode,omitempty"`
+	Present          bool           `json:"present"`
+	Major            uint32         `json:"major,omitempty"`
+	Minor            uint32         `json:"minor,omitempty"`
+	Devices          []DeviceStatus `json:"devices"`
+}
+
+type DeviceStatus struct {
+	ID            string     `json:"id"`
+	Health        string     `json:"health"`
+	Drained       bool       `json:"drained"`
+	LastAllocated *time.Time `json:"lastAllocated,omitempty"`
+}
+
+// Status returns a point-in-time view of the advertised devices.
+func (s *Server) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := Status{
+		Name:             s.Name(),
+		RegistrationMode: s.registrationMode,
+		Present:          s.present,
+		Major:            s.major,
+		Minor:            s.minor,
+		Devices:          make([]DeviceStatus, 0, len(s.devs)),
+	}
+	for _, dev := range s.devs {
+		_, drained := s.drained[dev.ID]
+		drained = drained || s.nodeDrained
+		ds := DeviceStatus{
+			ID:      dev.ID,
+			Health:  dev.Health,
+			Drained: drained,
+		}
+		if t, ok := s.lastAllocated[dev.ID]; ok {
+			ds.LastAllocated = &t
+		}
+		st.Devices = append(st.Devices, ds)
+	}
+	return st
+}
+
+// slots returns the number of slots to advertise for the discovered devices.
+func (s *Server) slots(discovered uint) uint {
+	if discovered <= s.devices {
+		return s.devices
+	}
+
+	switch s.discoveryPolicy {
+	case DiscoveryPolicyExpand:
+		s.log.Warn("Discovered more devices than configured, expanding",
+			"configured", s.devices, "discovered", discovered)
+		return discovered
+	default:
+		s.log.Warn("Discovered more devices than configured, capping",
+			"configured", s.devices, "discovered", discovered)
+		return s.devices
+	}
+}
+
+// SetDrained drains or restores the given device slots. When no IDs are given,
+// the whole node is drained or restored.
+func (s *Server) SetDrained(drained bool, ids ...string) {
+	s.mu.Lock()
+	if len(ids) == 0 {
+		for _, dev := range s.devs {
+			ids = append(ids, dev.ID)
+		}
+	}
+	for _, id := range ids {
+		if drained {
+			s.drained[id] = struct{}{}
+		} else {
+			delete(s.drained, id)
+		}
+	}
+	s.refreshHealth(reasonDrain)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// SetNodeDrained drains or restores every slot on behalf of the node state.
+// Restoring the node keeps the slots drained with SetDrained drained.
+func (s *Server) SetNodeDrained(drained bool) {
+	s.mu.Lock()
+	s.nodeDrained = drained
+	s.refreshHealth(reasonNodeDrain)
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// refreshHealth recomputes the health of every slot, updates the metrics and
+// logs one line per health transition. It must be called with s.mu held.
+func (s *Server) refreshHealth(reason string) {
+	type transition struct{ from, to string }
+	transitions := map[transition]int{}
+
+	var drained, unhealthy int
+	for i, dev := range s.devs {
+		old := dev.Health
+
+		_, isDrained := s.drained[dev.ID]
+		isDrained = isDrained || s.nodeDrained
+		switch {
+		case !s.present, s.probeErr != nil, s.badNumbers:
+			dev.Health = v1beta1.Unhealthy
+			unhealthy++
+		case s.maxAllocations > 0 && i >= s.maxAllocations:
+			// Slots beyond the cap are never schedulable.
+			dev.Health = v1beta1.Unhealthy
+			unhealthy++
+		case isDrained:
+			dev.Health = v1beta1.Unhealthy
+			drained++
+		default:
+			dev.Health = v1beta1.Healthy
+		}
+
+		if old != dev.Health {
+			transitions[transition{from: old, to: dev.Health}]++
+		}
+	}
+
+	if len(transitions) > 0 {
+		s.cache.invalidate()
+	}
+
+	for t, count := range transitions {
+		s.log.Info("Device health transition",
+			"old", t.from,
+			"new", t.to,
+			"reason", reason,
+			"devices", count,
+		)
+	}
+
+	if healthy := s.present && s.probeErr == nil && !s.badNumbers; s.healthHook != nil &&
+		(s.healthy == nil || *s.healthy != healthy) {
+		s.healthy = &healthy
+		s.healthHook(s.resource, healthy)
+	}
+
+	metrics.DevicesDrained.WithLabelValues(s.Name()).Set(float64(drained))
+	metrics.DevicesUnhealthy.WithLabelValues(s.Name()).Set(float64(unhealthy))
+}
+
+// notify pushes the current device list to every watcher without blocking.
+// Only the latest state matters, so a pending, unsent state is replaced.
+// Nothing is queued while no watcher is attached: ListAndWatch starts every
+// stream with the current snapshot, so a reconnecting kubelet receives the
+// latest device list exactly once.
+func (s *Server) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devs := s.snapshotLocked()
+	for w := range s.watchers {
+		select {
+		case w <- devs:
+			continue
+		default:
+		}
+
+		select {
+		case <-w:
+			metrics.ListAndWatchCoalesced.Inc()
+		default:
+		}
+
+		select {
+		case w <- devs:
+		default:
+		}
+	}
+}
+
+// watch registers a new watcher and returns its channel along with a function
+// removing it. It fails once the maximum number of watchers is reached.
+func (s *Server) watch() (<-chan []*v1beta1.Device, func(), error) {
+	w := make(chan []*v1beta1.Device, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return nil, nil, status.Error(codes.Unavailable, "server is shutting down")
+	}
+	if s.maxWatchers > 0 && len(s.watchers) >= s.maxWatchers {
+		return nil, nil, status.Errorf(codes.ResourceExhausted,
+			"too many ListAndWatch streams, limit is %d", s.maxWatchers)
+	}
+	s.watchers[w] = struct{}{}
+	metrics.ListAndWatchWatchers.WithLabelValues(s.Name()).Set(float64(len(s.watchers)))
+
+	return w, func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		metrics.ListAndWatchWatchers.WithLabelValues(s.Name()).Set(float64(len(s.watchers)))
+		s.mu.Unlock()
+	}, nil
+}
+
+// Stop ends every ListAndWatch stream and rejects new ones. The pending
+// updates are delivered before the streams end.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	for w := range s.watchers {
+		close(w)
+		delete(s.watchers, w)
+	}
+	metrics.ListAndWatchWatchers.WithLabelValues(s.Name()).Set(0)
+}
+
+// snapshot returns a copy of the current device list, safe to send to the kubelet.
+func (s *Server) snapshot() []*v1beta1.Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.snapshotLocked()
+}
+
+// snapshotLocked is like snapshot, but must be called with s.mu held.
+// Every ListAndWatch update goes through it, so it also refreshes the
+// allocated devices gauge.
+func (s *Server) snapshotLocked() []*v1beta1.Device {
+	s.refreshAllocatedLocked()
+
+	devs := make([]*v1beta1.Device, 0, len(s.devs))
+	for _, dev := range s.devs {
+		devs = append(devs, &v1beta1.Device{
+			ID:       dev.ID,
+			Health:   dev.Health,
+			Topology: dev.Topology,
+		})
+	}
+	return devs
 }
 
 func (s *Server) Name() string {
-	return path.Join(s.namespace, tunName)
+	return path.Join(s.namespace, s.resource)
+}
+
+// WithEndpoint serves the device plugin on endpoint, e.g.
+// tcp://127.0.0.1:9000, instead of a socket in the socket directory. The
+// kubelet only dials unix sockets, this is meant for testing without it.
+func WithEndpoint(endpoint string) Option {
+	return func(s *Server) {
+		s.endpoint = endpoint
+	}
 }
 
 func (s *Server) Socket() string {
-	return fmt.Sprintf("unix://%s", path.Join(v1beta1.DevicePluginPath, tunName+".sock"))
+	if s.endpoint != "" {
+		return s.endpoint
+	}
+	return fmt.Sprintf("unix://%s", path.Join(s.socketDir, s.resource+".sock"))
 }
 
 func (s *Server) GetDevicePluginOptions(
@@ -83,8 +691,8 @@ func (s *Server) GetDevicePluginOptions(
 	_ *v1beta1.Empty,
 ) (*v1beta1.DevicePluginOptions, error) {
 	return &v1beta1.DevicePluginOptions{
-		PreStartRequired:                false,
-		GetPreferredAllocationAvailable: false,
+		PreStartRequired:                s.prestartMknod,
+		GetPreferredAllocationAvailable: s.strategy != AllocationStrategyNone,
 	}, nil
 }
 
@@ -92,48 +700,263 @@ func (s *Server) ListAndWatch(
 	_ *v1beta1.Empty,
 	lws v1beta1.DevicePlugin_ListAndWatchServer,
 ) error {
-	if err := lws.Send(&v1beta1.ListAndWatchResponse{Devices: s.devs}); err != nil {
-		s.log.Error("Failed to send ListAndWatch response", "error", err)
+	streams := metrics.ListAndWatchActiveStreams.WithLabelValues(s.Name())
+	streams.Inc()
+	defer streams.Dec()
+
+	updates, stop, err := s.watch()
+	if err != nil {
+		metrics.ListAndWatchRejected.WithLabelValues(s.Name()).Inc()
+		s.log.Error("Rejected ListAndWatch stream", "error", err)
+		return err
+	}
+	defer stop()
+
+	if err := s.send(lws, s.snapshot()); err != nil {
+		return err
 	}
 
-	for range s.update {
-		if err := lws.Send(&v1beta1.ListAndWatchResponse{Devices: s.devs}); err != nil {
-			s.log.Error("Failed to send ListAndWatch response", "error", err)
+	for {
+		select {
+		case <-lws.Context().Done():
+			s.log.Debug("ListAndWatch stream closed")
+			return nil
+		case devs, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			if err := s.send(lws, devs); err != nil {
+				return err
+			}
 		}
 	}
+}
 
-	panic("unexpected error")
+// send pushes the device list on the stream. A failed send leaves the stream
+// broken, so the error ends ListAndWatch and the kubelet opens a new one.
+func (s *Server) send(lws v1beta1.DevicePlugin_ListAndWatchServer, devs []*v1beta1.Device) error {
+	if err := lws.Send(&v1beta1.ListAndWatchResponse{Devices: devs}); err != nil {
+		metrics.ListAndWatchSendErrors.WithLabelValues(s.Name()).Inc()
+		s.log.Error("Failed to send ListAndWatch response, closing the stream", "error", err)
+		return fmt.Errorf("failed to send ListAndWatch response: %w", err)
+	}
+	return nil
 }
 
 func (s *Server) Allocate(
 	ctx context.Context,
 	req *v1beta1.AllocateRequest,
-) (*v1beta1.AllocateResponse, error) {
-	s.update <- struct{}{}
+) (_ *v1beta1.AllocateResponse, err error) {
+	// Self probes would skew the latency of the kubelet allocations.
+	if !isSelfProbe(ctx) {
+		start := time.Now()
+		defer func() {
+			metrics.ObserveAllocate(time.Since(start), err)
+		}()
+	}
+
+	if container, err := s.admission.admit(ctx); err != nil {
+		s.log.Info("Allocation rejected by admission policy", "container", container, "error", err)
+		return nil, err
+	}
+
+	var ids []string
+	for _, creq := range req.GetContainerRequests() {
+		ids = append(ids, creq.GetDevicesIDs()...)
+	}
+	if err := s.validate(ids); err != nil {
+		s.log.Info("Invalid allocation request", "error", err)
+		return nil, err
+	}
+	// The advertised health lags behind the device, which may have vanished
+	// since the last discovery, e.g. on module unload. A dead spec would only
+	// fail later in the container runtime. With prestart mknod the node is
+	// created in PreStartContainer instead.
+	if !s.prestartMknod {
+		if _, err := os.Stat(s.hostPath); err != nil {
+			s.log.Warn("Device is gone, rejecting allocation", "path", s.hostPath, "error", err)
+			s.Rediscover()
+			return nil, status.Errorf(codes.Unavailable, "device %s is not available: %v", s.hostPath, err)
+		}
+	}
+	if !isSelfProbe(ctx) {
+		s.recordAllocation(ids)
+		metrics.AllocationsTotal.WithLabelValues(s.Name()).Add(float64(len(req.GetContainerRequests())))
+		s.audit(ctx, ids)
+	}
+
+	// The kubelet matches responses to containers by position, so there must
+	// be exactly one response per container request, in the same order.
+	resps := make([]*v1beta1.ContainerAllocateResponse, 0, len(req.GetContainerRequests()))
+	for _, creq := range req.GetContainerRequests() {
+		key := allocationKey(creq.GetDevicesIDs())
+		resp, ok := s.cache.get(key)
+		if ok {
+			s.log.Debug("Allocation cache hit", "devices", key)
+		} else {
+			resp = s.containerResponse(creq.GetDevicesIDs())
+			s.cache.put(key, resp)
+		}
+		resps = append(resps, resp)
+	}
+
+	return &v1beta1.AllocateResponse{
+		ContainerResponses: resps,
+	}, nil
+}
+
+// validate checks that the request fits in the advertised devices and that
+// every requested device is advertised and healthy.
+func (s *Server) validate(ids []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// The kubelet must never commit more devices than advertised, even when
+	// spread across the containers of a pod.
+	if len(ids) > len(s.devs) {
+		return status.Errorf(codes.InvalidArgument,
+			"requested %d devices, only %d are advertised", len(ids), len(s.devs))
+	}
+
+	health := make(map[string]string, len(s.devs))
+	for _, dev := range s.devs {
+		health[dev.ID] = dev.Health
+	}
+
+	for _, id := range ids {
+		if _, ok := health[id]; !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown device %q", id)
+		}
+	}
+
+	// The kubelet never signals deallocation, so every device handed out and
+	// still advertised counts as outstanding. Reallocating one of them does
+	// not count twice.
+	if s.maxAllocations > 0 {
+		outstanding := map[string]struct{}{}
+		for _, dev := range s.devs {
+			if _, ok := s.lastAllocated[dev.ID]; ok {
+				outstanding[dev.ID] = struct{}{}
+			}
+		}
+		for _, id := range ids {
+			outstanding[id] = struct{}{}
+		}
+		if len(outstanding) > s.maxAllocations {
+			return status.Errorf(codes.ResourceExhausted,
+				"allocation would exceed the limit of %d devices", s.maxAllocations)
+		}
+	}
 
+	for _, id := range ids {
+		if h := health[id]; h != v1beta1.Healthy {
+			return status.Errorf(codes.Unavailable, "device %q is %s", id, h)
+		}
+	}
+	return nil
+}
+
+// audit logs an allocation along with the pod and container identifiers of
+// the request metadata, which are hashed under the hash redaction policy.
+func (s *Server) audit(ctx context.Context, ids []string) {
+	args := []any{"devices", ids}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		args = append(args, logging.Identifiers(md)...)
+	}
+	s.log.Info("Allocated devices", args...)
+}
+
+// recordAllocation stores the allocation time of the given devices.
+func (s *Server) recordAllocation(ids []string) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requested := map[string]struct{}{}
+	for _, id := range ids {
+		requested[id] = struct{}{}
+	}
+
+	// Only known devices are tracked, to keep the metric cardinality bounded.
+	for _, dev := range s.devs {
+		if _, ok := requested[dev.ID]; ok {
+			s.lastAllocated[dev.ID] = now
+			metrics.DeviceLastAllocation.WithLabelValues(s.Name(), dev.ID).Set(float64(now.Unix()))
+		}
+	}
+	s.refreshAllocatedLocked()
+}
+
+// refreshAllocatedLocked updates the allocated devices gauge. The kubelet
+// never signals deallocation, so a device counts as allocated once it was
+// handed out and is still advertised. It must be called with s.mu held.
+func (s *Server) refreshAllocatedLocked() {
+	var allocated int
+	for _, dev := range s.devs {
+		if _, ok := s.lastAllocated[dev.ID]; ok {
+			allocated++
+		}
+	}
+	metrics.DevicesAllocated.WithLabelValues(s.Name()).Set(float64(allocated))
+}
+
+func (s *Server) containerResponse(ids []string) *v1beta1.ContainerAllocateResponse {
 	devices := []*v1beta1.DeviceSpec{
 		{
-			ContainerPath: tunPath,
-			HostPath:      tunPath,
-			Permissions:   rwPerm,
+			ContainerPath: s.containerPath,
+			HostPath:      s.hostPath,
+			Permissions:   string(s.permissions),
 		},
 	}
 
-	return &v1beta1.AllocateResponse{
-		ContainerResponses: []*v1beta1.ContainerAllocateResponse{{Devices: devices}},
-	}, nil
+	envs := map[string]string{
+		s.envPrefix + "_DEVICE_IDS":   strings.Join(ids, ","),
+		s.envPrefix + "_DEVICE_COUNT": strconv.Itoa(len(ids)),
+		s.envPrefix + "_DEVICE_KIND":  s.kind.name,
+		s.envPrefix + "_IFF_FLAGS":    fmt.Sprintf("%#x", s.kind.flags),
+	}
+
+	return &v1beta1.ContainerAllocateResponse{
+		Devices:     devices,
+		Envs:        envs,
+		Annotations: s.allocationAnnotations(ids),
+		CDIDevices:  s.cdiDevices(ids),
+	}
 }
 
 func (s *Server) GetPreferredAllocation(
 	ctx context.Context,
 	req *v1beta1.PreferredAllocationRequest,
 ) (*v1beta1.PreferredAllocationResponse, error) {
-	return &v1beta1.PreferredAllocationResponse{}, nil
+	resp := &v1beta1.PreferredAllocationResponse{}
+	if s.strategy == AllocationStrategyNone {
+		return resp, nil
+	}
+
+	for _, creq := range req.GetContainerRequests() {
+		resp.ContainerResponses = append(resp.ContainerResponses, &v1beta1.ContainerPreferredAllocationResponse{
+			DeviceIDs: s.strategy.preferred(
+				creq.GetAvailableDeviceIDs(),
+				creq.GetMustIncludeDeviceIDs(),
+				int(creq.GetAllocationSize()),
+			),
+		})
+	}
+
+	return resp, nil
 }
 
 func (s *Server) PreStartContainer(
 	ctx context.Context,
 	req *v1beta1.PreStartContainerRequest,
 ) (*v1beta1.PreStartContainerResponse, error) {
+	if s.prestartMknod {
+		if err := s.ensureDevice(); err != nil {
+			s.log.Error("Failed to ensure device node", "devices", req.GetDevicesIDs(), "error", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		s.Rediscover()
+	}
 	return &v1beta1.PreStartContainerResponse{}, nil
 }
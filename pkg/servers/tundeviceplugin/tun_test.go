@@ -0,0 +1,1087 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/anza-labs/tun-manager/pkg/logging"
+	"github.com/anza-labs/tun-manager/pkg/metrics"
+
+	"k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// newTestServer returns a server advertising devices slots of a device node
+// faked by a regular file.
+func newTestServer(t *testing.T, devices uint, opts ...Option) *Server {
+	t.Helper()
+
+	hostPath := filepath.Join(t.TempDir(), "tun")
+	if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to create the device: %v", err)
+	}
+
+	opts = append([]Option{
+		WithDeviceCount(devices),
+		WithDevicePaths(hostPath, DefaultDevicePath),
+		WithProber(func() error { return nil }),
+	}, opts...)
+	s, err := New("anza-labs.dev", opts...)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	return s
+}
+
+func TestSocket(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{name: "default", want: "unix://" + v1beta1.DevicePluginPath + "tun.sock"},
+		{
+			name: "override",
+			opts: []Option{WithSocketDir("/var/lib/k3s/device-plugins")},
+			want: "unix:///var/lib/k3s/device-plugins/tun.sock",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, 1, tc.opts...)
+
+			if got := s.Socket(); got != tc.want {
+				t.Errorf("got socket %q, want %q", got, tc.want)
+			}
+			// The kubelet is registered with the socket filename only.
+			if got := filepath.Base(s.Socket()); got != "tun.sock" {
+				t.Errorf("got socket filename %q, want %q", got, "tun.sock")
+			}
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	s, err := New("anza-labs.dev")
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	if s.Name() != "anza-labs.dev/tun" {
+		t.Errorf("got resource %q, want anza-labs.dev/tun", s.Name())
+	}
+	if got := len(s.Status().Devices); got != DefaultDeviceCount {
+		t.Errorf("got %d devices, want %d", got, DefaultDeviceCount)
+	}
+	if s.hostPath != DefaultDevicePath || s.containerPath != DefaultDevicePath {
+		t.Errorf("got device %s -> %s, want %s", s.hostPath, s.containerPath, DefaultDevicePath)
+	}
+	if s.socketDir != v1beta1.DevicePluginPath {
+		t.Errorf("got socket dir %q, want %q", s.socketDir, v1beta1.DevicePluginPath)
+	}
+	if s.permissions != DevicePermissionsReadWrite {
+		t.Errorf("got permissions %q, want %q", s.permissions, DevicePermissionsReadWrite)
+	}
+	if s.maxWatchers != DefaultMaxWatchers {
+		t.Errorf("got %d max watchers, want %d", s.maxWatchers, DefaultMaxWatchers)
+	}
+	if s.envPrefix != DefaultEnvPrefix {
+		t.Errorf("got env prefix %q, want %q", s.envPrefix, DefaultEnvPrefix)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	hostPath := filepath.Join(t.TempDir(), "tun")
+	var logs bytes.Buffer
+
+	s, err := New("anza-labs.dev",
+		WithKind(KindTAP),
+		WithDeviceCount(3),
+		WithDevicePaths(hostPath, "/dev/custom/tun"),
+		WithDevicePermissions(DevicePermissionsRead),
+		WithSocketDir("/var/lib/k3s/device-plugins"),
+		WithMaxWatchers(1),
+		WithEnvPrefix("CUSTOM"),
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+	)
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+
+	if s.Name() != "anza-labs.dev/tap" {
+		t.Errorf("got resource %q, want anza-labs.dev/tap", s.Name())
+	}
+	if got := len(s.Status().Devices); got != 3 {
+		t.Errorf("got %d devices, want 3", got)
+	}
+	if s.hostPath != hostPath || s.containerPath != "/dev/custom/tun" {
+		t.Errorf("got device %s -> %s, want %s -> /dev/custom/tun", s.hostPath, s.containerPath, hostPath)
+	}
+	if s.Socket() != "unix:///var/lib/k3s/device-plugins/tap.sock" {
+		t.Errorf("got socket %q, want it in the custom dir", s.Socket())
+	}
+	if s.permissions != DevicePermissionsRead {
+		t.Errorf("got permissions %q, want %q", s.permissions, DevicePermissionsRead)
+	}
+	if s.maxWatchers != 1 {
+		t.Errorf("got %d max watchers, want 1", s.maxWatchers)
+	}
+	if s.envPrefix != "CUSTOM" {
+		t.Errorf("got env prefix %q, want CUSTOM", s.envPrefix)
+	}
+	s.log.Info("probe")
+	if !strings.Contains(logs.String(), "msg=probe resource=tap") {
+		t.Errorf("the logger is not used: %q", logs.String())
+	}
+
+	// A nil logger keeps the default one.
+	if s, err := New("anza-labs.dev", WithLogger(nil)); err != nil || s.log == nil {
+		t.Errorf("New(WithLogger(nil)) = %v, %v, want the default logger", s, err)
+	}
+}
+
+func TestWatcherCoalescing(t *testing.T) {
+	s := newTestServer(t, 4)
+
+	updates, stop, err := s.watch()
+	if err != nil {
+		t.Fatalf("watch() failed: %v", err)
+	}
+	defer stop()
+
+	coalesced := testutil.ToFloat64(metrics.ListAndWatchCoalesced)
+
+	// A slow watcher reads nothing while the state changes four times.
+	for _, id := range []string{"tun0", "tun1", "tun2", "tun3"} {
+		s.SetDrained(true, id)
+	}
+
+	if len(updates) != 1 {
+		t.Fatalf("got %d pending updates, want 1", len(updates))
+	}
+	if got := testutil.ToFloat64(metrics.ListAndWatchCoalesced) - coalesced; got != 3 {
+		t.Errorf("got %v coalesced states, want 3", got)
+	}
+
+	// Only the latest state, with every device drained, is delivered.
+	for _, dev := range <-updates {
+		if dev.Health != v1beta1.Unhealthy {
+			t.Errorf("got device %s %s, want %s", dev.ID, dev.Health, v1beta1.Unhealthy)
+		}
+	}
+	if len(updates) != 0 {
+		t.Errorf("got %d pending updates after reading the latest, want 0", len(updates))
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	s := newTestServer(t, 4)
+	s.SetDrained(true, "tun3")
+
+	for _, tc := range []struct {
+		name       string
+		containers [][]string
+		want       codes.Code
+	}{
+		{name: "single container", containers: [][]string{{"tun0"}}},
+		{name: "two containers", containers: [][]string{{"tun0"}, {"tun1", "tun2"}}},
+		{name: "unknown device", containers: [][]string{{"tun0"}, {"tun9"}}, want: codes.InvalidArgument},
+		{name: "unhealthy device", containers: [][]string{{"tun3"}}, want: codes.Unavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &v1beta1.AllocateRequest{}
+			for _, ids := range tc.containers {
+				req.ContainerRequests = append(req.ContainerRequests, &v1beta1.ContainerAllocateRequest{DevicesIDs: ids})
+			}
+
+			resp, err := s.Allocate(t.Context(), req)
+			if status.Code(err) != tc.want {
+				t.Fatalf("Allocate() = %v, want %s", err, tc.want)
+			}
+			if tc.want != codes.OK {
+				return
+			}
+
+			// Every container gets its own response, in the request order.
+			if len(resp.GetContainerResponses()) != len(tc.containers) {
+				t.Fatalf("got %d container responses, want %d", len(resp.GetContainerResponses()), len(tc.containers))
+			}
+			for i, cresp := range resp.GetContainerResponses() {
+				if len(cresp.GetDevices()) != 1 || cresp.GetDevices()[0].GetContainerPath() != DefaultDevicePath {
+					t.Errorf("container %d: got devices %v, want %s", i, cresp.GetDevices(), DefaultDevicePath)
+				}
+				want := strings.Join(tc.containers[i], ",")
+				if got := cresp.GetEnvs()[DefaultEnvPrefix+"_DEVICE_IDS"]; got != want {
+					t.Errorf("container %d: got device IDs %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateRemovedDevice(t *testing.T) {
+	s := newTestServer(t, 2)
+
+	// The module is unloaded between two discoveries.
+	if err := os.Remove(s.hostPath); err != nil {
+		t.Fatalf("failed to remove the device: %v", err)
+	}
+
+	_, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun0"}}},
+	})
+	if status.Code(err) != codes.Unavailable || !strings.Contains(err.Error(), s.hostPath) {
+		t.Fatalf("Allocate() = %v, want %s naming the device", err, codes.Unavailable)
+	}
+
+	// The kubelet learns about the missing device right away.
+	for _, dev := range s.Status().Devices {
+		if dev.Health != v1beta1.Unhealthy {
+			t.Errorf("got device %s %s, want %s", dev.ID, dev.Health, v1beta1.Unhealthy)
+		}
+	}
+}
+
+func TestGetPreferredAllocation(t *testing.T) {
+	available := []string{"tun7", "tun0", "tun5", "tun1", "tun3", "tun6", "tun2", "tun4"}
+
+	for _, tc := range []struct {
+		name        string
+		strategy    AllocationStrategy
+		mustInclude []string
+		size        int32
+		want        []string
+	}{
+		{name: "packed", strategy: AllocationStrategyPacked, size: 3, want: []string{"tun0", "tun1", "tun2"}},
+		{name: "spread", strategy: AllocationStrategySpread, size: 4, want: []string{"tun0", "tun2", "tun4", "tun6"}},
+		{
+			name:        "packed with required devices",
+			strategy:    AllocationStrategyPacked,
+			mustInclude: []string{"tun5"},
+			size:        3,
+			want:        []string{"tun5", "tun0", "tun1"},
+		},
+		{
+			name:        "spread with required devices",
+			strategy:    AllocationStrategySpread,
+			mustInclude: []string{"tun7"},
+			size:        3,
+			want:        []string{"tun7", "tun0", "tun3"},
+		},
+		{name: "more than available", strategy: AllocationStrategyPacked, size: 10, want: []string{
+			"tun0", "tun1", "tun2", "tun3", "tun4", "tun5", "tun6", "tun7",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, 8, WithAllocationStrategy(tc.strategy))
+
+			opts, err := s.GetDevicePluginOptions(t.Context(), &v1beta1.Empty{})
+			if err != nil || !opts.GetGetPreferredAllocationAvailable() {
+				t.Fatalf("GetDevicePluginOptions() = %v, %v, want preferred allocation available", opts, err)
+			}
+
+			resp, err := s.GetPreferredAllocation(t.Context(), &v1beta1.PreferredAllocationRequest{
+				ContainerRequests: []*v1beta1.ContainerPreferredAllocationRequest{{
+					AvailableDeviceIDs:   available,
+					MustIncludeDeviceIDs: tc.mustInclude,
+					AllocationSize:       tc.size,
+				}},
+			})
+			if err != nil {
+				t.Fatalf("GetPreferredAllocation() failed: %v", err)
+			}
+			if got := resp.GetContainerResponses()[0].GetDeviceIDs(); !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetPreferredAllocationDisabled(t *testing.T) {
+	s := newTestServer(t, 4)
+
+	opts, err := s.GetDevicePluginOptions(t.Context(), &v1beta1.Empty{})
+	if err != nil || opts.GetGetPreferredAllocationAvailable() {
+		t.Fatalf("GetDevicePluginOptions() = %v, %v, want preferred allocation unavailable", opts, err)
+	}
+
+	resp, err := s.GetPreferredAllocation(t.Context(), &v1beta1.PreferredAllocationRequest{
+		ContainerRequests: []*v1beta1.ContainerPreferredAllocationRequest{{
+			AvailableDeviceIDs: []string{"tun0", "tun1"},
+			AllocationSize:     1,
+		}},
+	})
+	if err != nil || len(resp.GetContainerResponses()) != 0 {
+		t.Errorf("GetPreferredAllocation() = %v, %v, want an empty response", resp, err)
+	}
+}
+
+func TestAllocateAdvertisedLimit(t *testing.T) {
+	s := newTestServer(t, 3)
+
+	for _, tc := range []struct {
+		name       string
+		containers [][]string
+		want       codes.Code
+	}{
+		{name: "at the limit", containers: [][]string{{"tun0", "tun1"}, {"tun2"}}},
+		{name: "over the limit", containers: [][]string{{"tun0", "tun1"}, {"tun2", "tun0"}}, want: codes.InvalidArgument},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &v1beta1.AllocateRequest{}
+			for _, ids := range tc.containers {
+				req.ContainerRequests = append(req.ContainerRequests, &v1beta1.ContainerAllocateRequest{DevicesIDs: ids})
+			}
+
+			if _, err := s.Allocate(t.Context(), req); status.Code(err) != tc.want {
+				t.Errorf("Allocate() = %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestAllocateMaxAllocations(t *testing.T) {
+	s := newTestServer(t, 4, WithMaxAllocations(2))
+
+	for _, dev := range s.snapshot()[2:] {
+		if dev.Health != v1beta1.Unhealthy {
+			t.Errorf("got capped device %s %s, want %s", dev.ID, dev.Health, v1beta1.Unhealthy)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		ids  []string
+		want codes.Code
+	}{
+		{name: "below the cap", ids: []string{"tun0"}},
+		{name: "reaching the cap", ids: []string{"tun1"}},
+		{name: "reallocating an outstanding device", ids: []string{"tun0", "tun1"}},
+		{name: "beyond the cap", ids: []string{"tun2"}, want: codes.ResourceExhausted},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: tc.ids}},
+			}
+			if _, err := s.Allocate(t.Context(), req); status.Code(err) != tc.want {
+				t.Errorf("Allocate() = %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
+
+// failingStream is a ListAndWatch stream whose sends fail after the first ok ones.
+type failingStream struct {
+	grpc.ServerStream
+
+	ctx   context.Context
+	ok    int
+	sends int
+}
+
+func (s *failingStream) Context() context.Context { return s.ctx }
+
+func (s *failingStream) Send(*v1beta1.ListAndWatchResponse) error {
+	s.sends++
+	if s.sends > s.ok {
+		return errors.New("transport is closing")
+	}
+	return nil
+}
+
+func TestListAndWatchSendError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   int
+	}{
+		{name: "initial list", ok: 0},
+		{name: "update", ok: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, 2)
+			stream := &failingStream{ctx: t.Context(), ok: tc.ok}
+			sendErrors := testutil.ToFloat64(metrics.ListAndWatchSendErrors.WithLabelValues(s.Name()))
+
+			done := make(chan error, 1)
+			go func() { done <- s.ListAndWatch(&v1beta1.Empty{}, stream) }()
+
+			// The update is only sent once the stream is watching, keep
+			// changing the state until the stream gives up.
+			tick := time.NewTicker(10 * time.Millisecond)
+			defer tick.Stop()
+			timeout := time.After(5 * time.Second)
+			for drained := true; ; drained = !drained {
+				select {
+				case err := <-done:
+					if err == nil {
+						t.Fatal("ListAndWatch() returned nil, want the send error")
+					}
+					if stream.sends != tc.ok+1 {
+						t.Errorf("got %d sends, want %d", stream.sends, tc.ok+1)
+					}
+					got := testutil.ToFloat64(metrics.ListAndWatchSendErrors.WithLabelValues(s.Name())) - sendErrors
+					if got != 1 {
+						t.Errorf("got %v send errors, want 1", got)
+					}
+					return
+				case <-tick.C:
+					s.SetDrained(drained)
+				case <-timeout:
+					t.Fatal("ListAndWatch() did not return after a failed send")
+				}
+			}
+		})
+	}
+}
+
+func TestDrainedGauge(t *testing.T) {
+	s := newTestServer(t, 4)
+	drained := metrics.DevicesDrained.WithLabelValues(s.Name())
+	unhealthy := metrics.DevicesUnhealthy.WithLabelValues(s.Name())
+
+	s.SetDrained(true, "tun0", "tun2")
+	if got := testutil.ToFloat64(drained); got != 2 {
+		t.Errorf("got %v drained devices, want 2", got)
+	}
+	if got := testutil.ToFloat64(unhealthy); got != 0 {
+		t.Errorf("got %v unhealthy devices, want 0", got)
+	}
+
+	// A missing device makes every slot unhealthy, drained or not.
+	if err := os.Remove(s.hostPath); err != nil {
+		t.Fatalf("failed to remove the device: %v", err)
+	}
+	s.Rediscover()
+	if got := testutil.ToFloat64(drained); got != 0 {
+		t.Errorf("got %v drained devices, want 0", got)
+	}
+	if got := testutil.ToFloat64(unhealthy); got != 4 {
+		t.Errorf("got %v unhealthy devices, want 4", got)
+	}
+
+	s.SetDrained(false)
+	if err := os.WriteFile(s.hostPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to recreate the device: %v", err)
+	}
+	s.Rediscover()
+	if got := testutil.ToFloat64(drained) + testutil.ToFloat64(unhealthy); got != 0 {
+		t.Errorf("got %v drained or unhealthy devices, want 0", got)
+	}
+}
+
+// recordingStream is a ListAndWatch stream recording the sent device lists.
+type recordingStream struct {
+	grpc.ServerStream
+
+	ctx   context.Context
+	sends chan []*v1beta1.Device
+}
+
+func (s *recordingStream) Context() context.Context { return s.ctx }
+
+func (s *recordingStream) Send(resp *v1beta1.ListAndWatchResponse) error {
+	select {
+	case s.sends <- resp.GetDevices():
+	default:
+	}
+	return nil
+}
+
+// TestConcurrentAccess is meant to be run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	s := newTestServer(t, 8)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	var watchers, writers sync.WaitGroup
+	for range 2 {
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			stream := &recordingStream{ctx: ctx, sends: make(chan []*v1beta1.Device, 1)}
+			if err := s.ListAndWatch(&v1beta1.Empty{}, stream); err != nil {
+				t.Errorf("ListAndWatch() = %v", err)
+			}
+		}()
+	}
+
+	for i := range 4 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for range 50 {
+				id := fmt.Sprintf("tun%d", i)
+				_, _ = s.Allocate(ctx, &v1beta1.AllocateRequest{
+					ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{id}}},
+				})
+				_ = s.Status()
+			}
+		}()
+	}
+
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for i := range 50 {
+			s.SetDrained(i%2 == 0, "tun7")
+			s.Rediscover()
+			s.Reload(uint(8 + i%2))
+		}
+	}()
+
+	writers.Wait()
+	cancel()
+	watchers.Wait()
+}
+
+func TestAllocateContainerOrder(t *testing.T) {
+	s := newTestServer(t, 8)
+
+	containers := [][]string{{"tun4"}, {"tun0", "tun1"}, {"tun7", "tun2", "tun3"}}
+	req := &v1beta1.AllocateRequest{}
+	for _, ids := range containers {
+		req.ContainerRequests = append(req.ContainerRequests, &v1beta1.ContainerAllocateRequest{DevicesIDs: ids})
+	}
+
+	resp, err := s.Allocate(t.Context(), req)
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	if len(resp.GetContainerResponses()) != 3 {
+		t.Fatalf("got %d container responses, want 3", len(resp.GetContainerResponses()))
+	}
+	for i, cresp := range resp.GetContainerResponses() {
+		env := cresp.GetEnvs()
+		if got, want := env[DefaultEnvPrefix+"_DEVICE_IDS"], strings.Join(containers[i], ","); got != want {
+			t.Errorf("container %d: got device IDs %q, want %q", i, got, want)
+		}
+		if got, want := env[DefaultEnvPrefix+"_DEVICE_COUNT"], strconv.Itoa(len(containers[i])); got != want {
+			t.Errorf("container %d: got device count %s, want %s", i, got, want)
+		}
+		if len(cresp.GetDevices()) != 1 {
+			t.Errorf("container %d: got %d device specs, want 1", i, len(cresp.GetDevices()))
+		}
+	}
+}
+
+func TestAllocateWithoutWatcher(t *testing.T) {
+	s := newTestServer(t, 4)
+	goroutines := runtime.NumGoroutine()
+
+	// Allocations and state changes never block while the kubelet is not
+	// watching.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 10 {
+			_, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun0"}}},
+			})
+			if err != nil {
+				t.Errorf("Allocate() failed: %v", err)
+			}
+			s.SetDrained(true, "tun3")
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Allocate() blocked without a watcher")
+	}
+
+	// Nothing is left running once they return.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > goroutines {
+		t.Errorf("got %d goroutines, want at most %d", got, goroutines)
+	}
+
+	// A reconnecting kubelet receives the latest device list exactly once.
+	ctx, cancel := context.WithCancel(t.Context())
+	stream := &recordingStream{ctx: ctx, sends: make(chan []*v1beta1.Device, 4)}
+	watched := make(chan error, 1)
+	go func() { watched <- s.ListAndWatch(&v1beta1.Empty{}, stream) }()
+
+	select {
+	case devs := <-stream.sends:
+		if devs[3].Health != v1beta1.Unhealthy {
+			t.Errorf("got device %s %s, want the drained state", devs[3].ID, devs[3].Health)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListAndWatch() sent no device list")
+	}
+	select {
+	case devs := <-stream.sends:
+		t.Errorf("got a second device list %v", devs)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("ListAndWatch() = %v, want nil", err)
+	}
+}
+
+func TestSetNodeDrained(t *testing.T) {
+	s := newTestServer(t, 3)
+
+	health := func() map[string]string {
+		got := map[string]string{}
+		for _, dev := range s.snapshot() {
+			got[dev.ID] = dev.Health
+		}
+		return got
+	}
+
+	// An operator drains one slot through the admin service.
+	s.SetDrained(true, "tun1")
+
+	s.SetNodeDrained(true)
+	for id, h := range health() {
+		if h != v1beta1.Unhealthy {
+			t.Errorf("node drained: got device %s %s, want %s", id, h, v1beta1.Unhealthy)
+		}
+	}
+
+	// Restoring the node keeps the operator drain.
+	s.SetNodeDrained(false)
+	want := map[string]string{"tun0": v1beta1.Healthy, "tun1": v1beta1.Unhealthy, "tun2": v1beta1.Healthy}
+	if got := health(); !maps.Equal(got, want) {
+		t.Errorf("node restored: got %v, want %v", got, want)
+	}
+	for _, dev := range s.Status().Devices {
+		if dev.Drained != (dev.ID == "tun1") {
+			t.Errorf("got device %s drained %t, want %t", dev.ID, dev.Drained, dev.ID == "tun1")
+		}
+	}
+}
+
+// logRecords decodes the JSON log records of buf with the given message.
+func logRecords(t *testing.T, buf *bytes.Buffer, msg string) []map[string]any {
+	t.Helper()
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		rec := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("failed to decode %q: %v", line, err)
+		}
+		if rec["msg"] == msg {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func TestHealthTransitionLog(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestServer(t, 4, WithLogger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	buf.Reset()
+
+	s.SetDrained(true, "tun0", "tun1", "tun2")
+	s.SetDrained(true, "tun0")
+	s.SetDrained(false, "tun1")
+
+	// One record per transition and reason, none when nothing changed.
+	want := []map[string]any{
+		{"old": v1beta1.Healthy, "new": v1beta1.Unhealthy, "reason": reasonDrain, "devices": 3.0},
+		{"old": v1beta1.Unhealthy, "new": v1beta1.Healthy, "reason": reasonDrain, "devices": 1.0},
+	}
+	records := logRecords(t, &buf, "Device health transition")
+	if len(records) != len(want) {
+		t.Fatalf("got %d transition records, want %d: %s", len(records), len(want), buf.String())
+	}
+	for i, rec := range records {
+		for key, value := range want[i] {
+			if rec[key] != value {
+				t.Errorf("record %d: got %s=%v, want %v", i, key, rec[key], value)
+			}
+		}
+	}
+}
+
+func TestAllocateAudit(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := logging.Redact(slog.NewJSONHandler(&buf, nil), logging.RedactHash)
+	if err != nil {
+		t.Fatalf("Redact() failed: %v", err)
+	}
+	s := newTestServer(t, 2, WithLogger(slog.New(handler)))
+
+	ctx := metadata.NewIncomingContext(t.Context(), metadata.Pairs("container-name", "app", "pod-name", "web-0"))
+	req := &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{"tun0"}}},
+	}
+	if _, err := s.Allocate(ctx, req); err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+
+	records := logRecords(t, &buf, "Allocated devices")
+	if len(records) != 1 {
+		t.Fatalf("got %d audit records, want 1: %s", len(records), buf.String())
+	}
+	audit := records[0]
+	if audit["container"] != logging.Hash("app") || audit["pod"] != logging.Hash("web-0") {
+		t.Errorf("got container %v and pod %v, want them hashed", audit["container"], audit["pod"])
+	}
+}
+
+// startListAndWatch runs ListAndWatch until the test ends and waits for the
+// initial device list.
+func startListAndWatch(t *testing.T, s *Server) *recordingStream {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stream := &recordingStream{ctx: ctx, sends: make(chan []*v1beta1.Device, 1)}
+	done := make(chan error, 1)
+	go func() { done <- s.ListAndWatch(&v1beta1.Empty{}, stream) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	select {
+	case <-stream.sends:
+	case err := <-done:
+		t.Fatalf("ListAndWatch() = %v before sending the device list", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListAndWatch() sent no device list")
+	}
+	return stream
+}
+
+func TestListAndWatchLimit(t *testing.T) {
+	s := newTestServer(t, 2, WithMaxWatchers(2))
+	rejected := metrics.ListAndWatchRejected.WithLabelValues(s.Name())
+	before := testutil.ToFloat64(rejected)
+
+	// Streams up to the limit are served.
+	ctx, cancel := context.WithCancel(t.Context())
+	first := &recordingStream{ctx: ctx, sends: make(chan []*v1beta1.Device, 1)}
+	done := make(chan error, 1)
+	go func() { done <- s.ListAndWatch(&v1beta1.Empty{}, first) }()
+	<-first.sends
+	startListAndWatch(t, s)
+
+	stream := &recordingStream{ctx: t.Context(), sends: make(chan []*v1beta1.Device, 1)}
+	if err := s.ListAndWatch(&v1beta1.Empty{}, stream); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("ListAndWatch() = %v, want %s", err, codes.ResourceExhausted)
+	}
+	if len(stream.sends) != 0 {
+		t.Error("the rejected stream received a device list")
+	}
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("got %v rejected streams, want 1", got)
+	}
+
+	// A stream ending releases its slot.
+	cancel()
+	<-done
+	startListAndWatch(t, s)
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("got %v rejected streams after a slot was released, want 1", got)
+	}
+}
+
+func TestListAndWatchActiveStreams(t *testing.T) {
+	s := newTestServer(t, 2)
+	streams := metrics.ListAndWatchActiveStreams.WithLabelValues(s.Name())
+	before := testutil.ToFloat64(streams)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stream := &recordingStream{ctx: ctx, sends: make(chan []*v1beta1.Device, 1)}
+	done := make(chan error, 1)
+	go func() { done <- s.ListAndWatch(&v1beta1.Empty{}, stream) }()
+
+	select {
+	case <-stream.sends:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListAndWatch() sent no device list")
+	}
+	if got := testutil.ToFloat64(streams) - before; got != 1 {
+		t.Errorf("got %v active streams, want 1", got)
+	}
+
+	// The kubelet disconnects.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListAndWatch() did not return")
+	}
+	if got := testutil.ToFloat64(streams) - before; got != 0 {
+		t.Errorf("got %v active streams after the disconnect, want 0", got)
+	}
+}
+
+func TestDiscoveryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy     DiscoveryPolicy
+		discovered uint
+		want       uint
+	}{
+		{policy: DiscoveryPolicyCap, discovered: 1, want: 2},
+		{policy: DiscoveryPolicyCap, discovered: 2, want: 2},
+		{policy: DiscoveryPolicyCap, discovered: 5, want: 2},
+		{policy: DiscoveryPolicyExpand, discovered: 1, want: 2},
+		{policy: DiscoveryPolicyExpand, discovered: 2, want: 2},
+		{policy: DiscoveryPolicyExpand, discovered: 5, want: 5},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", tc.policy, tc.discovered), func(t *testing.T) {
+			s := newTestServer(t, 2, WithDiscoveryPolicy(tc.policy))
+			if got := s.slots(tc.discovered); got != tc.want {
+				t.Errorf("slots(%d) = %d, want %d", tc.discovered, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLastAllocated(t *testing.T) {
+	s := newTestServer(t, 2)
+
+	before := time.Now()
+	allocateOne(t, s, "tun0")
+	after := time.Now()
+
+	devs := s.Status().Devices
+	last := devs[0].LastAllocated
+	if last == nil || last.Before(before) || last.After(after) {
+		t.Fatalf("got last allocation %v, want between %s and %s", last, before, after)
+	}
+	if devs[1].LastAllocated != nil {
+		t.Errorf("got last allocation %s for a device never allocated", devs[1].LastAllocated)
+	}
+
+	gauge := metrics.DeviceLastAllocation.WithLabelValues(s.Name(), "tun0")
+	if got := testutil.ToFloat64(gauge); got != float64(last.Unix()) {
+		t.Errorf("got last allocation metric %v, want %d", got, last.Unix())
+	}
+
+	// Allocating again moves the timestamp forward.
+	time.Sleep(time.Millisecond)
+	allocateOne(t, s, "tun0")
+	if again := s.Status().Devices[0].LastAllocated; again == nil || !again.After(*last) {
+		t.Errorf("got last allocation %v, want after %s", again, last)
+	}
+}
+
+// TestConcurrentReload is meant to be run with -race.
+func TestConcurrentReload(t *testing.T) {
+	s := newTestServer(t, 2)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stream := &recordingStream{ctx: ctx, sends: make(chan []*v1beta1.Device, 1)}
+	watched := make(chan error, 1)
+	go func() { watched <- s.ListAndWatch(&v1beta1.Empty{}, stream) }()
+
+	// Every device list sent is complete, never a partially rebuilt one.
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for devs := range stream.sends {
+			if len(devs)%2 != 0 || len(devs) == 0 || len(devs) > 8 {
+				t.Errorf("got %d devices, want one of the reloaded counts", len(devs))
+			}
+			for i, dev := range devs {
+				if want := fmt.Sprintf("tun%d", i); dev.ID != want {
+					t.Errorf("got device %s at %d, want %s", dev.ID, i, want)
+				}
+			}
+		}
+	}()
+
+	var reloaders sync.WaitGroup
+	for g := range 4 {
+		reloaders.Add(1)
+		go func() {
+			defer reloaders.Done()
+			for i := range 100 {
+				s.Reload(uint(2 * (1 + (g+i)%4)))
+			}
+		}()
+	}
+	reloaders.Wait()
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("ListAndWatch() = %v, want nil", err)
+	}
+	close(stream.sends)
+	<-checked
+
+	st := s.Status()
+	if got := len(st.Devices); got != int(s.devices) {
+		t.Errorf("got %d devices in the status, want the last reloaded count %d", got, s.devices)
+	}
+}
+
+func TestReloadListAndWatch(t *testing.T) {
+	s := newTestServer(t, 2)
+	stream := startListAndWatch(t, s)
+
+	for _, devices := range []uint{4, 1} {
+		s.Reload(devices)
+
+		select {
+		case devs := <-stream.sends:
+			if len(devs) != int(devices) {
+				t.Errorf("got %d devices after Reload(%d), want %d", len(devs), devices, devices)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ListAndWatch() sent no device list after Reload(%d)", devices)
+		}
+	}
+}
+
+func TestAllocationMetrics(t *testing.T) {
+	s := newTestServer(t, 4)
+	allocations := metrics.AllocationsTotal.WithLabelValues(s.Name())
+	before := testutil.ToFloat64(allocations)
+	allocated := metrics.DevicesAllocated.WithLabelValues(s.Name())
+
+	_, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+		ContainerRequests: []*v1beta1.ContainerAllocateRequest{
+			{DevicesIDs: []string{"tun0"}},
+			{DevicesIDs: []string{"tun3"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Allocate() failed: %v", err)
+	}
+	allocateOne(t, s, "tun0")
+
+	// Every container counts, every device only once.
+	if got := testutil.ToFloat64(allocations) - before; got != 3 {
+		t.Errorf("got %v allocations, want 3", got)
+	}
+	if got := testutil.ToFloat64(allocated); got != 2 {
+		t.Errorf("got %v allocated devices, want 2", got)
+	}
+
+	// Devices no longer advertised are no longer counted.
+	s.Reload(2)
+	if got := testutil.ToFloat64(allocated); got != 1 {
+		t.Errorf("got %v allocated devices after the reload, want 1", got)
+	}
+}
+
+// allocateSamples returns the number of Allocate durations recorded with
+// outcome.
+func allocateSamples(t *testing.T, outcome string) uint64 {
+	t.Helper()
+
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "tun_allocate_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetLabel()[0].GetValue() == outcome {
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestAllocateDuration(t *testing.T) {
+	if err := metrics.RegisterAllocateLatency(metrics.LatencyHistogram, nil); err != nil {
+		t.Fatalf("RegisterAllocateLatency() failed: %v", err)
+	}
+	s := newTestServer(t, 4)
+
+	for _, tc := range []struct {
+		outcome string
+		id      string
+	}{
+		{outcome: metrics.OutcomeSuccess, id: "tun0"},
+		{outcome: metrics.OutcomeError, id: "tun9"},
+	} {
+		t.Run(tc.outcome, func(t *testing.T) {
+			before := allocateSamples(t, tc.outcome)
+
+			_, err := s.Allocate(t.Context(), &v1beta1.AllocateRequest{
+				ContainerRequests: []*v1beta1.ContainerAllocateRequest{{DevicesIDs: []string{tc.id}}},
+			})
+			if (err != nil) != (tc.outcome == metrics.OutcomeError) {
+				t.Fatalf("Allocate(%s) = %v, want outcome %s", tc.id, err, tc.outcome)
+			}
+
+			if got := allocateSamples(t, tc.outcome) - before; got != 1 {
+				t.Errorf("got %d %s samples, want 1", got, tc.outcome)
+			}
+		})
+	}
+}
+
+func TestCustomContainerPath(t *testing.T) {
+	hostPath := filepath.Join(t.TempDir(), "tun")
+	if err := os.WriteFile(hostPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to create the device: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		containerPath string
+		want          string
+	}{
+		{name: "default", want: DefaultDevicePath},
+		{name: "custom", containerPath: "/dev/vpn/tun", want: "/dev/vpn/tun"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			specPath := filepath.Join(t.TempDir(), "cdi.json")
+			s := newTestServer(t, 1, WithDevicePaths(hostPath, tc.containerPath), WithCDI(specPath))
+
+			specs := allocateOne(t, s, "tun0").GetDevices()
+			if len(specs) != 1 || specs[0].GetContainerPath() != tc.want || specs[0].GetHostPath() != hostPath {
+				t.Errorf("got device specs %v, want %s mounted at %s", specs, hostPath, tc.want)
+			}
+
+			// The CDI spec exposes the device at the same path.
+			if got := specDeviceNode(t, readCDISpec(t, specPath), 0)["path"]; got != tc.want {
+				t.Errorf("got CDI device node path %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	dns1123SubdomainMaxLength = 253
+	qualifiedNameMaxLength    = 63
+)
+
+var qualifiedNameRegexp = regexp.MustCompile(`^([A-Za-z0-9][-A-Za-z0-9_.]*)?[A-Za-z0-9]$`)
+
+var dns1123SubdomainRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// ValidateNamespace checks that the plugin namespace is a DNS-1123 subdomain.
+func ValidateNamespace(namespace string) error {
+	if len(namespace) > dns1123SubdomainMaxLength {
+		return fmt.Errorf("invalid namespace %q: must be no more than %d characters",
+			namespace, dns1123SubdomainMaxLength)
+	}
+	if !dns1123SubdomainRegexp.MatchString(namespace) {
+		return fmt.Errorf("invalid namespace %q: must be a lowercase DNS-1123 subdomain", namespace)
+	}
+	return nil
+}
+
+// validateResourceName checks that namespace/name is a valid extended
+// resource name.
+func validateResourceName(namespace, name string) error {
+	if err := ValidateNamespace(namespace); err != nil {
+		return err
+	}
+	if namespace == "kubernetes.io" || strings.HasSuffix(namespace, ".kubernetes.io") {
+		return fmt.Errorf("invalid namespace %q: the kubernetes.io domain is reserved", namespace)
+	}
+	if len(name) > qualifiedNameMaxLength || !qualifiedNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid resource name %q: must be a qualified name of at most %d characters",
+			name, qualifiedNameMaxLength)
+	}
+	return nil
+}
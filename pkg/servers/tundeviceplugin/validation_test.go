@@ -0,0 +1,100 @@
+// Copyright 2025 anza-labs contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tundeviceplugin
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateNamespace(t *testing.T) {
+	for _, tc := range []struct {
+		namespace string
+		valid     bool
+	}{
+		{namespace: "devices.anza-labs.dev", valid: true},
+		{namespace: "example.com", valid: true},
+		{namespace: "tun", valid: true},
+		{namespace: "", valid: false},
+		{namespace: "Devices.example.com", valid: false},
+		{namespace: "-example.com", valid: false},
+		{namespace: "example.com.", valid: false},
+		{namespace: "example_com", valid: false},
+		{namespace: "devices/example.com", valid: false},
+		{namespace: strings.Repeat("a.", 127) + "a", valid: false},
+	} {
+		t.Run(tc.namespace, func(t *testing.T) {
+			err := ValidateNamespace(tc.namespace)
+			if tc.valid != (err == nil) {
+				t.Fatalf("ValidateNamespace(%q) = %v, want valid %t", tc.namespace, err, tc.valid)
+			}
+
+			s, err := New(tc.namespace,
+				WithDevicePaths(filepath.Join(t.TempDir(), "tun"), DefaultDevicePath),
+				WithProber(func() error { return nil }),
+			)
+			if !tc.valid {
+				if err == nil {
+					t.Fatalf("New(%q) succeeded, want an error", tc.namespace)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("New(%q) failed: %v", tc.namespace, err)
+			}
+			if want := tc.namespace + "/tun"; s.Name() != want {
+				t.Errorf("got resource name %q, want %q", s.Name(), want)
+			}
+		})
+	}
+}
+
+func TestNewResourceName(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		namespace string
+		resource  string
+		wantErr   string
+	}{
+		{name: "valid", namespace: "anza-labs.dev", resource: "tun"},
+		{name: "mixed case resource", namespace: "anza-labs.dev", resource: "Tun_0.a"},
+		{name: "reserved domain", namespace: "kubernetes.io", resource: "tun", wantErr: "reserved"},
+		{name: "reserved subdomain", namespace: "devices.kubernetes.io", resource: "tun", wantErr: "reserved"},
+		{name: "uppercase namespace", namespace: "Anza-Labs.dev", resource: "tun", wantErr: "invalid namespace"},
+		{name: "slash in resource", namespace: "anza-labs.dev", resource: "net/tun", wantErr: "invalid resource name"},
+		{name: "leading dash", namespace: "anza-labs.dev", resource: "-tun", wantErr: "invalid resource name"},
+		{name: "trailing dot", namespace: "anza-labs.dev", resource: "tun.", wantErr: "invalid resource name"},
+		{name: "space", namespace: "anza-labs.dev", resource: "tun 0", wantErr: "invalid resource name"},
+		{name: "too long", namespace: "anza-labs.dev", resource: strings.Repeat("t", 64), wantErr: "invalid resource name"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.namespace,
+				WithResourceName(tc.resource),
+				WithDevicePaths(filepath.Join(t.TempDir(), "tun"), DefaultDevicePath),
+				WithProber(func() error { return nil }),
+			)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Errorf("New() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("New() = %v, want an error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}